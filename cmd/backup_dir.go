@@ -0,0 +1,50 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/fidrasofyan/db-backup/internal/config"
+	"github.com/spf13/cobra"
+)
+
+var (
+	backupDirNamesFlag []string
+	backupDirFlags     backupFlags
+)
+
+var backupDirCmd = &cobra.Command{
+	Use:   "backup-dir",
+	Short: "Archive directories and upload to S3-compatible storage",
+	Run: func(cmd *cobra.Command, args []string) {
+		runBackupCommand(&backupDirFlags, func(runCfg *config.Config) error {
+			// Databases are backed up by backup-db
+			dirConfigs := runCfg.BackupDirs
+			runCfg.DBConfigurations = nil
+			runCfg.BackupDirs = nil
+			for _, dirConfig := range dirConfigs {
+				if len(backupDirNamesFlag) == 0 || slices.Contains(backupDirNamesFlag, dirConfig.Name) {
+					runCfg.BackupDirs = append(runCfg.BackupDirs, dirConfig)
+				}
+			}
+			if len(runCfg.BackupDirs) == 0 {
+				return errors.New("no matching backup_dirs configured")
+			}
+			for _, dirConfig := range runCfg.BackupDirs {
+				if dirConfig.Mode == "snapshot" && backupDirFlags.noUpload {
+					return fmt.Errorf("--no-upload cannot be used with snapshot mode (%s)", dirConfig.Name)
+				}
+			}
+			return nil
+		})
+	},
+}
+
+func init() {
+	// Flags
+	backupDirFlags.register(backupDirCmd, "directory", "archives")
+	backupDirCmd.Flags().StringSliceVar(&backupDirNamesFlag, "name", nil, "Only back up the backup_dirs entries with these names. Defaults to all.")
+
+	rootCmd.AddCommand(backupDirCmd)
+}
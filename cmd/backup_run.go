@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/fidrasofyan/db-backup/internal/config"
+	"github.com/fidrasofyan/db-backup/internal/tasks"
+	"github.com/spf13/cobra"
+)
+
+// backupFlags are the flags of the backup commands.
+type backupFlags struct {
+	configPath      string
+	noUpload        bool
+	keep            int
+	stream          bool
+	remoteRetention bool
+	upload          uploadFlags
+}
+
+// register adds the flags to cmd. target names what cmd backs up, e.g.
+// "database", and files what it writes, e.g. "dumps".
+func (f *backupFlags) register(cmd *cobra.Command, target, files string) {
+	cmd.Flags().StringVarP(&f.configPath, "config", "c", "", "Path to config file. Run 'db-backup init' to create a config file.")
+	cmd.Flags().BoolVar(&f.noUpload, "no-upload", false, "Don't upload to S3")
+	cmd.Flags().BoolVar(&f.stream, "stream", false, fmt.Sprintf("Stream %s directly to S3 without staging them in local_dir", files))
+	cmd.Flags().BoolVar(&f.remoteRetention, "remote-retention", false, "Apply retention to the objects in the bucket instead of the files in local_dir")
+	cmd.Flags().IntVar(&f.keep, "keep", 0, fmt.Sprintf("Number of recent backup files to keep per %s. Overrides the retention config. 0 (default) means use the retention config.", target))
+
+	f.upload.register(cmd)
+}
+
+// runBackupCommand loads the config, applies flags and backs up, rotates and
+// uploads the targets left in the copy of the config passed to
+// selectTargets. Metrics are exported and notifications sent also for failed
+// runs. It exits on errors.
+func runBackupCommand(flags *backupFlags, selectTargets func(runCfg *config.Config) error) {
+	// Load config
+	cfg, err := tasks.LoadConfig(flags.configPath)
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+
+	// Context
+	ctx, cancel := newCommandContext(60 * time.Minute)
+	defer cancel()
+
+	if flags.stream {
+		cfg.Streaming = true
+	}
+	if flags.remoteRetention {
+		cfg.RetentionMode = "remote"
+	}
+	if err := flags.upload.apply(cfg); err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	if cfg.Streaming && flags.noUpload {
+		log.Fatalf("Error: --no-upload cannot be used with streaming")
+	}
+	if err := cfg.ValidateStreaming(); err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+
+	runCfg := *cfg
+	if err := selectTargets(&runCfg); err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+
+	// Create storage backends
+	dests, err := tasks.NewDestinations(ctx, cfg)
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	defer dests.Close()
+
+	// Backup, rotate and upload
+	run, err := tasks.RunBackup(ctx, &runCfg, dests, &tasks.RunBackupParams{
+		Keep:     flags.keep,
+		NoUpload: flags.noUpload,
+	})
+
+	// Export metrics and notify, also for failed runs
+	if cfg.Metrics.Textfile != "" {
+		if err := tasks.WriteMetricsTextfile(cfg, run); err != nil {
+			log.Printf("Warning: %v", err)
+		}
+	}
+	if err := tasks.SendNotifications(cfg, run); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/fidrasofyan/db-backup/internal/tasks"
+	"github.com/spf13/cobra"
+)
+
+var (
+	cleanupUploadsConfigPathFlag string
+	cleanupUploadsOlderThanFlag  time.Duration
+	cleanupUploadsDryRunFlag     bool
+)
+
+var cleanupUploadsCmd = &cobra.Command{
+	Use:   "cleanup-uploads",
+	Short: "Abort stale incomplete multipart uploads under remote_dir",
+	Run: func(cmd *cobra.Command, args []string) {
+
+		// Load config
+		cfg, err := tasks.LoadConfig(cleanupUploadsConfigPathFlag)
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+
+		// Context
+		ctx, cancel := newCommandContext(10 * time.Minute)
+		defer cancel()
+
+		// Create storage backends
+		dests, err := tasks.NewDestinations(ctx, cfg)
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		defer dests.Close()
+
+		// Cleanup
+		err = tasks.CleanupUploads(ctx, dests, &tasks.CleanupUploadsParams{
+			OlderThan: cleanupUploadsOlderThanFlag,
+			DryRun:    cleanupUploadsDryRunFlag,
+		})
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+	},
+}
+
+func init() {
+	// Flags
+	cleanupUploadsCmd.Flags().StringVarP(&cleanupUploadsConfigPathFlag, "config", "c", "", "Path to config file. Run 'db-backup init' to create a config file.")
+	cleanupUploadsCmd.Flags().DurationVar(&cleanupUploadsOlderThanFlag, "older-than", 24*time.Hour, "Only abort uploads started longer ago than this")
+	cleanupUploadsCmd.Flags().BoolVar(&cleanupUploadsDryRunFlag, "dry-run", false, "List the uploads that would be aborted without aborting them")
+
+	rootCmd.AddCommand(cleanupUploadsCmd)
+}
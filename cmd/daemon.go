@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/fidrasofyan/db-backup/internal/tasks"
+	"github.com/spf13/cobra"
+)
+
+var (
+	daemonConfigPathFlag string
+	daemonKeepFlag       int
+)
+
+var daemonCmd = &cobra.Command{
+	Use:   "daemon",
+	Short: "Run scheduled backups in-process using cron expressions from the config",
+	Run: func(cmd *cobra.Command, args []string) {
+
+		// Context for running jobs, cancelled on forced shutdown
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		daemon := tasks.NewDaemon(ctx, &tasks.DaemonParams{
+			ConfigPath: daemonConfigPathFlag,
+			Keep:       daemonKeepFlag,
+		})
+
+		// Setup signal catching before starting, so no signal is missed
+		sigCh := make(chan os.Signal, 1)
+		signal.Notify(sigCh,
+			os.Interrupt,    // SIGINT (Ctrl+C)
+			syscall.SIGTERM, // stop
+			syscall.SIGQUIT, // Ctrl+\
+			syscall.SIGHUP,  // reload config
+		)
+
+		if err := daemon.Start(); err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		log.Println("daemon started")
+
+		for sig := range sigCh {
+			if sig == syscall.SIGHUP {
+				log.Println("Signal caught: hangup, reloading config")
+				if err := daemon.Reload(); err != nil {
+					log.Printf("Error: reload failed, keeping current schedule: %v\n", err)
+				}
+				continue
+			}
+
+			// Wait for running jobs, a second stop signal aborts them
+			log.Printf("Signal caught: %s, waiting for running backups to finish\n", sig)
+			stopCtx := daemon.Stop()
+		drain:
+			for {
+				select {
+				case <-stopCtx.Done():
+					break drain
+				case sig := <-sigCh:
+					if sig == syscall.SIGHUP {
+						log.Println("Signal caught: hangup, ignored while stopping")
+						continue
+					}
+					log.Printf("Signal caught: %s, aborting running backups\n", sig)
+					cancel()
+					<-stopCtx.Done()
+					break drain
+				}
+			}
+			log.Println("daemon stopped")
+			return
+		}
+	},
+}
+
+func init() {
+	// Flags
+	daemonCmd.Flags().StringVarP(&daemonConfigPathFlag, "config", "c", "", "Path to config file. Run 'db-backup init' to create a config file.")
+	daemonCmd.Flags().IntVar(&daemonKeepFlag, "keep", 0, "Number of recent backup files to keep per database. Overrides the retention config. 0 (default) means use the retention config.")
+
+	rootCmd.AddCommand(daemonCmd)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/fidrasofyan/db-backup/internal/tasks"
+	"github.com/spf13/cobra"
+)
+
+var (
+	downloadConfigPathFlag  string
+	downloadDestinationFlag string
+	downloadNameFlag        string
+	downloadAtFlag          string
+	downloadOutFlag         string
+	downloadDecompressFlag  bool
+	downloadConcurrencyFlag int
+	downloadPartSizeFlag    int
+)
+
+var downloadCmd = &cobra.Command{
+	Use:   "download",
+	Short: "Download a backup from S3-compatible storage to a local file",
+	Run: func(cmd *cobra.Command, args []string) {
+
+		// Load config
+		cfg, err := tasks.LoadConfig(downloadConfigPathFlag)
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		cfg, err = cfg.WithDestination(downloadDestinationFlag)
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		if downloadConcurrencyFlag < 1 {
+			log.Fatalf("Error: --concurrency must be at least 1")
+		}
+		if err := validatePartSize(downloadPartSizeFlag); err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+
+		// Context
+		ctx, cancel := newCommandContext(6 * time.Hour)
+		defer cancel()
+
+		// Create storage backend
+		storageService, err := tasks.NewBackend(ctx, cfg)
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		defer storageService.Close()
+
+		// Download
+		_, err = tasks.Download(ctx, cfg, storageService, &tasks.DownloadParams{
+			Name:        downloadNameFlag,
+			At:          downloadAtFlag,
+			Out:         downloadOutFlag,
+			Decompress:  downloadDecompressFlag,
+			PartSize:    int64(downloadPartSizeFlag) * 1024 * 1024,
+			Concurrency: downloadConcurrencyFlag,
+		})
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+	},
+}
+
+func init() {
+	// Flags
+	downloadCmd.Flags().StringVarP(&downloadConfigPathFlag, "config", "c", "", "Path to config file. Run 'db-backup init' to create a config file.")
+	downloadCmd.Flags().StringVar(&downloadNameFlag, "db", "", "Name of the database or directory whose backup to download")
+	downloadCmd.Flags().StringVar(&downloadAtFlag, "at", "latest", "Backup to download: 'latest' or a timestamp in YYYYMMDD-HHMMSS format")
+	downloadCmd.Flags().StringVar(&downloadOutFlag, "out", ".", "File to write, or a directory to write the backup into under its own name")
+	downloadCmd.Flags().BoolVar(&downloadDecompressFlag, "decompress", false, "Decrypt and decompress while downloading, writing the plain dump (e.g. .sql)")
+	downloadCmd.Flags().IntVar(&downloadConcurrencyFlag, "concurrency", 5, "Number of parts downloaded in parallel")
+	downloadCmd.Flags().IntVar(&downloadPartSizeFlag, "part-size", 8, "Size of the parts downloaded in parallel, in MiB (5-5120)")
+	downloadCmd.Flags().StringVar(&downloadDestinationFlag, "destination", "", "Destination (destinations[].name) to download from. Defaults to the first destination.")
+	downloadCmd.MarkFlagRequired("db")
+
+	rootCmd.AddCommand(downloadCmd)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/fidrasofyan/db-backup/internal/tasks"
+	"github.com/spf13/cobra"
+)
+
+var (
+	listConfigPathFlag  string
+	listDestinationFlag string
+	listNameFlag        string
+	listJSONFlag        bool
+)
+
+var listCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the backups in local_dir and in S3-compatible storage",
+	Run: func(cmd *cobra.Command, args []string) {
+
+		// Load config
+		cfg, err := tasks.LoadConfig(listConfigPathFlag)
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		cfg, err = cfg.WithDestination(listDestinationFlag)
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+
+		// Context
+		ctx, cancel := newCommandContext(10 * time.Minute)
+		defer cancel()
+
+		// Create storage backend
+		storageService, err := tasks.NewBackend(ctx, cfg)
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		defer storageService.Close()
+
+		// List
+		lists, err := tasks.ListBackups(ctx, cfg, storageService, &tasks.ListBackupsParams{
+			Name: listNameFlag,
+		})
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+
+		if listJSONFlag {
+			encoder := json.NewEncoder(os.Stdout)
+			encoder.SetIndent("", "  ")
+			if err := encoder.Encode(lists); err != nil {
+				log.Fatalf("Error: %v", err)
+			}
+			return
+		}
+
+		for i, list := range lists {
+			if i > 0 {
+				fmt.Println()
+			}
+			if list.Latest == nil {
+				fmt.Printf("%s: no backups\n", list.Name)
+				continue
+			}
+			fmt.Printf("%s: latest %s (%s ago)\n", list.Name, list.Latest.Format(tasks.BackupTimeFormat), formatAge(list.LatestAge))
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			for _, b := range list.Backups {
+				fmt.Fprintf(w, "  %s\t%d\t%s\t%s\n", b.Timestamp.Format(tasks.BackupTimeFormat), b.Size, b.Location, b.File)
+			}
+			w.Flush()
+		}
+	},
+}
+
+func init() {
+	// Flags
+	listCmd.Flags().StringVarP(&listConfigPathFlag, "config", "c", "", "Path to config file. Run 'db-backup init' to create a config file.")
+	listCmd.Flags().StringVar(&listNameFlag, "db", "", "Only list the backups of this database or directory")
+	listCmd.Flags().BoolVar(&listJSONFlag, "json", false, "Print the backups as JSON")
+	listCmd.Flags().StringVar(&listDestinationFlag, "destination", "", "Destination (destinations[].name) to list. Defaults to the first destination.")
+
+	rootCmd.AddCommand(listCmd)
+}
+
+// formatAge formats d in days, hours and minutes, e.g. 2d3h or 45m.
+func formatAge(d time.Duration) string {
+	minutes := int(d.Minutes())
+	days, hours := minutes/(24*60), minutes/60%24
+	switch {
+	case days > 0:
+		return fmt.Sprintf("%dd%dh", days, hours)
+	case hours > 0:
+		return fmt.Sprintf("%dh%dm", hours, minutes%60)
+	default:
+		return fmt.Sprintf("%dm", minutes)
+	}
+}
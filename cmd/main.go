@@ -1,7 +1,12 @@
 package main
 
 import (
+	"context"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/spf13/cobra"
 )
@@ -11,6 +16,27 @@ var rootCmd = &cobra.Command{
 	Short: "Backup directory to S3",
 }
 
+// newCommandContext returns a context that is cancelled after timeout or
+// when the process receives a termination signal.
+func newCommandContext(timeout time.Duration) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+
+	// Setup signal catching
+	quitCh := make(chan os.Signal, 1)
+	signal.Notify(quitCh,
+		os.Interrupt,    // SIGINT (Ctrl+C)
+		syscall.SIGTERM, // stop
+		syscall.SIGQUIT, // Ctrl+\
+		syscall.SIGHUP,  // terminal hangup
+	)
+	go func() {
+		log.Printf("Signal caught: %s", <-quitCh)
+		cancel()
+	}()
+
+	return ctx, cancel
+}
+
 func main() {
 	if err := rootCmd.Execute(); err != nil {
 		log.Fatal(err)
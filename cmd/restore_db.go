@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/fidrasofyan/db-backup/internal/tasks"
+	"github.com/spf13/cobra"
+)
+
+var (
+	restoreDBConfigPathFlag  string
+	restoreDBDestinationFlag string
+	restoreDBNameFlag        string
+	restoreDBAtFlag          string
+	restoreDBTargetFlag      string
+	restoreDBListFlag        bool
+)
+
+var restoreDBCmd = &cobra.Command{
+	Use:   "restore-db",
+	Short: "Download a backup from S3-compatible storage and restore it into the database",
+	Run: func(cmd *cobra.Command, args []string) {
+
+		// Load config
+		cfg, err := tasks.LoadConfig(restoreDBConfigPathFlag)
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		cfg, err = cfg.WithDestination(restoreDBDestinationFlag)
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+
+		// Context
+		ctx, cancel := newCommandContext(60 * time.Minute)
+		defer cancel()
+
+		// Create storage backend
+		storageService, err := tasks.NewBackend(ctx, cfg)
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		defer storageService.Close()
+
+		// List available backups
+		if restoreDBListFlag {
+			backups, err := tasks.ListRemoteBackups(ctx, cfg, storageService, restoreDBNameFlag)
+			if err != nil {
+				log.Fatalf("Error: %v", err)
+			}
+			for _, b := range backups {
+				fmt.Printf("%s\t%d\t%s\n", b.Timestamp.Format(tasks.BackupTimeFormat), b.Size, b.Key)
+			}
+			return
+		}
+
+		// Restore
+		err = tasks.RestoreDB(ctx, cfg, storageService, &tasks.RestoreDBParams{
+			DBName:   restoreDBNameFlag,
+			At:       restoreDBAtFlag,
+			TargetDB: restoreDBTargetFlag,
+		})
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+	},
+}
+
+func init() {
+	// Flags
+	restoreDBCmd.Flags().StringVarP(&restoreDBConfigPathFlag, "config", "c", "", "Path to config file. Run 'db-backup init' to create a config file.")
+	restoreDBCmd.Flags().StringVar(&restoreDBNameFlag, "db", "", "Name of the database (backup_db[].dbname) whose backup to restore")
+	restoreDBCmd.Flags().StringVar(&restoreDBAtFlag, "at", "latest", "Backup to restore: 'latest' or a timestamp in YYYYMMDD-HHMMSS format")
+	restoreDBCmd.Flags().StringVar(&restoreDBTargetFlag, "target-db", "", "Database to restore into. Defaults to --db.")
+	restoreDBCmd.Flags().BoolVar(&restoreDBListFlag, "list", false, "List available backups instead of restoring")
+	restoreDBCmd.Flags().StringVar(&restoreDBDestinationFlag, "destination", "", "Destination (destinations[].name) to restore from. Defaults to the first destination.")
+	restoreDBCmd.MarkFlagRequired("db")
+
+	rootCmd.AddCommand(restoreDBCmd)
+}
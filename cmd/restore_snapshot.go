@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/fidrasofyan/db-backup/internal/tasks"
+	"github.com/spf13/cobra"
+)
+
+var (
+	restoreSnapshotConfigPathFlag  string
+	restoreSnapshotNameFlag        string
+	restoreSnapshotAtFlag          string
+	restoreSnapshotOutFlag         string
+	restoreSnapshotListFlag        bool
+	restoreSnapshotUnsafeLinksFlag bool
+)
+
+var restoreSnapshotCmd = &cobra.Command{
+	Use:   "restore-snapshot",
+	Short: "Restore the files of a directory snapshot from S3-compatible storage",
+	Run: func(cmd *cobra.Command, args []string) {
+
+		// Load config
+		cfg, err := tasks.LoadConfig(restoreSnapshotConfigPathFlag)
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+
+		// Context
+		ctx, cancel := newCommandContext(6 * time.Hour)
+		defer cancel()
+
+		// Create storage backend
+		storageService, err := tasks.NewBackend(ctx, cfg)
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		defer storageService.Close()
+
+		// List available snapshots
+		if restoreSnapshotListFlag {
+			snapshots, err := tasks.ListSnapshots(ctx, cfg, storageService, restoreSnapshotNameFlag)
+			if err != nil {
+				log.Fatalf("Error: %v", err)
+			}
+			for _, s := range snapshots {
+				fmt.Printf("%s\t%d\t%s\n", s.Timestamp.Format(tasks.BackupTimeFormat), s.Size, s.Key)
+			}
+			return
+		}
+
+		if restoreSnapshotOutFlag == "" {
+			log.Fatalf("Error: --out is required")
+		}
+
+		// Restore
+		err = tasks.RestoreSnapshot(ctx, cfg, storageService, &tasks.RestoreSnapshotParams{
+			Name:             restoreSnapshotNameFlag,
+			At:               restoreSnapshotAtFlag,
+			Out:              restoreSnapshotOutFlag,
+			AllowUnsafeLinks: restoreSnapshotUnsafeLinksFlag,
+		})
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+	},
+}
+
+func init() {
+	// Flags
+	restoreSnapshotCmd.Flags().StringVarP(&restoreSnapshotConfigPathFlag, "config", "c", "", "Path to config file. Run 'db-backup init' to create a config file.")
+	restoreSnapshotCmd.Flags().StringVar(&restoreSnapshotNameFlag, "name", "", "Name of the directory (backup_dirs[].name) whose snapshot to restore")
+	restoreSnapshotCmd.Flags().StringVar(&restoreSnapshotAtFlag, "at", "latest", "Snapshot to restore: 'latest' or a timestamp in YYYYMMDD-HHMMSS format")
+	restoreSnapshotCmd.Flags().StringVar(&restoreSnapshotOutFlag, "out", "", "Directory to restore the files into")
+	restoreSnapshotCmd.Flags().BoolVar(&restoreSnapshotListFlag, "list", false, "List available snapshots instead of restoring")
+	restoreSnapshotCmd.Flags().BoolVar(&restoreSnapshotUnsafeLinksFlag, "allow-unsafe-links", false, "Restore symlinks with absolute targets or targets outside of --out")
+	restoreSnapshotCmd.MarkFlagRequired("name")
+
+	rootCmd.AddCommand(restoreSnapshotCmd)
+}
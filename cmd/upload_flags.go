@@ -0,0 +1,51 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/fidrasofyan/db-backup/internal/config"
+	"github.com/spf13/cobra"
+)
+
+// uploadFlags tune the uploads of the backup commands. Zero values keep the
+// config.
+type uploadFlags struct {
+	concurrency     int
+	partConcurrency int
+	partSizeMB      int
+}
+
+func (f *uploadFlags) register(cmd *cobra.Command) {
+	cmd.Flags().IntVar(&f.concurrency, "upload-concurrency", 0, "Number of files uploaded in parallel. Overrides upload_concurrency.")
+	cmd.Flags().IntVar(&f.partConcurrency, "part-concurrency", 0, "Number of parts of a file uploaded in parallel. Overrides upload_part_concurrency.")
+	cmd.Flags().IntVar(&f.partSizeMB, "part-size", 0, "Multipart part size in MiB (5-5120). Overrides upload_part_size_mb.")
+}
+
+// apply overrides the upload settings of cfg with the flags that are set.
+func (f *uploadFlags) apply(cfg *config.Config) error {
+	if f.concurrency < 0 || f.partConcurrency < 0 {
+		return errors.New("--upload-concurrency and --part-concurrency must not be negative")
+	}
+	if f.concurrency > 0 {
+		cfg.UploadConcurrency = f.concurrency
+	}
+	if f.partConcurrency > 0 {
+		cfg.UploadPartConcurrency = f.partConcurrency
+	}
+	if f.partSizeMB != 0 {
+		if err := validatePartSize(f.partSizeMB); err != nil {
+			return err
+		}
+		cfg.UploadPartSizeMB = f.partSizeMB
+	}
+	return nil
+}
+
+// validatePartSize checks the value of a --part-size flag, in MiB.
+func validatePartSize(mb int) error {
+	if err := config.ValidateUploadPartSizeMB(mb); err != nil {
+		return fmt.Errorf("--part-size %v", err)
+	}
+	return nil
+}
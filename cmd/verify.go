@@ -0,0 +1,63 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/fidrasofyan/db-backup/internal/tasks"
+	"github.com/spf13/cobra"
+)
+
+var (
+	verifyConfigPathFlag  string
+	verifyDestinationFlag string
+	verifyManifestFlag    string
+	verifyDownloadFlag    bool
+)
+
+var verifyCmd = &cobra.Command{
+	Use:   "verify",
+	Short: "Verify uploaded backups against a backup manifest",
+	Run: func(cmd *cobra.Command, args []string) {
+
+		// Load config
+		cfg, err := tasks.LoadConfig(verifyConfigPathFlag)
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		cfg, err = cfg.WithDestination(verifyDestinationFlag)
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+
+		// Context
+		ctx, cancel := newCommandContext(60 * time.Minute)
+		defer cancel()
+
+		// Create storage backend
+		storageService, err := tasks.NewBackend(ctx, cfg)
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		defer storageService.Close()
+
+		// Verify
+		err = tasks.Verify(ctx, cfg, storageService, &tasks.VerifyParams{
+			Manifest: verifyManifestFlag,
+			Download: verifyDownloadFlag,
+		})
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+	},
+}
+
+func init() {
+	// Flags
+	verifyCmd.Flags().StringVarP(&verifyConfigPathFlag, "config", "c", "", "Path to config file. Run 'db-backup init' to create a config file.")
+	verifyCmd.Flags().StringVar(&verifyManifestFlag, "manifest", "latest", "Path to a local manifest file, or 'latest' to use the newest manifest in the bucket")
+	verifyCmd.Flags().BoolVar(&verifyDownloadFlag, "download", false, "Download every object and compare its SHA-256 instead of only checking its size")
+	verifyCmd.Flags().StringVar(&verifyDestinationFlag, "destination", "", "Destination (destinations[].name) to verify. Defaults to the first destination.")
+
+	rootCmd.AddCommand(verifyCmd)
+}
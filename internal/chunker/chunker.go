@@ -0,0 +1,108 @@
+package chunker
+
+import (
+	"errors"
+	"io"
+)
+
+// Chunk sizes. Cut points are content-defined, so an insertion only changes
+// the chunks around it instead of shifting every following chunk.
+const (
+	MinSize = 512 * 1024
+	AvgSize = 1024 * 1024
+	MaxSize = 4 * 1024 * 1024
+)
+
+// maskBits selects a cut point on average every AvgSize bytes past MinSize.
+// The high bits of the gear hash depend on the last 64 bytes, the low bits
+// only on the last few.
+const maskBits = 20
+
+const mask = (uint64(1)<<maskBits - 1) << (64 - maskBits)
+
+// gear maps bytes to random values. It must never change: the cut points,
+// and with them the deduplication of existing chunks, depend on it.
+var gear [256]uint64
+
+func init() {
+	// splitmix64 with a fixed seed
+	x := uint64(0x6462622d62636b70)
+	for i := range gear {
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		gear[i] = z ^ (z >> 31)
+	}
+}
+
+// Chunker splits a stream into content-defined chunks using a gear rolling
+// hash, like FastCDC.
+type Chunker struct {
+	r   io.Reader
+	buf []byte
+	// data is the unconsumed part of buf
+	data []byte
+	eof  bool
+}
+
+func New(r io.Reader) *Chunker {
+	return &Chunker{
+		r:   r,
+		buf: make([]byte, 2*MaxSize),
+	}
+}
+
+// Next returns the next chunk, or io.EOF after the last one. The chunk is
+// only valid until the next call.
+func (c *Chunker) Next() ([]byte, error) {
+	if err := c.fill(); err != nil {
+		return nil, err
+	}
+	if len(c.data) == 0 {
+		return nil, io.EOF
+	}
+
+	n := cut(c.data)
+	chunk := c.data[:n]
+	c.data = c.data[n:]
+	return chunk, nil
+}
+
+// fill reads until at least MaxSize bytes are buffered or the stream ends.
+func (c *Chunker) fill() error {
+	if c.eof || len(c.data) >= MaxSize {
+		return nil
+	}
+
+	// Move the unconsumed data to the front
+	n := copy(c.buf, c.data)
+	for n < MaxSize && !c.eof {
+		m, err := c.r.Read(c.buf[n:])
+		n += m
+		if errors.Is(err, io.EOF) {
+			c.eof = true
+		} else if err != nil {
+			return err
+		}
+	}
+	c.data = c.buf[:n]
+	return nil
+}
+
+// cut returns the length of the chunk at the start of data.
+func cut(data []byte) int {
+	if len(data) <= MinSize {
+		return len(data)
+	}
+	end := min(len(data), MaxSize)
+
+	var h uint64
+	for i := MinSize; i < end; i++ {
+		h = h<<1 + gear[data[i]]
+		if h&mask == 0 {
+			return i + 1
+		}
+	}
+	return end
+}
@@ -0,0 +1,147 @@
+package compression
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/fidrasofyan/db-backup/internal/config"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// File extensions appended to compressed backups
+const (
+	GzipFileExt = ".gz"
+	ZstdFileExt = ".zst"
+	XzFileExt   = ".xz"
+)
+
+// Compressor wraps backup streams with compression.
+type Compressor interface {
+	// Extension returns the file extension appended to compressed files. It
+	// is empty if the stream isn't compressed.
+	Extension() string
+	// Compress returns a writer that compresses to w. Close must be called
+	// to flush the stream; it does not close w.
+	Compress(w io.Writer) (io.WriteCloser, error)
+}
+
+// New returns the compressor configured in cfg. A nil cfg uses gzip at the
+// default level.
+func New(cfg *config.CompressionConfig) (Compressor, error) {
+	if cfg == nil {
+		return gzipCompressor{level: gzip.DefaultCompression}, nil
+	}
+
+	switch cfg.Type {
+	case "", "gzip":
+		level := cfg.Level
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		return gzipCompressor{level: level}, nil
+	case "zstd":
+		return zstdCompressor{level: cfg.Level, threads: cfg.Threads}, nil
+	case "xz":
+		return xzCompressor{}, nil
+	case "none":
+		return noneCompressor{}, nil
+	default:
+		return nil, fmt.Errorf("compression type %q is invalid", cfg.Type)
+	}
+}
+
+// Extensions returns the extensions of all compressed formats.
+func Extensions() []string {
+	return []string{GzipFileExt, ZstdFileExt, XzFileExt}
+}
+
+// TrimExtension removes a trailing compression extension from ext.
+func TrimExtension(ext string) string {
+	for _, e := range Extensions() {
+		if trimmed, found := strings.CutSuffix(ext, e); found {
+			return trimmed
+		}
+	}
+	return ext
+}
+
+// NewReader returns a reader that decompresses r according to the
+// compression extension ext ends with. Uncompressed streams are returned
+// as is.
+func NewReader(r io.Reader, ext string) (io.ReadCloser, error) {
+	switch {
+	case strings.HasSuffix(ext, GzipFileExt):
+		gzipReader, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read gzip stream: %v", err)
+		}
+		return gzipReader, nil
+	case strings.HasSuffix(ext, ZstdFileExt):
+		zstdReader, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read zstd stream: %v", err)
+		}
+		return zstdReader.IOReadCloser(), nil
+	case strings.HasSuffix(ext, XzFileExt):
+		xzReader, err := xz.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read xz stream: %v", err)
+		}
+		return io.NopCloser(xzReader), nil
+	default:
+		return io.NopCloser(r), nil
+	}
+}
+
+type gzipCompressor struct {
+	level int
+}
+
+func (gzipCompressor) Extension() string { return GzipFileExt }
+
+func (c gzipCompressor) Compress(w io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriterLevel(w, c.level)
+}
+
+type zstdCompressor struct {
+	level   int
+	threads int
+}
+
+func (zstdCompressor) Extension() string { return ZstdFileExt }
+
+func (c zstdCompressor) Compress(w io.Writer) (io.WriteCloser, error) {
+	opts := []zstd.EOption{}
+	if c.level > 0 {
+		opts = append(opts, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(c.level)))
+	}
+	if c.threads > 0 {
+		opts = append(opts, zstd.WithEncoderConcurrency(c.threads))
+	}
+	return zstd.NewWriter(w, opts...)
+}
+
+type xzCompressor struct{}
+
+func (xzCompressor) Extension() string { return XzFileExt }
+
+func (xzCompressor) Compress(w io.Writer) (io.WriteCloser, error) {
+	return xz.NewWriter(w)
+}
+
+type noneCompressor struct{}
+
+func (noneCompressor) Extension() string { return "" }
+
+func (noneCompressor) Compress(w io.Writer) (io.WriteCloser, error) {
+	return nopWriteCloser{w}, nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
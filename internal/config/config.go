@@ -4,8 +4,14 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
 	"strings"
+	"time"
 
+	"github.com/fidrasofyan/db-backup/internal/retention"
+	"github.com/fidrasofyan/db-backup/internal/retry"
+	"github.com/fidrasofyan/db-backup/internal/throttle"
+	"github.com/robfig/cron/v3"
 	"github.com/spf13/viper"
 )
 
@@ -17,6 +23,97 @@ type AWSConfig struct {
 	Bucket          string `mapstructure:"bucket"`
 }
 
+type StorageConfig struct {
+	// Type is s3 (default) to store backups in aws.bucket, local to store
+	// them in a directory, e.g. a mounted NAS share, or sftp
+	Type string `mapstructure:"type"`
+	// Path is the directory of local and sftp storage. remote_dir is
+	// relative to it.
+	Path string     `mapstructure:"path"`
+	SFTP SFTPConfig `mapstructure:"sftp"`
+}
+
+type SFTPConfig struct {
+	Host     string `mapstructure:"host"`
+	Port     string `mapstructure:"port"`
+	User     string `mapstructure:"user"`
+	Password string `mapstructure:"password"`
+	// PrivateKeyFile is an unencrypted private key used to log in
+	PrivateKeyFile string `mapstructure:"private_key_file"`
+	// KnownHostsFile verifies the server's host key. It defaults to
+	// ~/.ssh/known_hosts.
+	KnownHostsFile string `mapstructure:"known_hosts_file"`
+}
+
+// validate checks the fields of the storage type, reporting errors under
+// field and the s3 settings under awsField.
+func (s *StorageConfig) validate(field, awsField string, aws AWSConfig) error {
+	switch s.Type {
+	case "", "s3":
+		s.Type = "s3"
+		if aws.Endpoint == "" {
+			return fmt.Errorf("%s.endpoint is required", awsField)
+		}
+		if aws.Region == "" {
+			return fmt.Errorf("%s.region is required", awsField)
+		}
+		if aws.AccessKeyID == "" {
+			return fmt.Errorf("%s.access_key_id is required", awsField)
+		}
+		if aws.SecretAccessKey == "" {
+			return fmt.Errorf("%s.secret_access_key is required", awsField)
+		}
+		if aws.Bucket == "" {
+			return fmt.Errorf("%s.bucket is required", awsField)
+		}
+	case "local":
+		if s.Path == "" {
+			return fmt.Errorf("%s.path is required", field)
+		}
+	case "sftp":
+		if s.Path == "" {
+			return fmt.Errorf("%s.path is required", field)
+		}
+		if s.SFTP.Host == "" {
+			return fmt.Errorf("%s.sftp.host is required", field)
+		}
+		if s.SFTP.User == "" {
+			return fmt.Errorf("%s.sftp.user is required", field)
+		}
+		if s.SFTP.Password == "" && s.SFTP.PrivateKeyFile == "" {
+			return fmt.Errorf("%s.sftp.password or %s.sftp.private_key_file is required", field, field)
+		}
+	default:
+		return fmt.Errorf("%s.type is invalid", field)
+	}
+	return nil
+}
+
+// DestinationConfig is one place backups are uploaded to. The first
+// destination is the primary: streamed dumps and snapshot chunks are only
+// stored there, and restore, verify and restore-snapshot use it by default.
+type DestinationConfig struct {
+	// Name identifies the destination in logs, reports and the --destination
+	// flag
+	Name    string        `mapstructure:"name"`
+	AWS     AWSConfig     `mapstructure:"aws"`
+	Storage StorageConfig `mapstructure:"storage"`
+	// Prefix is the directory backups are stored under. It defaults to
+	// remote_dir.
+	Prefix string `mapstructure:"prefix"`
+	// Retention overrides the retention policy of every database and
+	// directory for the copies in this destination
+	Retention *RetentionConfig `mapstructure:"retention"`
+	// OnFailure is error (default) to fail the run when uploading to or
+	// pruning the destination fails, or warning to only log and report it
+	OnFailure string `mapstructure:"on_failure"`
+}
+
+// Optional reports whether a failure of the destination is only a warning.
+func (d *DestinationConfig) Optional() bool {
+	return d.OnFailure == "warning"
+}
+
 type BackupDBConfig struct {
 	Type     string `mapstructure:"type"`
 	Host     string `mapstructure:"host"`
@@ -24,13 +121,303 @@ type BackupDBConfig struct {
 	User     string `mapstructure:"user"`
 	Password string `mapstructure:"password"`
 	DBName   string `mapstructure:"dbname"`
+	// Format is the dump output format, if the dumper supports more than one
+	Format string `mapstructure:"format"`
+	// Compression overrides the global compression for this database
+	Compression *CompressionConfig `mapstructure:"compression"`
+	// Retention overrides the global retention policy for this database
+	Retention *RetentionConfig `mapstructure:"retention"`
+	// Schedule overrides the global daemon schedule for this database
+	Schedule string `mapstructure:"schedule"`
+}
+
+type BackupDirConfig struct {
+	// Name identifies the archives, like dbname does for dumps
+	Name  string   `mapstructure:"name"`
+	Paths []string `mapstructure:"paths"`
+	// Mode is archive (default) to write a tarball per run, or snapshot to
+	// upload deduplicated chunks and an index per run
+	Mode string `mapstructure:"mode"`
+	// Include limits the archived files to those matching a glob. Patterns
+	// without a slash match the base name, others the path relative to
+	// the archived path.
+	Include []string `mapstructure:"include"`
+	// Exclude skips files and directories matching a glob
+	Exclude []string `mapstructure:"exclude"`
+	// FollowSymlinks archives the targets of symlinks instead of the links
+	FollowSymlinks bool `mapstructure:"follow_symlinks"`
+	// Compression overrides the global compression for this directory
+	Compression *CompressionConfig `mapstructure:"compression"`
+	// Retention overrides the global retention policy for this directory
+	Retention *RetentionConfig `mapstructure:"retention"`
+	// Schedule overrides the global daemon schedule for this directory
+	Schedule string `mapstructure:"schedule"`
+}
+
+type CompressionConfig struct {
+	// Type is one of gzip (default), zstd, xz or none
+	Type string `mapstructure:"type"`
+	// Level is the compression level. 0 uses the algorithm's default.
+	Level int `mapstructure:"level"`
+	// Threads is the number of zstd encoder goroutines. 0 uses all CPUs.
+	Threads int `mapstructure:"threads"`
+}
+
+// validate checks the compression fields, reporting errors under field.
+func (c *CompressionConfig) validate(field string) error {
+	if c == nil {
+		return nil
+	}
+	switch c.Type {
+	case "", "gzip":
+		if c.Level < 0 || c.Level > 9 {
+			return fmt.Errorf("%s.level must be between 1 and 9 for gzip", field)
+		}
+	case "zstd":
+		if c.Level < 0 || c.Level > 22 {
+			return fmt.Errorf("%s.level must be between 1 and 22 for zstd", field)
+		}
+	case "xz", "none":
+		if c.Level != 0 {
+			return fmt.Errorf("%s.level is not supported for %s", field, c.Type)
+		}
+	default:
+		return fmt.Errorf("%s.type is invalid", field)
+	}
+	if c.Threads < 0 {
+		return fmt.Errorf("%s.threads must not be negative", field)
+	}
+	if c.Threads > 0 && c.Type != "zstd" {
+		return fmt.Errorf("%s.threads is only supported for zstd", field)
+	}
+	return nil
+}
+
+type RetentionConfig struct {
+	KeepLast int `mapstructure:"keep_last"`
+	Daily    int `mapstructure:"daily"`
+	Weekly   int `mapstructure:"weekly"`
+	Monthly  int `mapstructure:"monthly"`
+	Yearly   int `mapstructure:"yearly"`
+	// MaxAge is a duration such as 90d or 720h
+	MaxAge string `mapstructure:"max_age"`
+}
+
+// Policy converts the config into a retention policy. MaxAge must have been
+// validated by New.
+func (r *RetentionConfig) Policy() retention.Policy {
+	if r == nil {
+		return retention.Policy{}
+	}
+	var maxAge time.Duration
+	if r.MaxAge != "" {
+		maxAge, _ = retention.ParseMaxAge(r.MaxAge)
+	}
+	return retention.Policy{
+		KeepLast: r.KeepLast,
+		Daily:    r.Daily,
+		Weekly:   r.Weekly,
+		Monthly:  r.Monthly,
+		Yearly:   r.Yearly,
+		MaxAge:   maxAge,
+	}
+}
+
+func (r *RetentionConfig) validate(field string) error {
+	if r == nil {
+		return nil
+	}
+	if r.KeepLast < 0 || r.Daily < 0 || r.Weekly < 0 || r.Monthly < 0 || r.Yearly < 0 {
+		return fmt.Errorf("%s counts must not be negative", field)
+	}
+	if r.MaxAge != "" {
+		if _, err := retention.ParseMaxAge(r.MaxAge); err != nil {
+			return fmt.Errorf("%s.max_age is invalid: %v", field, err)
+		}
+	}
+	return nil
+}
+
+type RetryPolicyConfig struct {
+	// MaxAttempts is the number of tries, including the first one
+	MaxAttempts int `mapstructure:"max_attempts"`
+	// BaseDelay is the longest wait before the first retry. It doubles with
+	// every following retry, up to MaxDelay.
+	BaseDelay time.Duration `mapstructure:"base_delay"`
+	MaxDelay  time.Duration `mapstructure:"max_delay"`
+}
+
+func (r RetryPolicyConfig) Policy() retry.Policy {
+	return retry.Policy{
+		MaxAttempts: r.MaxAttempts,
+		BaseDelay:   r.BaseDelay,
+		MaxDelay:    r.MaxDelay,
+	}
+}
+
+// validate checks the fields and fills unset ones from def, reporting errors
+// under field.
+func (r *RetryPolicyConfig) validate(field string, def RetryPolicyConfig) error {
+	if r.MaxAttempts < 0 {
+		return fmt.Errorf("%s.max_attempts must not be negative", field)
+	}
+	if r.BaseDelay < 0 || r.MaxDelay < 0 {
+		return fmt.Errorf("%s delays must not be negative", field)
+	}
+	if r.MaxAttempts == 0 {
+		r.MaxAttempts = def.MaxAttempts
+	}
+	if r.BaseDelay == 0 {
+		r.BaseDelay = def.BaseDelay
+	}
+	if r.MaxDelay == 0 {
+		r.MaxDelay = max(def.MaxDelay, r.BaseDelay)
+	}
+	if r.MaxDelay < r.BaseDelay {
+		return fmt.Errorf("%s.max_delay must not be less than base_delay", field)
+	}
+	return nil
+}
+
+type UploadRateWindowConfig struct {
+	// From and To are local times of day in HH:MM format. A window ending
+	// before it starts spans midnight.
+	From string `mapstructure:"from"`
+	To   string `mapstructure:"to"`
+	// Rate is the limit during the window, e.g. 5MB/s. 0 is unlimited.
+	Rate string `mapstructure:"rate"`
+}
+
+// parseTimeOfDay parses HH:MM into an offset from midnight.
+func parseTimeOfDay(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q, expected HH:MM", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// UploadPartSize returns the multipart part size in bytes.
+func (c *Config) UploadPartSize() int64 {
+	return int64(c.UploadPartSizeMB) * 1024 * 1024
+}
+
+// ValidateUploadPartSizeMB checks a part size in MiB against the S3 limits.
+func ValidateUploadPartSizeMB(mb int) error {
+	if mb < 5 || mb > 5*1024 {
+		return errors.New("must be between 5 and 5120")
+	}
+	return nil
+}
+
+// UploadRate returns the upload bandwidth schedule. The fields must have been
+// validated by New.
+func (c *Config) UploadRate() throttle.Schedule {
+	var schedule throttle.Schedule
+	if c.MaxUploadRate != "" {
+		schedule.Default, _ = throttle.ParseRate(c.MaxUploadRate)
+	}
+	for _, w := range c.UploadRateSchedule {
+		from, _ := parseTimeOfDay(w.From)
+		to, _ := parseTimeOfDay(w.To)
+		rate, _ := throttle.ParseRate(w.Rate)
+		schedule.Windows = append(schedule.Windows, throttle.Window{From: from, To: to, Rate: rate})
+	}
+	return schedule
+}
+
+type RetryConfig struct {
+	// Upload applies to every S3 request, e.g. each part of an upload
+	Upload RetryPolicyConfig `mapstructure:"upload"`
+	// Dump applies to whole dumps. The partial file of a failed attempt is
+	// deleted before the next one.
+	Dump RetryPolicyConfig `mapstructure:"dump"`
+}
+
+type EncryptionConfig struct {
+	// Type is age or aes-gcm. Empty disables encryption.
+	Type string `mapstructure:"type"`
+	// Recipients are the age public keys backups are encrypted to
+	Recipients []string `mapstructure:"recipients"`
+	// IdentityFile holds the age private keys used to decrypt on restore
+	IdentityFile string `mapstructure:"identity_file"`
+	// Passphrase derives the aes-gcm key
+	Passphrase string `mapstructure:"passphrase"`
+	// ContentKey is a secret keying the names of age encrypted snapshot
+	// chunks. The recipients are public, so they can't key them.
+	ContentKey string `mapstructure:"content_key"`
+}
+
+type MetricsConfig struct {
+	// Textfile is written after every run for the node_exporter textfile
+	// collector
+	Textfile string `mapstructure:"textfile"`
+	// Listen is the address of the /metrics endpoint in daemon mode
+	Listen string `mapstructure:"listen"`
+}
+
+type NotificationConfig struct {
+	// Type is webhook, slack or email
+	Type string `mapstructure:"type"`
+	// OnFailureOnly skips notifications for successful runs
+	OnFailureOnly bool `mapstructure:"on_failure_only"`
+	// URL is the endpoint of webhook and slack notifications
+	URL string `mapstructure:"url"`
+	// SMTP settings of email notifications
+	SMTPHost string `mapstructure:"smtp_host"`
+	SMTPPort string `mapstructure:"smtp_port"`
+	// TLS is starttls to use STARTTLS when the server offers it, or
+	// implicit to connect over TLS. It defaults to implicit on port 465 and
+	// starttls otherwise.
+	TLS      string   `mapstructure:"tls"`
+	Username string   `mapstructure:"username"`
+	Password string   `mapstructure:"password"`
+	From     string   `mapstructure:"from"`
+	To       []string `mapstructure:"to"`
 }
 
 type Config struct {
-	AWS              AWSConfig        `mapstructure:"aws"`
-	DBConfigurations []BackupDBConfig `mapstructure:"backup_db"`
-	LocalDir         string           `mapstructure:"local_dir"`
-	RemoteDir        string           `mapstructure:"remote_dir"`
+	// AWS and Storage configure the only destination when Destinations is
+	// empty. Otherwise New sets them to the first destination.
+	AWS              AWSConfig            `mapstructure:"aws"`
+	Storage          StorageConfig        `mapstructure:"storage"`
+	Destinations     []DestinationConfig  `mapstructure:"destinations"`
+	DBConfigurations []BackupDBConfig     `mapstructure:"backup_db"`
+	BackupDirs       []BackupDirConfig    `mapstructure:"backup_dirs"`
+	Encryption       EncryptionConfig     `mapstructure:"encryption"`
+	Compression      *CompressionConfig   `mapstructure:"compression"`
+	Retention        *RetentionConfig     `mapstructure:"retention"`
+	Metrics          MetricsConfig        `mapstructure:"metrics"`
+	Notifications    []NotificationConfig `mapstructure:"notifications"`
+	Retry            RetryConfig          `mapstructure:"retry"`
+	LocalDir         string               `mapstructure:"local_dir"`
+	RemoteDir        string               `mapstructure:"remote_dir"`
+	// RetentionMode is local (default) to prune from the files in local_dir,
+	// or remote to prune from the bucket listing
+	RetentionMode string `mapstructure:"retention_mode"`
+	// Streaming pipes dumps straight to S3 instead of staging them in local_dir
+	Streaming bool `mapstructure:"streaming"`
+	// StreamingKeepLocal also writes a local copy of streamed dumps
+	StreamingKeepLocal bool `mapstructure:"streaming_keep_local"`
+	// Schedule is the cron expression used by the daemon command
+	Schedule string `mapstructure:"schedule"`
+	// DumpConcurrency is the number of databases dumped in parallel
+	DumpConcurrency int `mapstructure:"dump_concurrency"`
+	// DumpConcurrencyPerHost limits parallel dumps against the same host
+	DumpConcurrencyPerHost int `mapstructure:"dump_concurrency_per_host"`
+	// UploadConcurrency is the number of files uploaded in parallel
+	UploadConcurrency int `mapstructure:"upload_concurrency"`
+	// UploadPartConcurrency is the number of parts of a file uploaded in
+	// parallel. Streamed dumps buffer this many parts plus one in memory.
+	UploadPartConcurrency int `mapstructure:"upload_part_concurrency"`
+	// UploadPartSizeMB is the multipart part size in MiB. Parts of files too
+	// big for S3's 10,000 parts limit are made bigger automatically.
+	UploadPartSizeMB int `mapstructure:"upload_part_size_mb"`
+	// MaxUploadRate limits the bandwidth of all uploads together, e.g.
+	// 20MB/s. Empty or 0 is unlimited.
+	MaxUploadRate string `mapstructure:"max_upload_rate"`
+	// UploadRateSchedule overrides MaxUploadRate at times of day
+	UploadRateSchedule []UploadRateWindowConfig `mapstructure:"upload_rate_schedule"`
 }
 
 func New(configPath string) (*Config, error) {
@@ -53,21 +440,6 @@ func New(configPath string) (*Config, error) {
 	}
 
 	// Validation
-	if cfg.AWS.Endpoint == "" {
-		return nil, errors.New("aws.endpoint is required")
-	}
-	if cfg.AWS.Region == "" {
-		return nil, errors.New("aws.region is required")
-	}
-	if cfg.AWS.AccessKeyID == "" {
-		return nil, errors.New("aws.access_key_id is required")
-	}
-	if cfg.AWS.SecretAccessKey == "" {
-		return nil, errors.New("aws.secret_access_key is required")
-	}
-	if cfg.AWS.Bucket == "" {
-		return nil, errors.New("aws.bucket is required")
-	}
 	if cfg.LocalDir == "" {
 		return nil, errors.New("local_dir is required")
 	}
@@ -89,34 +461,294 @@ func New(configPath string) (*Config, error) {
 	if !info.IsDir() {
 		return nil, fmt.Errorf("local_dir %v is not a directory", cfg.LocalDir)
 	}
-	if cfg.RemoteDir == "" {
-		return nil, errors.New("remote_dir is required")
+	if err := cfg.validateDestinations(); err != nil {
+		return nil, err
 	}
 
+	// Engine specific fields are validated by the dumper registered for the type
 	for i, db := range cfg.DBConfigurations {
-		if db.Type != "mysql" && db.Type != "mariadb" {
-			return nil, fmt.Errorf("backup_db[%d].type is invalid", i)
+		if db.Type == "" {
+			return nil, fmt.Errorf("backup_db[%d].type is required", i)
 		}
-		if db.Host == "" {
-			return nil, fmt.Errorf("backup_db[%d].host is required", i)
+		if db.DBName == "" {
+			return nil, fmt.Errorf("backup_db[%d].dbname is required", i)
 		}
-		if db.Port == "" {
-			return nil, fmt.Errorf("backup_db[%d].port is required", i)
+		if err := db.Compression.validate(fmt.Sprintf("backup_db[%d].compression", i)); err != nil {
+			return nil, err
 		}
-		if db.User == "" {
-			return nil, fmt.Errorf("backup_db[%d].user is required", i)
+		if err := db.Retention.validate(fmt.Sprintf("backup_db[%d].retention", i)); err != nil {
+			return nil, err
 		}
-		if db.Password == "" {
-			return nil, fmt.Errorf("backup_db[%d].password is required", i)
+		if db.Schedule != "" {
+			if _, err := cron.ParseStandard(db.Schedule); err != nil {
+				return nil, fmt.Errorf("backup_db[%d].schedule is invalid: %v", i, err)
+			}
 		}
-		if db.DBName == "" {
-			return nil, fmt.Errorf("backup_db[%d].dbname is required", i)
+	}
+	names := map[string]bool{}
+	for _, db := range cfg.DBConfigurations {
+		names[db.DBName] = true
+	}
+	for i, dir := range cfg.BackupDirs {
+		if dir.Name == "" {
+			return nil, fmt.Errorf("backup_dirs[%d].name is required", i)
+		}
+		if strings.ContainsAny(dir.Name, `/\`) {
+			return nil, fmt.Errorf("backup_dirs[%d].name must not contain slashes", i)
+		}
+		if names[dir.Name] {
+			return nil, fmt.Errorf("backup_dirs[%d].name %s is already used", i, dir.Name)
+		}
+		names[dir.Name] = true
+		if len(dir.Paths) == 0 {
+			return nil, fmt.Errorf("backup_dirs[%d].paths is required", i)
+		}
+		if dir.Mode == "" {
+			cfg.BackupDirs[i].Mode = "archive"
+		}
+		if dir.Mode != "" && dir.Mode != "archive" && dir.Mode != "snapshot" {
+			return nil, fmt.Errorf("backup_dirs[%d].mode is invalid", i)
+		}
+		for _, pattern := range append(dir.Include, dir.Exclude...) {
+			if _, err := filepath.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("backup_dirs[%d]: pattern %q is invalid", i, pattern)
+			}
+		}
+		if err := dir.Compression.validate(fmt.Sprintf("backup_dirs[%d].compression", i)); err != nil {
+			return nil, err
+		}
+		if err := dir.Retention.validate(fmt.Sprintf("backup_dirs[%d].retention", i)); err != nil {
+			return nil, err
+		}
+		if dir.Schedule != "" {
+			if _, err := cron.ParseStandard(dir.Schedule); err != nil {
+				return nil, fmt.Errorf("backup_dirs[%d].schedule is invalid: %v", i, err)
+			}
+		}
+	}
+	if cfg.Schedule != "" {
+		if _, err := cron.ParseStandard(cfg.Schedule); err != nil {
+			return nil, fmt.Errorf("schedule is invalid: %v", err)
+		}
+	}
+	if err := cfg.Retention.validate("retention"); err != nil {
+		return nil, err
+	}
+	if err := cfg.Compression.validate("compression"); err != nil {
+		return nil, err
+	}
+	if cfg.DumpConcurrency < 0 {
+		return nil, errors.New("dump_concurrency must not be negative")
+	}
+	if cfg.DumpConcurrency == 0 {
+		cfg.DumpConcurrency = 1
+	}
+	if cfg.DumpConcurrencyPerHost < 0 {
+		return nil, errors.New("dump_concurrency_per_host must not be negative")
+	}
+	if cfg.DumpConcurrencyPerHost == 0 {
+		cfg.DumpConcurrencyPerHost = 1
+	}
+	err = cfg.Retry.Upload.validate("retry.upload", RetryPolicyConfig{
+		MaxAttempts: 5,
+		BaseDelay:   500 * time.Millisecond,
+		MaxDelay:    20 * time.Second,
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = cfg.Retry.Dump.validate("retry.dump", RetryPolicyConfig{
+		MaxAttempts: 3,
+		BaseDelay:   10 * time.Second,
+		MaxDelay:    time.Minute,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if cfg.UploadConcurrency < 0 {
+		return nil, errors.New("upload_concurrency must not be negative")
+	}
+	if cfg.UploadConcurrency == 0 {
+		cfg.UploadConcurrency = 5
+	}
+	if cfg.UploadPartConcurrency < 0 {
+		return nil, errors.New("upload_part_concurrency must not be negative")
+	}
+	if cfg.UploadPartConcurrency == 0 {
+		cfg.UploadPartConcurrency = 5
+	}
+	if cfg.UploadPartSizeMB == 0 {
+		cfg.UploadPartSizeMB = 5
+	}
+	if err := ValidateUploadPartSizeMB(cfg.UploadPartSizeMB); err != nil {
+		return nil, fmt.Errorf("upload_part_size_mb %v", err)
+	}
+	if cfg.MaxUploadRate != "" {
+		if _, err := throttle.ParseRate(cfg.MaxUploadRate); err != nil {
+			return nil, fmt.Errorf("max_upload_rate is invalid: %v", err)
+		}
+	}
+	for i, w := range cfg.UploadRateSchedule {
+		if _, err := parseTimeOfDay(w.From); err != nil {
+			return nil, fmt.Errorf("upload_rate_schedule[%d].from is invalid: %v", i, err)
+		}
+		if _, err := parseTimeOfDay(w.To); err != nil {
+			return nil, fmt.Errorf("upload_rate_schedule[%d].to is invalid: %v", i, err)
+		}
+		if w.From == w.To {
+			return nil, fmt.Errorf("upload_rate_schedule[%d] is empty: from and to are equal", i)
+		}
+		if w.Rate == "" {
+			return nil, fmt.Errorf("upload_rate_schedule[%d].rate is required", i)
+		}
+		if _, err := throttle.ParseRate(w.Rate); err != nil {
+			return nil, fmt.Errorf("upload_rate_schedule[%d].rate is invalid: %v", i, err)
+		}
+	}
+	if cfg.RetentionMode == "" {
+		cfg.RetentionMode = "local"
+	}
+	if cfg.RetentionMode != "local" && cfg.RetentionMode != "remote" {
+		return nil, errors.New("retention_mode is invalid")
+	}
+	if err := cfg.ValidateStreaming(); err != nil {
+		return nil, err
+	}
+
+	for i, n := range cfg.Notifications {
+		switch n.Type {
+		case "webhook", "slack":
+			if n.URL == "" {
+				return nil, fmt.Errorf("notifications[%d].url is required", i)
+			}
+		case "email":
+			if n.SMTPHost == "" {
+				return nil, fmt.Errorf("notifications[%d].smtp_host is required", i)
+			}
+			if n.From == "" {
+				return nil, fmt.Errorf("notifications[%d].from is required", i)
+			}
+			if len(n.To) == 0 {
+				return nil, fmt.Errorf("notifications[%d].to is required", i)
+			}
+			if n.SMTPPort == "" {
+				cfg.Notifications[i].SMTPPort = "587"
+			}
+			if n.TLS != "" && n.TLS != "starttls" && n.TLS != "implicit" {
+				return nil, fmt.Errorf("notifications[%d].tls is invalid", i)
+			}
+		default:
+			return nil, fmt.Errorf("notifications[%d].type is invalid", i)
 		}
 	}
 
+	switch cfg.Encryption.Type {
+	case "":
+	case "age":
+		if len(cfg.Encryption.Recipients) == 0 && cfg.Encryption.IdentityFile == "" {
+			return nil, errors.New("encryption.recipients or encryption.identity_file is required")
+		}
+		for i, dir := range cfg.BackupDirs {
+			if dir.Mode == "snapshot" && cfg.Encryption.ContentKey == "" {
+				return nil, fmt.Errorf("encryption.content_key is required for age encrypted snapshots (backup_dirs[%d])", i)
+			}
+		}
+	case "aes-gcm":
+		if cfg.Encryption.Passphrase == "" {
+			return nil, errors.New("encryption.passphrase is required")
+		}
+	default:
+		return nil, errors.New("encryption.type is invalid")
+	}
+
 	// Normalize
-	cfg.AWS.Endpoint = strings.TrimRight(cfg.AWS.Endpoint, "/")
-	cfg.RemoteDir = strings.TrimLeft(cfg.RemoteDir, "/")
+	for i := range cfg.Destinations {
+		d := &cfg.Destinations[i]
+		d.AWS.Endpoint = strings.TrimRight(d.AWS.Endpoint, "/")
+		d.Prefix = strings.TrimLeft(d.Prefix, "/")
+	}
+	primary := cfg.Destinations[0]
+	cfg.AWS, cfg.Storage, cfg.RemoteDir = primary.AWS, primary.Storage, primary.Prefix
 
 	return &cfg, nil
 }
+
+// validateDestinations checks the destinations, or makes the only destination
+// from aws, storage and remote_dir if none are configured.
+func (c *Config) validateDestinations() error {
+	if len(c.Destinations) == 0 {
+		if err := c.Storage.validate("storage", "aws", c.AWS); err != nil {
+			return err
+		}
+		if c.RemoteDir == "" {
+			return errors.New("remote_dir is required")
+		}
+		c.Destinations = []DestinationConfig{{
+			Name:      "default",
+			AWS:       c.AWS,
+			Storage:   c.Storage,
+			Prefix:    c.RemoteDir,
+			OnFailure: "error",
+		}}
+		return nil
+	}
+
+	if c.AWS != (AWSConfig{}) || c.Storage != (StorageConfig{}) {
+		return errors.New("aws and storage cannot be used together with destinations")
+	}
+	names := map[string]bool{}
+	for i := range c.Destinations {
+		d := &c.Destinations[i]
+		field := fmt.Sprintf("destinations[%d]", i)
+		if d.Name == "" {
+			return fmt.Errorf("%s.name is required", field)
+		}
+		if names[d.Name] {
+			return fmt.Errorf("%s.name %s is already used", field, d.Name)
+		}
+		names[d.Name] = true
+		if err := d.Storage.validate(field+".storage", field+".aws", d.AWS); err != nil {
+			return err
+		}
+		if d.Prefix == "" {
+			d.Prefix = c.RemoteDir
+		}
+		if d.Prefix == "" {
+			return fmt.Errorf("%s.prefix or remote_dir is required", field)
+		}
+		if err := d.Retention.validate(field + ".retention"); err != nil {
+			return err
+		}
+		switch d.OnFailure {
+		case "":
+			d.OnFailure = "error"
+		case "error", "warning":
+		default:
+			return fmt.Errorf("%s.on_failure is invalid", field)
+		}
+	}
+	return nil
+}
+
+// ValidateStreaming checks that streamed dumps reach every destination. Only
+// the primary receives the stream; the others are uploaded the local copy.
+func (c *Config) ValidateStreaming() error {
+	if c.Streaming && !c.StreamingKeepLocal && len(c.Destinations) > 1 {
+		return errors.New("streaming requires streaming_keep_local with more than one destination")
+	}
+	return nil
+}
+
+// WithDestination returns a copy of the config storing backups in the named
+// destination: aws, storage and remote_dir are replaced by its settings. An
+// empty name selects the first destination.
+func (c *Config) WithDestination(name string) (*Config, error) {
+	for _, d := range c.Destinations {
+		if name == "" || d.Name == name {
+			dc := *c
+			dc.AWS, dc.Storage, dc.RemoteDir = d.AWS, d.Storage, d.Prefix
+			return &dc, nil
+		}
+	}
+	return nil, fmt.Errorf("destination %s not found", name)
+}
@@ -0,0 +1,109 @@
+package dumper
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/fidrasofyan/db-backup/internal/config"
+)
+
+// Dumper builds the command that writes a database dump to stdout.
+// Implementations register themselves by backup_db[].type.
+type Dumper interface {
+	// Binary returns the dump binary found in PATH.
+	Binary() (string, error)
+	// Validate checks the engine specific fields of dbConfig.
+	Validate(dbConfig config.BackupDBConfig) error
+	// Command returns the dump command. Credentials are passed via cmd.Env.
+	Command(ctx context.Context, binary string, dbConfig config.BackupDBConfig) *exec.Cmd
+	// Extension returns the extension of the uncompressed dump, e.g. ".sql".
+	Extension(dbConfig config.BackupDBConfig) string
+	// Version returns the version string reported by binary.
+	Version(ctx context.Context, binary string) (string, error)
+}
+
+// Restorer is implemented by dumpers that can load their dumps back.
+type Restorer interface {
+	// RestoreCommands returns the command that creates targetDB when it is
+	// missing and the command that reads a dump with extension ext on stdin.
+	RestoreCommands(ctx context.Context, dbConfig config.BackupDBConfig, targetDB, ext string) (*exec.Cmd, *exec.Cmd, error)
+}
+
+var (
+	mu       sync.RWMutex
+	registry = map[string]Dumper{}
+)
+
+// Register makes a dumper available for the given backup_db[].type.
+func Register(dbType string, d Dumper) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if _, exists := registry[dbType]; exists {
+		panic("dumper: Register called twice for type " + dbType)
+	}
+	registry[dbType] = d
+}
+
+// Get returns the dumper registered for dbType.
+func Get(dbType string) (Dumper, error) {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	d, ok := registry[dbType]
+	if !ok {
+		return nil, fmt.Errorf("unsupported database type %q (supported: %s)", dbType, strings.Join(typesLocked(), ", "))
+	}
+	return d, nil
+}
+
+// Types returns the registered database types, sorted.
+func Types() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	return typesLocked()
+}
+
+func typesLocked() []string {
+	types := make([]string, 0, len(registry))
+	for t := range registry {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// findCommand returns the first of candidates found in PATH.
+func findCommand(candidates ...string) (string, error) {
+	for _, c := range candidates {
+		if _, err := exec.LookPath(c); err == nil {
+			return c, nil
+		}
+	}
+	return "", fmt.Errorf("%s command not found", strings.Join(candidates, " or "))
+}
+
+// commandVersion runs binary with args and returns the first line of output.
+func commandVersion(ctx context.Context, binary string, args ...string) (string, error) {
+	out, err := exec.CommandContext(ctx, binary, args...).Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to get %s version: %v", binary, err)
+	}
+	line, _, _ := strings.Cut(string(out), "\n")
+	return strings.TrimSpace(line), nil
+}
+
+// requireFields returns an error naming the first empty field.
+func requireFields(fields ...[2]string) error {
+	for _, f := range fields {
+		if f[1] == "" {
+			return fmt.Errorf("%s is required", f[0])
+		}
+	}
+	return nil
+}
@@ -0,0 +1,263 @@
+package dumper
+
+import (
+	"context"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/fidrasofyan/db-backup/internal/config"
+)
+
+const password = "s3cr3t"
+
+func testDBConfig(dbType, format string) config.BackupDBConfig {
+	return config.BackupDBConfig{
+		Type:     dbType,
+		Host:     "db.example.com",
+		Port:     "3306",
+		User:     "backup",
+		Password: password,
+		DBName:   "app",
+		Format:   format,
+	}
+}
+
+// fakeCommands makes PATH contain only executables with the given names.
+func fakeCommands(t *testing.T, names ...string) {
+	t.Helper()
+	dir := t.TempDir()
+	for _, name := range names {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("#!/bin/sh\n"), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("PATH", dir)
+}
+
+// checkCommand checks the arguments of cmd and that the password is passed
+// in envVar only.
+func checkCommand(t *testing.T, cmd *exec.Cmd, wantArgs []string, envVar string) {
+	t.Helper()
+	if !slices.Equal(cmd.Args, wantArgs) {
+		t.Errorf("args = %q, want %q", cmd.Args, wantArgs)
+	}
+	for _, arg := range cmd.Args {
+		if strings.Contains(arg, password) {
+			t.Errorf("password in argument %q", arg)
+		}
+	}
+	if !slices.Contains(cmd.Env, envVar+"="+password) {
+		t.Errorf("env doesn't contain %s", envVar)
+	}
+}
+
+func TestCommand(t *testing.T) {
+	tests := []struct {
+		name     string
+		dbType   string
+		format   string
+		binary   string
+		wantArgs []string
+		wantExt  string
+		envVar   string
+	}{
+		{
+			name:   "mysql",
+			dbType: "mysql",
+			binary: "mysqldump",
+			wantArgs: []string{"mysqldump", "--quick", "--single-transaction", "--routines", "--triggers", "--events",
+				"-hdb.example.com", "-P3306", "-ubackup", "app"},
+			wantExt: ".sql",
+			envVar:  "MYSQL_PWD",
+		},
+		{
+			name:   "mariadb",
+			dbType: "mariadb",
+			binary: "mariadb-dump",
+			wantArgs: []string{"mariadb-dump", "--quick", "--single-transaction", "--routines", "--triggers", "--events",
+				"-hdb.example.com", "-P3306", "-ubackup", "app"},
+			wantExt: ".sql",
+			envVar:  "MYSQL_PWD",
+		},
+		{
+			name:   "postgres plain",
+			dbType: "postgres",
+			binary: "pg_dump",
+			wantArgs: []string{"pg_dump", "--no-password", "--host=db.example.com", "--port=3306", "--username=backup",
+				"--dbname=app", "--format=plain"},
+			wantExt: ".sql",
+			envVar:  "PGPASSWORD",
+		},
+		{
+			name:   "postgres custom",
+			dbType: "postgres",
+			format: "custom",
+			binary: "pg_dump",
+			wantArgs: []string{"pg_dump", "--no-password", "--host=db.example.com", "--port=3306", "--username=backup",
+				"--dbname=app", "--format=custom", "--compress=0"},
+			wantExt: ".dump",
+			envVar:  "PGPASSWORD",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakeCommands(t, tt.binary)
+			d, err := Get(tt.dbType)
+			if err != nil {
+				t.Fatal(err)
+			}
+			dbConfig := testDBConfig(tt.dbType, tt.format)
+			if err := d.Validate(dbConfig); err != nil {
+				t.Fatalf("Validate() = %v", err)
+			}
+			binary, err := d.Binary()
+			if err != nil {
+				t.Fatalf("Binary() = %v", err)
+			}
+			if binary != tt.binary {
+				t.Errorf("Binary() = %q, want %q", binary, tt.binary)
+			}
+
+			checkCommand(t, d.Command(context.Background(), binary, dbConfig), tt.wantArgs, tt.envVar)
+			if ext := d.Extension(dbConfig); ext != tt.wantExt {
+				t.Errorf("Extension() = %q, want %q", ext, tt.wantExt)
+			}
+		})
+	}
+}
+
+func TestRestoreCommands(t *testing.T) {
+	tests := []struct {
+		name       string
+		dbType     string
+		binaries   []string
+		targetDB   string
+		ext        string
+		wantCreate []string
+		wantArgs   []string
+		envVar     string
+	}{
+		{
+			name:       "mysql",
+			dbType:     "mysql",
+			binaries:   []string{"mysql"},
+			targetDB:   "app_restore",
+			ext:        ".sql.gz",
+			wantCreate: []string{"mysql", "-hdb.example.com", "-P3306", "-ubackup", "-e", "CREATE DATABASE IF NOT EXISTS `app_restore`"},
+			wantArgs:   []string{"mysql", "-hdb.example.com", "-P3306", "-ubackup", "--database=app_restore"},
+			envVar:     "MYSQL_PWD",
+		},
+		{
+			name:       "mariadb with an unusual name",
+			dbType:     "mariadb",
+			binaries:   []string{"mariadb"},
+			targetDB:   "-x`y",
+			ext:        ".sql",
+			wantCreate: []string{"mariadb", "-hdb.example.com", "-P3306", "-ubackup", "-e", "CREATE DATABASE IF NOT EXISTS `-x``y`"},
+			wantArgs:   []string{"mariadb", "-hdb.example.com", "-P3306", "-ubackup", "--database=-x`y"},
+			envVar:     "MYSQL_PWD",
+		},
+		{
+			name:       "postgres plain",
+			dbType:     "postgres",
+			binaries:   []string{"psql", "pg_restore"},
+			targetDB:   "app_restore",
+			ext:        ".sql.zst",
+			wantCreate: []string{"psql", "--no-password", "--host=db.example.com", "--port=3306", "--username=backup", "--dbname=postgres", "--quiet"},
+			wantArgs: []string{"psql", "--no-password", "--host=db.example.com", "--port=3306", "--username=backup",
+				"--dbname=app_restore", "--set=ON_ERROR_STOP=1", "--quiet"},
+			envVar: "PGPASSWORD",
+		},
+		{
+			name:       "postgres custom",
+			dbType:     "postgres",
+			binaries:   []string{"psql", "pg_restore"},
+			targetDB:   "app_restore",
+			ext:        ".dump.gz.age",
+			wantCreate: []string{"psql", "--no-password", "--host=db.example.com", "--port=3306", "--username=backup", "--dbname=postgres", "--quiet"},
+			wantArgs:   []string{"pg_restore", "--no-password", "--host=db.example.com", "--port=3306", "--username=backup", "--dbname=app_restore"},
+			envVar:     "PGPASSWORD",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakeCommands(t, tt.binaries...)
+			d, err := Get(tt.dbType)
+			if err != nil {
+				t.Fatal(err)
+			}
+			createCmd, cmd, err := d.(Restorer).RestoreCommands(context.Background(), testDBConfig(tt.dbType, ""), tt.targetDB, tt.ext)
+			if err != nil {
+				t.Fatalf("RestoreCommands() = %v", err)
+			}
+			checkCommand(t, createCmd, tt.wantCreate, tt.envVar)
+			checkCommand(t, cmd, tt.wantArgs, tt.envVar)
+		})
+	}
+}
+
+func TestPostgresCreateStatement(t *testing.T) {
+	fakeCommands(t, "psql")
+	createCmd, _, err := Postgres{}.RestoreCommands(context.Background(), testDBConfig("postgres", ""), "it's", ".sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdin, err := io.ReadAll(createCmd.Stdin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "SELECT format('CREATE DATABASE %I', 'it''s') WHERE NOT EXISTS (SELECT FROM pg_database WHERE datname = 'it''s')\\gexec\n"
+	if string(stdin) != want {
+		t.Errorf("stdin = %q, want %q", stdin, want)
+	}
+}
+
+func TestRestoreCommandsMissingBinary(t *testing.T) {
+	fakeCommands(t)
+	if _, _, err := (MySQL{}).RestoreCommands(context.Background(), testDBConfig("mysql", ""), "app", ".sql"); err == nil {
+		t.Error("RestoreCommands() succeeded without mysql or mariadb in PATH")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		dbType  string
+		edit    func(c *config.BackupDBConfig)
+		wantErr bool
+	}{
+		{name: "mysql", dbType: "mysql", edit: func(c *config.BackupDBConfig) {}},
+		{name: "mysql without password", dbType: "mysql", edit: func(c *config.BackupDBConfig) { c.Password = "" }, wantErr: true},
+		{name: "mysql with format", dbType: "mysql", edit: func(c *config.BackupDBConfig) { c.Format = "custom" }, wantErr: true},
+		{name: "postgres custom", dbType: "postgres", edit: func(c *config.BackupDBConfig) { c.Format = "custom" }},
+		{name: "postgres invalid format", dbType: "postgres", edit: func(c *config.BackupDBConfig) { c.Format = "tar" }, wantErr: true},
+		{name: "postgres without host", dbType: "postgres", edit: func(c *config.BackupDBConfig) { c.Host = "" }, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, err := Get(tt.dbType)
+			if err != nil {
+				t.Fatal(err)
+			}
+			dbConfig := testDBConfig(tt.dbType, "")
+			tt.edit(&dbConfig)
+			if err := d.Validate(dbConfig); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestGetUnsupported(t *testing.T) {
+	if _, err := Get("oracle"); err == nil {
+		t.Error("Get() succeeded for an unregistered type")
+	}
+	if types := Types(); !slices.Equal(types, []string{"mariadb", "mysql", "postgres"}) {
+		t.Errorf("Types() = %q", types)
+	}
+}
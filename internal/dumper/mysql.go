@@ -0,0 +1,86 @@
+package dumper
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/fidrasofyan/db-backup/internal/config"
+)
+
+// MySQL dumps MySQL and MariaDB databases with mysqldump or mariadb-dump.
+type MySQL struct{}
+
+func init() {
+	Register("mysql", MySQL{})
+	Register("mariadb", MySQL{})
+}
+
+func (MySQL) Binary() (string, error) {
+	return findCommand("mysqldump", "mariadb-dump")
+}
+
+func (MySQL) Validate(dbConfig config.BackupDBConfig) error {
+	if dbConfig.Format != "" {
+		return fmt.Errorf("format is not supported for %s", dbConfig.Type)
+	}
+	return requireFields(
+		[2]string{"host", dbConfig.Host},
+		[2]string{"port", dbConfig.Port},
+		[2]string{"user", dbConfig.User},
+		[2]string{"password", dbConfig.Password},
+	)
+}
+
+func (MySQL) Command(ctx context.Context, binary string, dbConfig config.BackupDBConfig) *exec.Cmd {
+	cmd := exec.CommandContext(
+		ctx,
+		binary,
+		"--quick",
+		"--single-transaction",
+		"--routines",
+		"--triggers",
+		"--events",
+		"-h"+dbConfig.Host,
+		"-P"+dbConfig.Port,
+		"-u"+dbConfig.User,
+		dbConfig.DBName,
+	)
+
+	// Pass password via environment variable (more secure)
+	cmd.Env = append(os.Environ(), "MYSQL_PWD="+dbConfig.Password)
+	return cmd
+}
+
+func (MySQL) Extension(dbConfig config.BackupDBConfig) string {
+	return ".sql"
+}
+
+func (MySQL) Version(ctx context.Context, binary string) (string, error) {
+	return commandVersion(ctx, binary, "--version")
+}
+
+func (MySQL) RestoreCommands(ctx context.Context, dbConfig config.BackupDBConfig, targetDB, ext string) (*exec.Cmd, *exec.Cmd, error) {
+	binary, err := findCommand("mysql", "mariadb")
+	if err != nil {
+		return nil, nil, err
+	}
+	connArgs := []string{
+		"-h" + dbConfig.Host,
+		"-P" + dbConfig.Port,
+		"-u" + dbConfig.User,
+	}
+	// Pass password via environment variable (more secure)
+	env := append(os.Environ(), "MYSQL_PWD="+dbConfig.Password)
+
+	createCmd := exec.CommandContext(ctx, binary, append(connArgs, "-e", fmt.Sprintf("CREATE DATABASE IF NOT EXISTS `%s`", strings.ReplaceAll(targetDB, "`", "``")))...)
+	createCmd.Env = env
+
+	// A bare name starting with "-" would be read as an option
+	cmd := exec.CommandContext(ctx, binary, append(connArgs, "--database="+targetDB)...)
+	cmd.Env = env
+
+	return createCmd, cmd, nil
+}
@@ -0,0 +1,105 @@
+package dumper
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/fidrasofyan/db-backup/internal/config"
+)
+
+// Postgres dumps PostgreSQL databases with pg_dump in plain or custom format.
+type Postgres struct{}
+
+func init() {
+	Register("postgres", Postgres{})
+}
+
+func (Postgres) Binary() (string, error) {
+	return findCommand("pg_dump")
+}
+
+func (Postgres) Validate(dbConfig config.BackupDBConfig) error {
+	if dbConfig.Format != "" && dbConfig.Format != "plain" && dbConfig.Format != "custom" {
+		return fmt.Errorf("format %q is invalid (supported: plain, custom)", dbConfig.Format)
+	}
+	return requireFields(
+		[2]string{"host", dbConfig.Host},
+		[2]string{"port", dbConfig.Port},
+		[2]string{"user", dbConfig.User},
+		[2]string{"password", dbConfig.Password},
+	)
+}
+
+func (Postgres) Command(ctx context.Context, binary string, dbConfig config.BackupDBConfig) *exec.Cmd {
+	args := []string{
+		"--no-password",
+		"--host=" + dbConfig.Host,
+		"--port=" + dbConfig.Port,
+		"--username=" + dbConfig.User,
+		"--dbname=" + dbConfig.DBName,
+	}
+	if dbConfig.Format == "custom" {
+		// The archive is compressed afterwards, so skip pg_dump's own compression
+		args = append(args, "--format=custom", "--compress=0")
+	} else {
+		args = append(args, "--format=plain")
+	}
+	cmd := exec.CommandContext(ctx, binary, args...)
+
+	// Pass password via environment variable (more secure)
+	cmd.Env = append(os.Environ(), "PGPASSWORD="+dbConfig.Password)
+	return cmd
+}
+
+func (Postgres) Extension(dbConfig config.BackupDBConfig) string {
+	if dbConfig.Format == "custom" {
+		return ".dump"
+	}
+	return ".sql"
+}
+
+func (Postgres) Version(ctx context.Context, binary string) (string, error) {
+	return commandVersion(ctx, binary, "--version")
+}
+
+func (Postgres) RestoreCommands(ctx context.Context, dbConfig config.BackupDBConfig, targetDB, ext string) (*exec.Cmd, *exec.Cmd, error) {
+	psqlBinary, err := findCommand("psql")
+	if err != nil {
+		return nil, nil, err
+	}
+	connArgs := []string{
+		"--no-password",
+		"--host=" + dbConfig.Host,
+		"--port=" + dbConfig.Port,
+		"--username=" + dbConfig.User,
+	}
+	// Pass password via environment variable (more secure)
+	env := append(os.Environ(), "PGPASSWORD="+dbConfig.Password)
+
+	// CREATE DATABASE has no IF NOT EXISTS in postgres, so let psql
+	// execute the statement only when the database is missing
+	literal := "'" + strings.ReplaceAll(targetDB, "'", "''") + "'"
+	createCmd := exec.CommandContext(ctx, psqlBinary, append(connArgs, "--dbname=postgres", "--quiet")...)
+	createCmd.Env = env
+	createCmd.Stdin = strings.NewReader(fmt.Sprintf(
+		"SELECT format('CREATE DATABASE %%I', %s) WHERE NOT EXISTS (SELECT FROM pg_database WHERE datname = %s)\\gexec\n",
+		literal, literal,
+	))
+
+	var cmd *exec.Cmd
+	if strings.HasPrefix(ext, ".dump") {
+		restoreBinary, err := findCommand("pg_restore")
+		if err != nil {
+			return nil, nil, err
+		}
+		cmd = exec.CommandContext(ctx, restoreBinary, append(connArgs, "--dbname="+targetDB)...)
+	} else {
+		cmd = exec.CommandContext(ctx, psqlBinary, append(connArgs, "--dbname="+targetDB, "--set=ON_ERROR_STOP=1", "--quiet")...)
+	}
+	cmd.Env = env
+
+	return createCmd, cmd, nil
+}
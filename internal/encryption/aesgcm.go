@@ -0,0 +1,260 @@
+package encryption
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// The AES-GCM stream format is:
+//
+//	magic (8 bytes) | salt (16 bytes) | stream id (16 bytes) | sealed chunk...
+//
+// The key of a stream is derived with HKDF from the stream id and a master
+// key, which is derived from the passphrase and salt with PBKDF2. The master
+// key is derived once per salt, so encrypting many small streams, such as
+// snapshot chunks, stays fast.
+//
+// Each chunk holds up to aesChunkSize bytes of plaintext and is sealed with a
+// nonce made of the chunk counter and a flag marking the final chunk, so
+// reordered, dropped or truncated chunks fail authentication.
+const (
+	aesMagic      = "DBBKAES1"
+	aesSaltSize   = 16
+	aesStreamSize = 16
+	aesChunkSize  = 64 * 1024
+	aesIterations = 600000
+	// aesContentSalt derives the master key of ContentKey, which must be the
+	// same on every run
+	aesContentSalt = aesMagic + " content"
+)
+
+type aesGCM struct {
+	passphrase string
+
+	mu sync.Mutex
+	// salt is shared by the streams encrypted by this instance
+	salt []byte
+	// masterKeys caches the PBKDF2 keys by salt
+	masterKeys map[string][]byte
+}
+
+func (a *aesGCM) Extension() string {
+	return AESGCMFileExt
+}
+
+func (a *aesGCM) masterKey(salt []byte) ([]byte, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if key, ok := a.masterKeys[string(salt)]; ok {
+		return key, nil
+	}
+	key, err := pbkdf2.Key(sha256.New, a.passphrase, salt, aesIterations, 32)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive key: %v", err)
+	}
+	if a.masterKeys == nil {
+		a.masterKeys = map[string][]byte{}
+	}
+	a.masterKeys[string(salt)] = key
+	return key, nil
+}
+
+// aead returns the cipher of a stream.
+func (a *aesGCM) aead(salt, streamID []byte) (cipher.AEAD, error) {
+	key, err := a.masterKey(salt)
+	if err != nil {
+		return nil, err
+	}
+	key, err = hkdf.Key(sha256.New, key, streamID, aesMagic, 32)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive key: %v", err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (a *aesGCM) ContentKey() ([]byte, error) {
+	key, err := a.masterKey([]byte(aesContentSalt))
+	if err != nil {
+		return nil, err
+	}
+	return hkdf.Key(sha256.New, key, nil, contentKeyInfo, 32)
+}
+
+func (a *aesGCM) Encrypt(w io.Writer) (io.WriteCloser, error) {
+	a.mu.Lock()
+	if a.salt == nil {
+		salt := make([]byte, aesSaltSize)
+		if _, err := rand.Read(salt); err != nil {
+			a.mu.Unlock()
+			return nil, fmt.Errorf("failed to generate salt: %v", err)
+		}
+		a.salt = salt
+	}
+	salt := a.salt
+	a.mu.Unlock()
+
+	streamID := make([]byte, aesStreamSize)
+	if _, err := rand.Read(streamID); err != nil {
+		return nil, fmt.Errorf("failed to generate stream id: %v", err)
+	}
+	aead, err := a.aead(salt, streamID)
+	if err != nil {
+		return nil, err
+	}
+
+	header := append([]byte(aesMagic), salt...)
+	if _, err := w.Write(append(header, streamID...)); err != nil {
+		return nil, err
+	}
+
+	return &aesWriter{
+		w:    w,
+		aead: aead,
+		buf:  make([]byte, 0, aesChunkSize),
+	}, nil
+}
+
+func (a *aesGCM) Decrypt(r io.Reader) (io.Reader, error) {
+	header := make([]byte, len(aesMagic)+aesSaltSize+aesStreamSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("failed to read encryption header: %v", err)
+	}
+	if string(header[:len(aesMagic)]) != aesMagic {
+		return nil, errors.New("not an aes-gcm encrypted stream")
+	}
+	salt := header[len(aesMagic) : len(aesMagic)+aesSaltSize]
+	streamID := header[len(aesMagic)+aesSaltSize:]
+
+	aead, err := a.aead(salt, streamID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &aesReader{
+		r:    bufio.NewReaderSize(r, aesChunkSize+aead.Overhead()+1),
+		aead: aead,
+		buf:  make([]byte, aesChunkSize+aead.Overhead()),
+	}, nil
+}
+
+func aesNonce(counter uint64, final bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce, counter)
+	if final {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+type aesWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	buf     []byte
+	counter uint64
+	closed  bool
+}
+
+func (w *aesWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, errors.New("write to closed encryptor")
+	}
+
+	n := 0
+	for len(p) > 0 {
+		// Only flush a full chunk once more data arrives, so the last chunk
+		// is always sealed as final in Close
+		if len(w.buf) == aesChunkSize {
+			if err := w.flush(false); err != nil {
+				return n, err
+			}
+		}
+		c := copy(w.buf[len(w.buf):aesChunkSize], p)
+		w.buf = w.buf[:len(w.buf)+c]
+		p = p[c:]
+		n += c
+	}
+	return n, nil
+}
+
+func (w *aesWriter) flush(final bool) error {
+	sealed := w.aead.Seal(nil, aesNonce(w.counter, final), w.buf, nil)
+	if _, err := w.w.Write(sealed); err != nil {
+		return err
+	}
+	w.counter++
+	w.buf = w.buf[:0]
+	return nil
+}
+
+func (w *aesWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	return w.flush(true)
+}
+
+type aesReader struct {
+	r       *bufio.Reader
+	aead    cipher.AEAD
+	buf     []byte
+	plain   []byte
+	counter uint64
+	done    bool
+}
+
+func (r *aesReader) Read(p []byte) (int, error) {
+	for len(r.plain) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.plain)
+	r.plain = r.plain[n:]
+	return n, nil
+}
+
+func (r *aesReader) next() error {
+	n, err := io.ReadFull(r.r, r.buf)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		if err == io.EOF {
+			return errors.New("encrypted stream is truncated")
+		}
+		return err
+	}
+
+	// A chunk is final when nothing follows it
+	final := err == io.ErrUnexpectedEOF
+	if !final {
+		if _, err := r.r.Peek(1); err == io.EOF {
+			final = true
+		}
+	}
+
+	plain, err := r.aead.Open(nil, aesNonce(r.counter, final), r.buf[:n], nil)
+	if err != nil {
+		return errors.New("failed to decrypt: wrong passphrase or corrupted data")
+	}
+	r.counter++
+	r.plain = plain
+	r.done = final
+	return nil
+}
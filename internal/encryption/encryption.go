@@ -0,0 +1,129 @@
+package encryption
+
+import (
+	"crypto/hkdf"
+	"crypto/pbkdf2"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"filippo.io/age"
+	"github.com/fidrasofyan/db-backup/internal/config"
+)
+
+const (
+	// contentKeyInfo separates ContentKey from other keys derived from a
+	// secret
+	contentKeyInfo = "db-backup content key"
+	// ageContentSalt derives the ContentKey of age from encryption.content_key
+	ageContentSalt = "db-backup age content"
+)
+
+// File extensions appended to encrypted backups
+const (
+	AgeFileExt    = ".age"
+	AESGCMFileExt = ".enc"
+)
+
+// Encryptor wraps backup streams with client-side encryption.
+type Encryptor interface {
+	// Extension returns the file extension appended to encrypted files.
+	Extension() string
+	// Encrypt returns a writer that encrypts to w. Close must be called to
+	// flush the final block; it does not close w.
+	Encrypt(w io.Writer) (io.WriteCloser, error)
+	// Decrypt returns a reader that decrypts r.
+	Decrypt(r io.Reader) (io.Reader, error)
+	// ContentKey returns a stable secret for keyed hashes of plaintext, such
+	// as the names of snapshot chunks, so stored names don't reveal content.
+	ContentKey() ([]byte, error)
+}
+
+// New returns the encryptor configured in cfg, or nil if encryption is
+// disabled.
+func New(cfg config.EncryptionConfig) (Encryptor, error) {
+	switch cfg.Type {
+	case "":
+		return nil, nil
+	case "age":
+		return newAge(cfg)
+	case "aes-gcm":
+		if cfg.Passphrase == "" {
+			return nil, errors.New("encryption.passphrase is required")
+		}
+		return &aesGCM{passphrase: cfg.Passphrase}, nil
+	default:
+		return nil, fmt.Errorf("encryption.type %q is invalid", cfg.Type)
+	}
+}
+
+// IsEncrypted reports whether ext ends with an encryption extension.
+func IsEncrypted(ext string) bool {
+	return strings.HasSuffix(ext, AgeFileExt) || strings.HasSuffix(ext, AESGCMFileExt)
+}
+
+type ageEncryptor struct {
+	recipients []age.Recipient
+	identities []age.Identity
+	contentKey string
+}
+
+func newAge(cfg config.EncryptionConfig) (*ageEncryptor, error) {
+	a := &ageEncryptor{contentKey: cfg.ContentKey}
+	for i, r := range cfg.Recipients {
+		recipient, err := age.ParseX25519Recipient(r)
+		if err != nil {
+			return nil, fmt.Errorf("encryption.recipients[%d] is invalid: %v", i, err)
+		}
+		a.recipients = append(a.recipients, recipient)
+	}
+
+	if cfg.IdentityFile != "" {
+		f, err := os.Open(cfg.IdentityFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open encryption.identity_file: %v", err)
+		}
+		defer f.Close()
+
+		a.identities, err = age.ParseIdentities(f)
+		if err != nil {
+			return nil, fmt.Errorf("encryption.identity_file is invalid: %v", err)
+		}
+	}
+
+	return a, nil
+}
+
+func (a *ageEncryptor) Extension() string {
+	return AgeFileExt
+}
+
+func (a *ageEncryptor) Encrypt(w io.Writer) (io.WriteCloser, error) {
+	if len(a.recipients) == 0 {
+		return nil, errors.New("encryption.recipients is required to encrypt")
+	}
+	return age.Encrypt(w, a.recipients...)
+}
+
+// ContentKey is derived from encryption.content_key, as the recipients are
+// public and anyone could recompute names keyed by them.
+func (a *ageEncryptor) ContentKey() ([]byte, error) {
+	if a.contentKey == "" {
+		return nil, errors.New("encryption.content_key is required for snapshots")
+	}
+	key, err := pbkdf2.Key(sha256.New, a.contentKey, []byte(ageContentSalt), aesIterations, 32)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive key: %v", err)
+	}
+	return hkdf.Key(sha256.New, key, nil, contentKeyInfo, 32)
+}
+
+func (a *ageEncryptor) Decrypt(r io.Reader) (io.Reader, error) {
+	if len(a.identities) == 0 {
+		return nil, errors.New("encryption.identity_file is required to decrypt")
+	}
+	return age.Decrypt(r, a.identities...)
+}
@@ -0,0 +1,253 @@
+package metrics
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fidrasofyan/db-backup/internal/report"
+)
+
+const lastSuccessMetric = "db_backup_last_success_timestamp_seconds"
+
+// Registry keeps the latest backup outcome of every database and renders it
+// in the Prometheus text exposition format.
+type Registry struct {
+	mu  sync.Mutex
+	dbs map[string]*dbState
+}
+
+type dbState struct {
+	lastRun     time.Time
+	lastSuccess time.Time
+	success     bool
+	last        report.Database
+	// restored holds the values read by LoadTextfile, used until the
+	// database is recorded again
+	restored map[string]float64
+}
+
+func NewRegistry() *Registry {
+	return &Registry{dbs: map[string]*dbState{}}
+}
+
+// Record updates the registry with the outcome of a run.
+func (r *Registry) Record(run *report.Run) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, d := range run.Databases() {
+		state, ok := r.dbs[d.Name]
+		if !ok {
+			state = &dbState{}
+			r.dbs[d.Name] = state
+		}
+		state.lastRun = run.StartedAt
+		state.success = d.Success
+		state.last = d
+		state.restored = nil
+		if d.Success {
+			state.lastSuccess = d.FinishedAt
+		}
+	}
+}
+
+// Prune drops databases not in names, e.g. after they were removed from the
+// config.
+func (r *Registry) Prune(names []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	keep := map[string]bool{}
+	for _, name := range names {
+		keep[name] = true
+	}
+	for name := range r.dbs {
+		if !keep[name] {
+			delete(r.dbs, name)
+		}
+	}
+}
+
+type metric struct {
+	name  string
+	help  string
+	value func(s *dbState) float64
+}
+
+var dbMetrics = []metric{
+	{"db_backup_last_run_timestamp_seconds", "Unix time of the last backup run.", func(s *dbState) float64 {
+		return unixSeconds(s.lastRun)
+	}},
+	{lastSuccessMetric, "Unix time of the last successful backup.", func(s *dbState) float64 {
+		return unixSeconds(s.lastSuccess)
+	}},
+	{"db_backup_last_run_success", "Whether the last backup run succeeded (1) or failed (0).", func(s *dbState) float64 {
+		if s.success {
+			return 1
+		}
+		return 0
+	}},
+	{"db_backup_duration_seconds", "Duration of the last dump.", func(s *dbState) float64 {
+		if s.last.StartedAt.IsZero() || s.last.FinishedAt.IsZero() {
+			return 0
+		}
+		return s.last.Duration().Seconds()
+	}},
+	{"db_backup_dump_size_bytes", "Size of the last stored dump.", func(s *dbState) float64 {
+		return float64(s.last.DumpSize)
+	}},
+	{"db_backup_upload_bytes", "Bytes uploaded in the last run.", func(s *dbState) float64 {
+		return float64(s.last.UploadedBytes)
+	}},
+	{"db_backup_uploaded_files", "Files uploaded in the last run.", func(s *dbState) float64 {
+		return float64(s.last.Uploaded)
+	}},
+	{"db_backup_skipped_files", "Files skipped in the last run because they already existed or were empty.", func(s *dbState) float64 {
+		return float64(s.last.Skipped)
+	}},
+	{"db_backup_deleted_files", "Backups deleted by retention in the last run.", func(s *dbState) float64 {
+		return float64(s.last.Deleted)
+	}},
+	{"db_backup_retries", "Dump attempts and S3 requests retried in the last run.", func(s *dbState) float64 {
+		return float64(s.last.Retries())
+	}},
+}
+
+func unixSeconds(t time.Time) float64 {
+	if t.IsZero() {
+		return 0
+	}
+	return float64(t.UnixNano()) / 1e9
+}
+
+// WriteTo writes all metrics in the Prometheus text exposition format.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	names := make([]string, 0, len(r.dbs))
+	for name := range r.dbs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	for _, m := range dbMetrics {
+		fmt.Fprintf(&buf, "# HELP %s %s\n", m.name, m.help)
+		fmt.Fprintf(&buf, "# TYPE %s gauge\n", m.name)
+		for _, name := range names {
+			state := r.dbs[name]
+			value, ok := state.restored[m.name]
+			if !ok {
+				value = m.value(state)
+			}
+			fmt.Fprintf(&buf, "%s{database=%q} %s\n", m.name, name, strconv.FormatFloat(value, 'f', -1, 64))
+		}
+	}
+	return buf.WriteTo(w)
+}
+
+// Handler serves the metrics over HTTP.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		r.WriteTo(w)
+	})
+}
+
+// WriteTextfile writes the metrics to path for the node_exporter textfile
+// collector. The file is replaced atomically so the collector never reads a
+// partial file.
+func (r *Registry) WriteTextfile(path string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".db-backup-metrics-*")
+	if err != nil {
+		return fmt.Errorf("failed to write metrics: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := r.WriteTo(tmp); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write metrics: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write metrics: %v", err)
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return fmt.Errorf("failed to write metrics: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to write metrics: %v", err)
+	}
+	return nil
+}
+
+// LoadTextfile restores the metrics from a textfile written by a previous
+// run, so databases that are not part of this run keep their last outcome and
+// a failed run doesn't reset the last success time. A missing file is not an
+// error.
+func (r *Registry) LoadTextfile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to read metrics: %v", err)
+	}
+	defer f.Close()
+
+	known := map[string]bool{}
+	for _, m := range dbMetrics {
+		known[m.name] = true
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// Format: name{database="x"} value
+		line := scanner.Text()
+		metricName, rest, found := strings.Cut(line, "{database=")
+		if !found || !known[metricName] {
+			continue
+		}
+		i := strings.LastIndex(rest, "} ")
+		if i < 0 {
+			continue
+		}
+		name, err := strconv.Unquote(rest[:i])
+		if err != nil {
+			continue
+		}
+		value, err := strconv.ParseFloat(rest[i+2:], 64)
+		if err != nil {
+			continue
+		}
+
+		state, ok := r.dbs[name]
+		if !ok {
+			state = &dbState{restored: map[string]float64{}}
+			r.dbs[name] = state
+		}
+		if state.restored == nil {
+			// Recorded in this process already
+			continue
+		}
+		state.restored[metricName] = value
+		if metricName == lastSuccessMetric && value != 0 {
+			sec := int64(value)
+			state.lastSuccess = time.Unix(sec, int64((value-float64(sec))*1e9))
+		}
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,120 @@
+package notify
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+
+	"github.com/fidrasofyan/db-backup/internal/report"
+)
+
+// Email sends the run report over SMTP. STARTTLS is used when the server
+// offers it, unless TLS is implicit.
+type Email struct {
+	Host string
+	Port string
+	// TLS is starttls or implicit. Empty is implicit on port 465 and
+	// starttls otherwise.
+	TLS      string
+	Username string
+	Password string
+	From     string
+	To       []string
+	// TLSConfig, if set, is used for implicit TLS connections
+	TLSConfig *tls.Config
+}
+
+func (e *Email) Name() string {
+	return "email"
+}
+
+func (e *Email) Notify(ctx context.Context, summary report.Summary) error {
+	var auth smtp.Auth
+	if e.Username != "" {
+		auth = smtp.PlainAuth("", e.Username, e.Password, e.Host)
+	}
+
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "From: %s\r\n", e.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(e.To, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject(summary)))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	msg.WriteString("\r\n")
+	msg.WriteString(strings.ReplaceAll(text(summary), "\n", "\r\n"))
+
+	// smtp.SendMail has no context support, so bound it by the deadline
+	errCh := make(chan error, 1)
+	go func() {
+		addr := net.JoinHostPort(e.Host, e.Port)
+		if e.implicitTLS() {
+			errCh <- e.sendTLS(addr, auth, []byte(msg.String()))
+			return
+		}
+		errCh <- smtp.SendMail(addr, auth, e.From, e.To, []byte(msg.String()))
+	}()
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (e *Email) implicitTLS() bool {
+	return e.TLS == "implicit" || e.TLS == "" && e.Port == "465"
+}
+
+// sendTLS sends msg like smtp.SendMail over a connection that starts with
+// TLS, as servers on port 465 expect.
+func (e *Email) sendTLS(addr string, auth smtp.Auth, msg []byte) error {
+	config := e.TLSConfig
+	if config == nil {
+		config = &tls.Config{ServerName: e.Host}
+	}
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 30 * time.Second}, "tcp", addr, config)
+	if err != nil {
+		return err
+	}
+	c, err := smtp.NewClient(conn, e.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if auth != nil {
+		if ok, _ := c.Extension("AUTH"); !ok {
+			return errors.New("smtp: server doesn't support AUTH")
+		}
+		if err := c.Auth(auth); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(e.From); err != nil {
+		return err
+	}
+	for _, to := range e.To {
+		if err := c.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
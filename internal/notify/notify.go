@@ -0,0 +1,140 @@
+package notify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/fidrasofyan/db-backup/internal/config"
+	"github.com/fidrasofyan/db-backup/internal/report"
+)
+
+// Notifier delivers a run report to a single sink.
+type Notifier interface {
+	// Name identifies the sink in logs.
+	Name() string
+	Notify(ctx context.Context, summary report.Summary) error
+}
+
+type sink struct {
+	notifier      Notifier
+	onFailureOnly bool
+}
+
+// Dispatcher sends run reports to every configured sink.
+type Dispatcher struct {
+	sinks []sink
+}
+
+func New(cfgs []config.NotificationConfig) (*Dispatcher, error) {
+	client := &http.Client{Timeout: 30 * time.Second}
+
+	d := &Dispatcher{}
+	for i, cfg := range cfgs {
+		var n Notifier
+		switch cfg.Type {
+		case "webhook":
+			n = &Webhook{URL: cfg.URL, Client: client}
+		case "slack":
+			n = &Slack{URL: cfg.URL, Client: client}
+		case "email":
+			n = &Email{
+				Host:     cfg.SMTPHost,
+				Port:     cfg.SMTPPort,
+				TLS:      cfg.TLS,
+				Username: cfg.Username,
+				Password: cfg.Password,
+				From:     cfg.From,
+				To:       cfg.To,
+			}
+		default:
+			return nil, fmt.Errorf("notifications[%d].type is invalid", i)
+		}
+		d.sinks = append(d.sinks, sink{notifier: n, onFailureOnly: cfg.OnFailureOnly})
+	}
+	return d, nil
+}
+
+// Notify sends summary to every sink that wants it. A failing sink doesn't
+// stop the others; all errors are returned joined.
+func (d *Dispatcher) Notify(ctx context.Context, summary report.Summary) error {
+	var errs []error
+	for _, s := range d.sinks {
+		if s.onFailureOnly && summary.Success {
+			continue
+		}
+		if err := s.notifier.Notify(ctx, summary); err != nil {
+			errs = append(errs, fmt.Errorf("%s notification failed: %w", s.notifier.Name(), err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// subject returns a one-line description of the run.
+func subject(summary report.Summary) string {
+	if summary.Success && len(summary.Warnings()) > 0 {
+		return fmt.Sprintf("[db-backup] Backup succeeded with warnings on %s (%d of %d destinations failed)", summary.Hostname, len(summary.Warnings()), len(summary.Destinations))
+	}
+	if summary.Success {
+		return fmt.Sprintf("[db-backup] Backup succeeded on %s", summary.Hostname)
+	}
+	return fmt.Sprintf("[db-backup] Backup FAILED on %s (%d of %d databases)", summary.Hostname, len(summary.Failed()), len(summary.Databases))
+}
+
+// text renders the run as plain text, one line per database and, if there
+// is more than one, per destination.
+func text(summary report.Summary) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Host: %s\n", summary.Hostname)
+	fmt.Fprintf(&b, "Started: %s\n", summary.StartedAt.Format(time.RFC3339))
+	fmt.Fprintf(&b, "Duration: %s\n", summary.FinishedAt.Sub(summary.StartedAt).Round(time.Second))
+	if summary.Error != "" {
+		fmt.Fprintf(&b, "Error: %s\n", summary.Error)
+	}
+	b.WriteString("\n")
+
+	for _, d := range summary.Databases {
+		var retries string
+		if d.Retries() > 0 {
+			retries = fmt.Sprintf(" | retries: %d", d.Retries())
+		}
+		if d.Success {
+			fmt.Fprintf(&b, "- %s: OK | size: %s | duration: %s | uploaded: %d | skipped: %d | deleted: %d%s\n",
+				d.Name, formatBytes(d.DumpSize), d.Duration().Round(time.Second), d.Uploaded, d.Skipped, d.Deleted, retries)
+		} else {
+			fmt.Fprintf(&b, "- %s: FAILED%s | %s\n", d.Name, retries, d.Error)
+		}
+	}
+
+	if len(summary.Destinations) > 1 {
+		b.WriteString("\nDestinations:\n")
+		for _, d := range summary.Destinations {
+			switch {
+			case d.Success:
+				fmt.Fprintf(&b, "- %s: OK | uploaded: %d (%s) | skipped: %d | deleted: %d\n",
+					d.Name, d.Uploaded, formatBytes(d.UploadedBytes), d.Skipped, d.Deleted)
+			case d.Optional:
+				fmt.Fprintf(&b, "- %s: WARNING | %s\n", d.Name, d.Error)
+			default:
+				fmt.Fprintf(&b, "- %s: FAILED | %s\n", d.Name, d.Error)
+			}
+		}
+	}
+	return b.String()
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,337 @@
+package notify
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fidrasofyan/db-backup/internal/config"
+	"github.com/fidrasofyan/db-backup/internal/report"
+)
+
+func testSummary(success bool) report.Summary {
+	started := time.Date(2024, 3, 10, 2, 0, 0, 0, time.UTC)
+	summary := report.Summary{
+		Hostname:   "db1",
+		Success:    success,
+		StartedAt:  started,
+		FinishedAt: started.Add(90 * time.Second),
+		Databases: []report.Database{{
+			Name:       "app",
+			Success:    true,
+			StartedAt:  started,
+			FinishedAt: started.Add(80 * time.Second),
+			DumpSize:   3 * 1024 * 1024,
+			Uploaded:   1,
+		}},
+	}
+	if !success {
+		summary.Error = "1 of 2 databases failed"
+		summary.Databases = append(summary.Databases, report.Database{
+			Name:  "shop",
+			Error: "dump failed: exit status 2",
+		})
+	}
+	return summary
+}
+
+// request is a request received by a test server.
+type request struct {
+	method      string
+	contentType string
+	body        []byte
+}
+
+// testServer returns a server that records the first request it receives
+// and responds with status and body.
+func testServer(t *testing.T, status int, body string) (*httptest.Server, chan request) {
+	t.Helper()
+	requests := make(chan request, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req request
+		req.method = r.Method
+		req.contentType = r.Header.Get("Content-Type")
+		req.body, _ = io.ReadAll(r.Body)
+		select {
+		case requests <- req:
+		default:
+		}
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(srv.Close)
+	return srv, requests
+}
+
+func TestWebhook(t *testing.T) {
+	srv, requests := testServer(t, http.StatusNoContent, "")
+	w := &Webhook{URL: srv.URL, Client: srv.Client()}
+
+	summary := testSummary(false)
+	if err := w.Notify(context.Background(), summary); err != nil {
+		t.Fatalf("Notify() = %v", err)
+	}
+
+	req := <-requests
+	if req.method != http.MethodPost || req.contentType != "application/json" {
+		t.Errorf("got %s with content type %q, want a JSON POST", req.method, req.contentType)
+	}
+	var got report.Summary
+	if err := json.Unmarshal(req.body, &got); err != nil {
+		t.Fatalf("invalid payload %s: %v", req.body, err)
+	}
+	if got.Hostname != "db1" || got.Success || got.Error != summary.Error || len(got.Databases) != 2 {
+		t.Errorf("payload = %+v, want %+v", got, summary)
+	}
+	if got.Databases[1].Name != "shop" || got.Databases[1].Error != "dump failed: exit status 2" {
+		t.Errorf("failed database = %+v", got.Databases[1])
+	}
+}
+
+func TestSlack(t *testing.T) {
+	srv, requests := testServer(t, http.StatusOK, "ok")
+	s := &Slack{URL: srv.URL, Client: srv.Client()}
+
+	if err := s.Notify(context.Background(), testSummary(true)); err != nil {
+		t.Fatalf("Notify() = %v", err)
+	}
+
+	req := <-requests
+	var got map[string]string
+	if err := json.Unmarshal(req.body, &got); err != nil {
+		t.Fatalf("invalid payload %s: %v", req.body, err)
+	}
+	for _, want := range []string{
+		"*[db-backup] Backup succeeded on db1*",
+		"- app: OK | size: 3.0 MiB | duration: 1m20s | uploaded: 1 | skipped: 0 | deleted: 0\n",
+	} {
+		if !strings.Contains(got["text"], want) {
+			t.Errorf("text %q doesn't contain %q", got["text"], want)
+		}
+	}
+}
+
+func TestPostJSONError(t *testing.T) {
+	srv, _ := testServer(t, http.StatusInternalServerError, "invalid_token\n")
+	for _, n := range []Notifier{
+		&Webhook{URL: srv.URL, Client: srv.Client()},
+		&Slack{URL: srv.URL, Client: srv.Client()},
+	} {
+		err := n.Notify(context.Background(), testSummary(true))
+		if err == nil || !strings.Contains(err.Error(), "500") || !strings.Contains(err.Error(), "invalid_token") {
+			t.Errorf("%s: Notify() = %v, want the status and body", n.Name(), err)
+		}
+	}
+}
+
+// smtpServer accepts one SMTP session on a local port and sends the message
+// it receives on the returned channel. The session starts with TLS if
+// tlsConfig is set.
+func smtpServer(t *testing.T, tlsConfig *tls.Config) (string, string, chan string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	if tlsConfig != nil {
+		ln = tls.NewListener(ln, tlsConfig)
+	}
+
+	messages := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		tp := textproto.NewConn(conn)
+		tp.PrintfLine("220 localhost ESMTP")
+		for {
+			line, err := tp.ReadLine()
+			if err != nil {
+				return
+			}
+			switch cmd, _, _ := strings.Cut(line, " "); strings.ToUpper(cmd) {
+			case "EHLO", "HELO":
+				tp.PrintfLine("250 localhost")
+			case "DATA":
+				tp.PrintfLine("354 go ahead")
+				data, err := tp.ReadDotBytes()
+				if err != nil {
+					return
+				}
+				messages <- string(data)
+				tp.PrintfLine("250 queued")
+			case "QUIT":
+				tp.PrintfLine("221 bye")
+				return
+			default:
+				tp.PrintfLine("250 ok")
+			}
+		}
+	}()
+
+	host, port, _ := net.SplitHostPort(ln.Addr().String())
+	return host, port, messages
+}
+
+// receive returns the message received by an SMTP server and its header.
+func receive(t *testing.T, messages chan string) (string, textproto.MIMEHeader) {
+	t.Helper()
+	var msg string
+	select {
+	case msg = <-messages:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message received")
+	}
+	header, err := textproto.NewReader(bufio.NewReader(strings.NewReader(msg))).ReadMIMEHeader()
+	if err != nil {
+		t.Fatalf("invalid message %q: %v", msg, err)
+	}
+	return msg, header
+}
+
+func TestEmail(t *testing.T) {
+	host, port, messages := smtpServer(t, nil)
+	e := &Email{
+		Host: host,
+		Port: port,
+		From: "backup@example.com",
+		To:   []string{"ops@example.com", "dba@example.com"},
+	}
+
+	if err := e.Notify(context.Background(), testSummary(false)); err != nil {
+		t.Fatalf("Notify() = %v", err)
+	}
+
+	msg, header := receive(t, messages)
+	if got := header.Get("To"); got != "ops@example.com, dba@example.com" {
+		t.Errorf("To = %q", got)
+	}
+	if got := header.Get("Subject"); got != "[db-backup] Backup FAILED on db1 (1 of 2 databases)" {
+		t.Errorf("Subject = %q", got)
+	}
+	if !strings.Contains(msg, "- shop: FAILED | dump failed: exit status 2\n") {
+		t.Errorf("message %q doesn't list the failed database", msg)
+	}
+}
+
+func TestEmailImplicitTLS(t *testing.T) {
+	// Borrow the certificate of a TLS test server
+	srv := httptest.NewTLSServer(http.NotFoundHandler())
+	srv.Close()
+	host, port, messages := smtpServer(t, &tls.Config{Certificates: srv.TLS.Certificates})
+	e := &Email{
+		Host:      host,
+		Port:      port,
+		TLS:       "implicit",
+		From:      "backup@example.com",
+		To:        []string{"ops@example.com"},
+		TLSConfig: srv.Client().Transport.(*http.Transport).TLSClientConfig,
+	}
+
+	summary := testSummary(true)
+	summary.Hostname = "bücher-db"
+	if err := e.Notify(context.Background(), summary); err != nil {
+		t.Fatalf("Notify() = %v", err)
+	}
+
+	_, header := receive(t, messages)
+	raw := header.Get("Subject")
+	if strings.ContainsFunc(raw, func(r rune) bool { return r > 127 }) {
+		t.Errorf("Subject %q is not encoded", raw)
+	}
+	got, err := new(mime.WordDecoder).DecodeHeader(raw)
+	if err != nil || got != "[db-backup] Backup succeeded on bücher-db" {
+		t.Errorf("Subject = %q (%v), want the hostname decoded", got, err)
+	}
+}
+
+// fakeNotifier records the summaries it is sent.
+type fakeNotifier struct {
+	name  string
+	err   error
+	calls []report.Summary
+}
+
+func (n *fakeNotifier) Name() string {
+	return n.name
+}
+
+func (n *fakeNotifier) Notify(ctx context.Context, summary report.Summary) error {
+	n.calls = append(n.calls, summary)
+	return n.err
+}
+
+func TestDispatcherOnFailureOnly(t *testing.T) {
+	always := &fakeNotifier{name: "always"}
+	onFailure := &fakeNotifier{name: "on-failure"}
+	d := &Dispatcher{sinks: []sink{
+		{notifier: always},
+		{notifier: onFailure, onFailureOnly: true},
+	}}
+
+	if err := d.Notify(context.Background(), testSummary(true)); err != nil {
+		t.Fatalf("Notify() = %v", err)
+	}
+	if len(always.calls) != 1 || len(onFailure.calls) != 0 {
+		t.Errorf("successful run: got %d and %d notifications, want 1 and 0", len(always.calls), len(onFailure.calls))
+	}
+
+	if err := d.Notify(context.Background(), testSummary(false)); err != nil {
+		t.Fatalf("Notify() = %v", err)
+	}
+	if len(always.calls) != 2 || len(onFailure.calls) != 1 {
+		t.Errorf("failed run: got %d and %d notifications, want 2 and 1", len(always.calls), len(onFailure.calls))
+	}
+}
+
+func TestDispatcherErrors(t *testing.T) {
+	errDown := errors.New("down")
+	failing := &fakeNotifier{name: "failing", err: errDown}
+	next := &fakeNotifier{name: "next"}
+	d := &Dispatcher{sinks: []sink{{notifier: failing}, {notifier: next}}}
+
+	err := d.Notify(context.Background(), testSummary(true))
+	if !errors.Is(err, errDown) || !strings.Contains(err.Error(), "failing notification failed") {
+		t.Errorf("Notify() = %v, want the error of the failing sink", err)
+	}
+	if len(next.calls) != 1 {
+		t.Error("a failing sink stopped the others")
+	}
+}
+
+func TestNew(t *testing.T) {
+	d, err := New([]config.NotificationConfig{
+		{Type: "webhook", URL: "http://example.com/hook"},
+		{Type: "slack", URL: "http://example.com/slack", OnFailureOnly: true},
+		{Type: "email", SMTPHost: "localhost", SMTPPort: "25"},
+	})
+	if err != nil {
+		t.Fatalf("New() = %v", err)
+	}
+	var names []string
+	for _, s := range d.sinks {
+		names = append(names, s.notifier.Name())
+	}
+	if strings.Join(names, ",") != "webhook,slack,email" || !d.sinks[1].onFailureOnly {
+		t.Errorf("sinks = %v", d.sinks)
+	}
+
+	if _, err := New([]config.NotificationConfig{{Type: "pager"}}); err == nil {
+		t.Error("New() accepted an invalid type")
+	}
+}
@@ -0,0 +1,219 @@
+package report
+
+import (
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Database is the outcome of one database in a backup run.
+type Database struct {
+	Name       string    `json:"name"`
+	Success    bool      `json:"success"`
+	Error      string    `json:"error,omitempty"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	// DumpSize is the size of the stored (compressed) dump
+	DumpSize      int64 `json:"dump_size"`
+	UploadedBytes int64 `json:"uploaded_bytes"`
+	Uploaded      int   `json:"uploaded"`
+	Skipped       int   `json:"skipped"`
+	Deleted       int   `json:"deleted"`
+	// DumpRetries and UploadRetries count the retried dumps and S3 requests
+	DumpRetries   int `json:"dump_retries"`
+	UploadRetries int `json:"upload_retries"`
+}
+
+// Retries is the total number of retries.
+func (d *Database) Retries() int {
+	return d.DumpRetries + d.UploadRetries
+}
+
+func (d *Database) Duration() time.Duration {
+	return d.FinishedAt.Sub(d.StartedAt)
+}
+
+// Destination is the outcome of uploading to and pruning one destination in a
+// backup run.
+type Destination struct {
+	Name    string `json:"name"`
+	Success bool   `json:"success"`
+	// Optional destinations don't fail the run; their errors are warnings
+	Optional      bool   `json:"optional"`
+	Error         string `json:"error,omitempty"`
+	UploadedBytes int64  `json:"uploaded_bytes"`
+	Uploaded      int    `json:"uploaded"`
+	Skipped       int    `json:"skipped"`
+	Deleted       int    `json:"deleted"`
+}
+
+// Run collects the outcome of a backup run. It is safe for concurrent use,
+// and its methods are no-ops on a nil *Run.
+type Run struct {
+	mu         sync.Mutex
+	Hostname   string
+	StartedAt  time.Time
+	FinishedAt time.Time
+	Error      string
+	databases  map[string]*Database
+	// destinations is in config order, the primary first
+	destinations []*Destination
+}
+
+func New() *Run {
+	hostname, _ := os.Hostname()
+	return &Run{
+		Hostname:  hostname,
+		StartedAt: time.Now(),
+		databases: map[string]*Database{},
+	}
+}
+
+// Update calls fn with the entry of database name, creating it if needed.
+func (r *Run) Update(name string, fn func(d *Database)) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	d, ok := r.databases[name]
+	if !ok {
+		d = &Database{Name: name}
+		r.databases[name] = d
+	}
+	fn(d)
+}
+
+// UpdateDestination calls fn with the entry of destination name, creating it
+// if needed.
+func (r *Run) UpdateDestination(name string, fn func(d *Destination)) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, d := range r.destinations {
+		if d.Name == name {
+			fn(d)
+			return
+		}
+	}
+	d := &Destination{Name: name}
+	r.destinations = append(r.destinations, d)
+	fn(d)
+}
+
+// Failed reports whether database name has recorded an error.
+func (r *Run) Failed(name string) bool {
+	if r == nil {
+		return false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	d, ok := r.databases[name]
+	return ok && d.Error != ""
+}
+
+// Finish records the end of the run and its error, if any.
+func (r *Run) Finish(err error) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.FinishedAt = time.Now()
+	if err != nil {
+		r.Error = err.Error()
+	}
+}
+
+// Databases returns a copy of the database entries, sorted by name.
+func (r *Run) Databases() []Database {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	dbs := make([]Database, 0, len(r.databases))
+	for _, d := range r.databases {
+		dbs = append(dbs, *d)
+	}
+	sort.Slice(dbs, func(i, j int) bool {
+		return dbs[i].Name < dbs[j].Name
+	})
+	return dbs
+}
+
+// Destinations returns a copy of the destination entries, in config order.
+func (r *Run) Destinations() []Destination {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	dests := make([]Destination, len(r.destinations))
+	for i, d := range r.destinations {
+		dests[i] = *d
+	}
+	return dests
+}
+
+// Summary is a point-in-time copy of a run, e.g. for notifications.
+type Summary struct {
+	Hostname   string     `json:"hostname"`
+	Success    bool       `json:"success"`
+	Error      string     `json:"error,omitempty"`
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt time.Time  `json:"finished_at"`
+	Databases  []Database `json:"databases"`
+	// Destinations is empty for runs that didn't upload
+	Destinations []Destination `json:"destinations,omitempty"`
+}
+
+// Failed returns the databases that failed.
+func (s Summary) Failed() []Database {
+	var failed []Database
+	for _, d := range s.Databases {
+		if !d.Success {
+			failed = append(failed, d)
+		}
+	}
+	return failed
+}
+
+// Warnings returns the optional destinations that failed. They don't affect
+// Success.
+func (s Summary) Warnings() []Destination {
+	var warnings []Destination
+	for _, d := range s.Destinations {
+		if !d.Success && d.Optional {
+			warnings = append(warnings, d)
+		}
+	}
+	return warnings
+}
+
+func (r *Run) Summary() Summary {
+	dbs := r.Databases()
+	dests := r.Destinations()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return Summary{
+		Hostname:     r.Hostname,
+		Success:      r.Error == "",
+		Error:        r.Error,
+		StartedAt:    r.StartedAt,
+		FinishedAt:   r.FinishedAt,
+		Databases:    dbs,
+		Destinations: dests,
+	}
+}
@@ -0,0 +1,154 @@
+package retention
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Policy decides which backups to keep. A backup is kept when any rule
+// selects it. The zero Policy keeps everything.
+type Policy struct {
+	// KeepLast keeps the newest n backups
+	KeepLast int
+	// Daily, Weekly, Monthly and Yearly keep the newest backup of each of the
+	// last n days, ISO weeks, months and years that have a backup
+	Daily   int
+	Weekly  int
+	Monthly int
+	Yearly  int
+	// MaxAge deletes backups older than this, even if a rule above keeps
+	// them. The newest backup is never deleted.
+	MaxAge time.Duration
+}
+
+// Backup is a single backup identified by ID, as seen by the policy.
+type Backup struct {
+	ID        string
+	Timestamp time.Time
+}
+
+func (p Policy) IsZero() bool {
+	return p == Policy{}
+}
+
+// hasCountRules reports whether any count based rule is set.
+func (p Policy) hasCountRules() bool {
+	return p.KeepLast > 0 || p.Daily > 0 || p.Weekly > 0 || p.Monthly > 0 || p.Yearly > 0
+}
+
+func (p Policy) String() string {
+	var parts []string
+	add := func(name string, n int) {
+		if n > 0 {
+			parts = append(parts, fmt.Sprintf("%s=%d", name, n))
+		}
+	}
+	add("last", p.KeepLast)
+	add("daily", p.Daily)
+	add("weekly", p.Weekly)
+	add("monthly", p.Monthly)
+	add("yearly", p.Yearly)
+	if p.MaxAge > 0 {
+		parts = append(parts, "max_age="+p.MaxAge.String())
+	}
+	if len(parts) == 0 {
+		return "keep all"
+	}
+	return strings.Join(parts, " ")
+}
+
+// Apply returns the backups that policy deletes, newest first. It doesn't
+// modify backups.
+func Apply(policy Policy, backups []Backup, now time.Time) []Backup {
+	if policy.IsZero() || len(backups) == 0 {
+		return nil
+	}
+
+	sorted := make([]Backup, len(backups))
+	copy(sorted, backups)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Timestamp.After(sorted[j].Timestamp)
+	})
+
+	keep := make([]bool, len(sorted))
+	if policy.hasCountRules() {
+		for i := 0; i < policy.KeepLast && i < len(sorted); i++ {
+			keep[i] = true
+		}
+		keepPeriods(sorted, keep, policy.Daily, func(t time.Time) string {
+			return t.Format("2006-01-02")
+		})
+		keepPeriods(sorted, keep, policy.Weekly, func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%d-%02d", year, week)
+		})
+		keepPeriods(sorted, keep, policy.Monthly, func(t time.Time) string {
+			return t.Format("2006-01")
+		})
+		keepPeriods(sorted, keep, policy.Yearly, func(t time.Time) string {
+			return t.Format("2006")
+		})
+	} else {
+		// Only max_age is set
+		for i := range keep {
+			keep[i] = true
+		}
+	}
+
+	if policy.MaxAge > 0 {
+		cutoff := now.Add(-policy.MaxAge)
+		for i, b := range sorted {
+			if i > 0 && b.Timestamp.Before(cutoff) {
+				keep[i] = false
+			}
+		}
+	}
+
+	var deleted []Backup
+	for i, b := range sorted {
+		if !keep[i] {
+			deleted = append(deleted, b)
+		}
+	}
+	return deleted
+}
+
+// keepPeriods marks the newest backup of each of the first n distinct periods.
+// sorted must be newest first.
+func keepPeriods(sorted []Backup, keep []bool, n int, period func(time.Time) string) {
+	if n <= 0 {
+		return
+	}
+	last := ""
+	for i, b := range sorted {
+		p := period(b.Timestamp)
+		if p == last {
+			continue
+		}
+		last = p
+		keep[i] = true
+		n--
+		if n == 0 {
+			return
+		}
+	}
+}
+
+// ParseMaxAge parses a duration that also accepts a day suffix, e.g. "90d".
+func ParseMaxAge(s string) (time.Duration, error) {
+	if days, found := strings.CutSuffix(s, "d"); found {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	return d, nil
+}
@@ -0,0 +1,157 @@
+package retention
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+const stamp = "20060102-150405"
+
+// backups returns a backup for each timestamp, identified by it.
+func backups(t *testing.T, timestamps ...string) []Backup {
+	t.Helper()
+	var list []Backup
+	for _, s := range timestamps {
+		ts, err := time.Parse(stamp, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		list = append(list, Backup{ID: s, Timestamp: ts})
+	}
+	return list
+}
+
+func TestApply(t *testing.T) {
+	now := time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		policy  Policy
+		backups []string
+		want    []string
+	}{
+		{
+			name:    "empty policy",
+			policy:  Policy{},
+			backups: []string{"20240310-020000", "20240101-020000", "20200101-020000"},
+			want:    nil,
+		},
+		{
+			name:    "no backups",
+			policy:  Policy{KeepLast: 1},
+			backups: nil,
+			want:    nil,
+		},
+		{
+			name:    "keep last",
+			policy:  Policy{KeepLast: 2},
+			backups: []string{"20240308-020000", "20240310-020000", "20240307-020000", "20240309-020000"},
+			want:    []string{"20240308-020000", "20240307-020000"},
+		},
+		{
+			name:    "daily at midnight",
+			policy:  Policy{Daily: 2},
+			backups: []string{"20240303-235959", "20240303-000000", "20240302-235959", "20240302-000000", "20240301-120000"},
+			want:    []string{"20240303-000000", "20240302-000000", "20240301-120000"},
+		},
+		{
+			name:    "daily skips days without backups",
+			policy:  Policy{Daily: 2},
+			backups: []string{"20240310-020000", "20240301-020000", "20240201-020000"},
+			want:    []string{"20240201-020000"},
+		},
+		{
+			// 2024-12-30 is the Monday of ISO week 1 of 2025
+			name:    "weekly across the ISO year boundary",
+			policy:  Policy{Weekly: 2},
+			backups: []string{"20250106-000000", "20250105-230000", "20241230-000000", "20241229-235959"},
+			want:    []string{"20241230-000000", "20241229-235959"},
+		},
+		{
+			name:    "weekly keeps the last week of the ISO year",
+			policy:  Policy{Weekly: 3},
+			backups: []string{"20250106-000000", "20250105-230000", "20241230-000000", "20241229-235959"},
+			want:    []string{"20241230-000000"},
+		},
+		{
+			name:    "monthly at the end of february",
+			policy:  Policy{Monthly: 2},
+			backups: []string{"20240301-000000", "20240229-235959", "20240201-000000", "20240131-235959"},
+			want:    []string{"20240201-000000", "20240131-235959"},
+		},
+		{
+			name:    "yearly at new year",
+			policy:  Policy{Yearly: 2},
+			backups: []string{"20250101-000000", "20241231-235959", "20240101-000000", "20231231-235959"},
+			want:    []string{"20240101-000000", "20231231-235959"},
+		},
+		{
+			name:    "grandfather-father-son",
+			policy:  Policy{Daily: 2, Monthly: 2},
+			backups: []string{"20240310-020000", "20240309-020000", "20240301-020000", "20240215-020000", "20240115-020000"},
+			want:    []string{"20240301-020000", "20240115-020000"},
+		},
+		{
+			name:    "max_age with grandfather-father-son",
+			policy:  Policy{Daily: 7, Monthly: 12, MaxAge: 48 * time.Hour},
+			backups: []string{"20240310-020000", "20240309-020000", "20240308-020000", "20240201-020000"},
+			want:    []string{"20240308-020000", "20240201-020000"},
+		},
+		{
+			name:    "max_age keeps backups at the cutoff",
+			policy:  Policy{MaxAge: 48 * time.Hour},
+			backups: []string{"20240310-020000", "20240308-120000", "20240308-115959"},
+			want:    []string{"20240308-115959"},
+		},
+		{
+			name:    "max_age keeps the newest backup",
+			policy:  Policy{KeepLast: 3, MaxAge: 24 * time.Hour},
+			backups: []string{"20240301-020000", "20240201-020000"},
+			want:    []string{"20240201-020000"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			list := backups(t, tt.backups...)
+			original := slices.Clone(list)
+
+			var got []string
+			for _, b := range Apply(tt.policy, list, now) {
+				got = append(got, b.ID)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("Apply() deleted %v, want %v", got, tt.want)
+			}
+			if !slices.Equal(list, original) {
+				t.Errorf("Apply() modified backups: %v", list)
+			}
+		})
+	}
+}
+
+func TestParseMaxAge(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    time.Duration
+		wantErr bool
+	}{
+		{in: "90d", want: 90 * 24 * time.Hour},
+		{in: "0d", want: 0},
+		{in: "36h", want: 36 * time.Hour},
+		{in: "-1d", wantErr: true},
+		{in: "-1h", wantErr: true},
+		{in: "1w", wantErr: true},
+		{in: "d", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParseMaxAge(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseMaxAge(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ParseMaxAge(%q) = %v, want %v", tt.in, got, tt.want)
+			}
+		})
+	}
+}
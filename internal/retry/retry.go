@@ -0,0 +1,90 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"time"
+)
+
+// Policy retries a failed operation with exponential backoff and full
+// jitter. The zero Policy tries once.
+type Policy struct {
+	// MaxAttempts is the number of tries, including the first one
+	MaxAttempts int
+	// BaseDelay is the longest wait before the first retry. It doubles with
+	// every following retry, up to MaxDelay.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+}
+
+// Delay returns the wait before retry n, starting at 1. It is a random
+// duration between zero and the exponential backoff, so clients failing
+// together don't retry together.
+func (p Policy) Delay(n int) time.Duration {
+	backoff := p.BaseDelay
+	for i := 1; i < n && backoff < p.MaxDelay; i++ {
+		backoff *= 2
+	}
+	if p.MaxDelay > 0 {
+		backoff = min(backoff, p.MaxDelay)
+	}
+	if backoff <= 0 {
+		return 0
+	}
+	return rand.N(backoff + 1)
+}
+
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+// Permanent marks err as not worth retrying.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err: err}
+}
+
+// Do calls fn until it succeeds, returns an error marked Permanent, the
+// attempts are used up or ctx is done. onRetry, if not nil, is called with
+// the attempt about to be made, the wait before it and the error of the
+// previous attempt. Do returns the last error.
+func (p Policy) Do(ctx context.Context, fn func() error, onRetry func(attempt int, delay time.Duration, err error)) error {
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+
+		var perm *permanentError
+		if errors.As(err, &perm) {
+			return perm.err
+		}
+		if attempt >= p.MaxAttempts || ctx.Err() != nil {
+			return err
+		}
+
+		delay := p.Delay(attempt)
+		if onRetry != nil {
+			onRetry(attempt+1, delay, err)
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+}
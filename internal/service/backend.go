@@ -0,0 +1,52 @@
+package service
+
+import (
+	"context"
+	"io"
+)
+
+// Backend stores backups as objects under slash separated keys. Storage
+// stores them in an S3 bucket, FileBackend in a local directory or over
+// SFTP, and MemoryBackend in memory.
+type Backend interface {
+	// Put stores data as a single object, e.g. a snapshot chunk
+	Put(ctx context.Context, key string, data []byte) error
+	// Get opens the object for reading. The caller must close the returned
+	// body.
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// Stat returns the object's metadata, or nil if it doesn't exist
+	Stat(ctx context.Context, key string) (*Object, error)
+	// List returns every object under prefix
+	List(ctx context.Context, prefix string) ([]Object, error)
+	// Remove deletes the object. Deleting a missing object is not an error.
+	Remove(ctx context.Context, key string) error
+	// RemoveMany deletes keys, reporting those that failed in the returned
+	// error
+	RemoveMany(ctx context.Context, keys []string) error
+
+	// Upload stores a local file, in parts if the backend supports it
+	Upload(ctx context.Context, params *UploadParams) error
+	// UploadStream stores everything read from r and returns its size
+	UploadStream(ctx context.Context, params *UploadStreamParams, r io.Reader) (int64, error)
+	// Download writes the object to w and returns its size, after verifying
+	// the downloaded data against the object's metadata
+	Download(ctx context.Context, params *DownloadParams, w io.Writer) (int64, error)
+	// MatchesFile reports whether obj, as returned by Stat, has the size and
+	// content of the local file at path, uploaded by Upload with partSize.
+	// The file's checksums are cached in cacheFile, if set.
+	MatchesFile(ctx context.Context, obj *Object, path string, partSize int64, cacheFile string) (bool, error)
+	// ListMultipartUploads returns the uploads under prefix that were
+	// started but never finished
+	ListMultipartUploads(ctx context.Context, prefix string) ([]MultipartUpload, error)
+	// AbortMultipartUpload discards an unfinished upload
+	AbortMultipartUpload(ctx context.Context, key, uploadID string) error
+
+	// Close releases the backend's connections
+	Close() error
+}
+
+var (
+	_ Backend = (*Storage)(nil)
+	_ Backend = (*FileBackend)(nil)
+	_ Backend = (*MemoryBackend)(nil)
+)
@@ -0,0 +1,226 @@
+package service
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// Every upload sends the CRC32C checksum of its body, which S3 checks before
+// accepting it. S3 reports the checksum of a multipart object as the CRC32C
+// of its parts' checksums followed by the part count, e.g. "pR9o1g==-3".
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// crc32cOf returns the base64 encoded CRC32C of everything read from r, as
+// S3 expects it.
+func crc32cOf(r io.Reader) (string, error) {
+	hash := crc32.New(crc32cTable)
+	if _, err := io.Copy(hash, r); err != nil {
+		return "", fmt.Errorf("failed to compute checksum: %w", err)
+	}
+	return base64.StdEncoding.EncodeToString(hash.Sum(nil)), nil
+}
+
+// compositeChecksum returns the checksum of a multipart object made of parts
+// with the given checksums.
+func compositeChecksum(partChecksums []string) string {
+	hash := crc32.New(crc32cTable)
+	for _, checksum := range partChecksums {
+		sum, _ := base64.StdEncoding.DecodeString(checksum)
+		hash.Write(sum)
+	}
+	return fmt.Sprintf("%s-%d", base64.StdEncoding.EncodeToString(hash.Sum(nil)), len(partChecksums))
+}
+
+// checksumParts returns the part count of a multipart object's checksum, or
+// 0 for the checksum of a single part upload.
+func checksumParts(checksum string) int {
+	_, count, ok := strings.Cut(checksum, "-")
+	if !ok {
+		return 0
+	}
+	n, err := strconv.Atoi(count)
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+// partLayout describes the part sizes of a multipart object. Upload uses
+// parts of the same size, UploadStream parts that grow. The zero layout is
+// an object uploaded in one request.
+type partLayout struct {
+	// size is the size of the first part
+	size   int64
+	stream bool
+}
+
+// partSize returns the size of part n, starting at 1.
+func (l partLayout) partSize(n int) int64 {
+	if l.stream {
+		return streamPartSize(int32(n), l.size)
+	}
+	return l.size
+}
+
+// key identifies the layout in the checksum cache.
+func (l partLayout) key() string {
+	if l.stream {
+		return "stream-" + strconv.FormatInt(l.size, 10)
+	}
+	return strconv.FormatInt(l.size, 10)
+}
+
+// layoutOf returns the layout with a first part of first bytes that splits
+// size bytes in parts parts.
+func layoutOf(size int64, parts int, first int64) (partLayout, bool) {
+	for _, l := range []partLayout{{size: first}, {size: first, stream: true}} {
+		if partCount(size, l.partSize) == parts {
+			return l, true
+		}
+	}
+	return partLayout{}, false
+}
+
+// partCount returns the number of parts of an object of size with the part
+// sizes returned by partSize.
+func partCount(size int64, partSize func(n int) int64) int {
+	n := 0
+	for total := int64(0); total < size; total += partSize(n) {
+		n++
+	}
+	return n
+}
+
+// detectLayout returns the layout of obj uploaded in parts parts. hint, if
+// positive, is a likely first part size tried before asking S3 for the size
+// of the first part. ok is false if the part sizes can't be told.
+func (s *Storage) detectLayout(ctx context.Context, obj *Object, parts int, hint int64) (partLayout, bool, error) {
+	if hint > 0 {
+		if layout, ok := layoutOf(obj.Size, parts, hint); ok {
+			return layout, true, nil
+		}
+	}
+	first, err := s.firstPartSize(ctx, obj.Key)
+	if err != nil {
+		return partLayout{}, false, err
+	}
+	if first <= 0 {
+		return partLayout{}, false, nil
+	}
+	layout, ok := layoutOf(obj.Size, parts, first)
+	return layout, ok, nil
+}
+
+// fileChecksum returns the checksum S3 reports for size bytes of file
+// uploaded with layout.
+func fileChecksum(file io.ReaderAt, size int64, layout partLayout) (string, error) {
+	if layout.size <= 0 {
+		return crc32cOf(io.NewSectionReader(file, 0, size))
+	}
+
+	var partChecksums []string
+	for offset, n := int64(0), 1; offset < size; n++ {
+		partSize := min(layout.partSize(n), size-offset)
+		checksum, err := crc32cOf(io.NewSectionReader(file, offset, partSize))
+		if err != nil {
+			return "", err
+		}
+		partChecksums = append(partChecksums, checksum)
+		offset += partSize
+	}
+	return compositeChecksum(partChecksums), nil
+}
+
+// fileMatches reports whether obj has the size and content of the local file
+// at path. Objects without a checksum, e.g. uploaded by older versions or by
+// backends that don't keep checksums, are compared by size only. layout
+// returns the part layout of a multipart object, ok is false if it can't be
+// told. Checksums are looked up in and added to the cache file at cacheFile,
+// if set.
+func fileMatches(obj *Object, path, cacheFile string, layout func(parts int) (partLayout, bool, error)) (bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return false, fmt.Errorf("failed to open file: %v", err)
+	}
+	defer file.Close()
+
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return false, fmt.Errorf("failed to get file info: %v", err)
+	}
+	if fileInfo.Size() != obj.Size {
+		return false, nil
+	}
+	if obj.Checksum == "" {
+		return true, nil
+	}
+
+	var parts partLayout
+	if n := checksumParts(obj.Checksum); n > 0 {
+		if layout == nil {
+			return false, nil
+		}
+		var ok bool
+		parts, ok, err = layout(n)
+		if err != nil {
+			return false, err
+		}
+		if !ok {
+			return false, nil
+		}
+	}
+
+	cache := loadChecksumCache(cacheFile, fileInfo)
+	if checksum, ok := cache.Checksums[parts.key()]; ok {
+		return checksum == obj.Checksum, nil
+	}
+	checksum, err := fileChecksum(file, obj.Size, parts)
+	if err != nil {
+		return false, err
+	}
+	cache.set(parts, checksum)
+	return checksum == obj.Checksum, nil
+}
+
+// verifyUpload compares the checksum S3 reported for a finished upload with
+// the expected one. An object that doesn't match is deleted, so it isn't
+// mistaken for a good copy later. Some S3 compatible services don't report
+// checksums, then there is nothing to compare.
+func (s *Storage) verifyUpload(ctx context.Context, key, expected string, got *string) error {
+	if aws.ToString(got) == "" || aws.ToString(got) == expected {
+		return nil
+	}
+
+	if err := s.Remove(ctx, key); err != nil {
+		log.Printf("Warning: failed to delete corrupt object %s: %v\n", key, err)
+	}
+	return fmt.Errorf("checksum mismatch for %s: expected %s, got %s", key, expected, aws.ToString(got))
+}
+
+// firstPartSize returns the size of the first part of a multipart object.
+func (s *Storage) firstPartSize(ctx context.Context, key string) (int64, error) {
+	var res *s3.HeadObjectOutput
+	err := s.do(ctx, "head part 1 of "+key, nil, func() (err error) {
+		res, err = s.client.HeadObject(ctx, &s3.HeadObjectInput{
+			Bucket:     aws.String(s.bucket),
+			Key:        aws.String(key),
+			PartNumber: aws.Int32(1),
+		})
+		return err
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to get part size of %s: %w", key, err)
+	}
+	return aws.ToInt64(res.ContentLength), nil
+}
@@ -0,0 +1,83 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// checksumCache holds the checksums of a local file by part layout. It is
+// persisted in a small JSON file next to the file, like the upload state, so
+// backups that were already uploaded aren't read again on every run just to
+// be compared with their objects.
+type checksumCache struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	// Checksums maps part layout keys, "0" for a single part, to the
+	// checksum S3 reports for the file uploaded with that layout
+	Checksums map[string]string `json:"checksums"`
+
+	path string
+}
+
+// loadChecksumCache reads the cache file at path. The cache is empty if
+// there is none or it was saved for another version of the file with info.
+func loadChecksumCache(path string, info os.FileInfo) *checksumCache {
+	fresh := &checksumCache{
+		Size:      info.Size(),
+		ModTime:   info.ModTime(),
+		Checksums: map[string]string{},
+		path:      path,
+	}
+	if path == "" {
+		return fresh
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return fresh
+	}
+	if err != nil {
+		log.Printf("Warning: failed to read checksum cache: %v\n", err)
+		return fresh
+	}
+	cache := &checksumCache{path: path}
+	if err := json.Unmarshal(data, cache); err != nil {
+		log.Printf("Warning: failed to parse checksum cache %s: %v\n", path, err)
+		return fresh
+	}
+	if cache.Size != info.Size() || !cache.ModTime.Equal(info.ModTime()) || cache.Checksums == nil {
+		return fresh
+	}
+	return cache
+}
+
+// set records the checksum for layout and saves the cache. Failing to save
+// is only logged, as the checksum can be computed again.
+func (c *checksumCache) set(layout partLayout, checksum string) {
+	if c.path == "" || c.Checksums[layout.key()] == checksum {
+		return
+	}
+	c.Checksums[layout.key()] = checksum
+	if err := c.save(); err != nil {
+		log.Printf("Warning: %v\n", err)
+	}
+}
+
+func (c *checksumCache) save() error {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	tmp := c.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return fmt.Errorf("failed to write checksum cache: %v", err)
+	}
+	if err := os.Rename(tmp, c.path); err != nil {
+		return fmt.Errorf("failed to write checksum cache: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package service
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLayoutOf(t *testing.T) {
+	tests := []struct {
+		name   string
+		size   int64
+		parts  int
+		first  int64
+		want   partLayout
+		wantOK bool
+	}{
+		{name: "equal parts", size: 25, parts: 3, first: 10, want: partLayout{size: 10}, wantOK: true},
+		// Stream parts double after MaxParts/10 parts
+		{name: "stream parts", size: 3000, parts: 2000, first: 1, want: partLayout{size: 1, stream: true}, wantOK: true},
+		{name: "other part size", size: 25, parts: 2, first: 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := layoutOf(tt.size, tt.parts, tt.first)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("layoutOf() = %+v, %v, want %+v, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestFileMatchesStreamedObject(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 300)
+	path := filepath.Join(t.TempDir(), "app_20240101-020000.sql.gz")
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	// The checksum S3 reports for data streamed in growing parts
+	var partChecksums []string
+	for offset, n := 0, 1; offset < len(data); n++ {
+		size := int(streamPartSize(int32(n), 1))
+		checksum, err := crc32cOf(bytes.NewReader(data[offset : offset+size]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		partChecksums = append(partChecksums, checksum)
+		offset += size
+	}
+	obj := &Object{Size: int64(len(data)), Checksum: compositeChecksum(partChecksums)}
+
+	cacheFile := path + ".crc32c"
+	layout := func(parts int) (partLayout, bool, error) {
+		l, ok := layoutOf(obj.Size, parts, 1)
+		return l, ok, nil
+	}
+	for _, run := range []string{"computed", "cached"} {
+		matches, err := fileMatches(obj, path, cacheFile, layout)
+		if err != nil || !matches {
+			t.Fatalf("%s: fileMatches() = %v, %v, want a match", run, matches, err)
+		}
+	}
+	if _, err := os.Stat(cacheFile); err != nil {
+		t.Errorf("checksum not cached: %v", err)
+	}
+
+	obj.Checksum = compositeChecksum(partChecksums[1:])
+	if matches, err := fileMatches(obj, path, "", layout); err != nil || matches {
+		t.Errorf("fileMatches() = %v, %v, want no match", matches, err)
+	}
+}
@@ -0,0 +1,325 @@
+package service
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+type DownloadParams struct {
+	Key string
+	// PartSize is the size of the ranges downloaded in parallel. It defaults
+	// to MinPartSize.
+	PartSize int64
+	// Concurrency is the number of ranges downloaded in parallel. Up to this
+	// many parts are buffered in memory.
+	Concurrency int
+	// OnRetry, if set, is called for every retried request
+	OnRetry func()
+}
+
+// Download writes the object to w in order and returns its size. Ranges of
+// params.PartSize are fetched params.Concurrency at a time, each requested
+// with the object's ETag so the object can't change in between. The size and
+// the CRC32C checksum, or else the ETag, of the downloaded data are verified
+// against the object.
+func (s *Storage) Download(ctx context.Context, params *DownloadParams, w io.Writer) (int64, error) {
+	// Validate parameters
+	if params == nil {
+		return 0, errors.New("params cannot be nil")
+	}
+	if params.Key == "" {
+		return 0, errors.New("key is required")
+	}
+	partSize := params.PartSize
+	if partSize <= 0 {
+		partSize = MinPartSize
+	}
+	concurrency := max(params.Concurrency, 1)
+
+	obj, err := s.Stat(ctx, params.Key)
+	if err != nil {
+		return 0, err
+	}
+	if obj == nil {
+		return 0, fmt.Errorf("object %s not found: %w", params.Key, os.ErrNotExist)
+	}
+	sum, expected, err := s.objectHash(ctx, obj)
+	if err != nil {
+		return 0, err
+	}
+	if sum != nil {
+		w = io.MultiWriter(w, sum)
+	} else {
+		log.Printf("Warning: can't verify the checksum or ETag of %s, only its size is verified\n", obj.Key)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Parts are fetched concurrently but written in order. A part holds its
+	// slot until it is written, which bounds the parts in memory.
+	type partResult struct {
+		data []byte
+		err  error
+	}
+	parts := (obj.Size + partSize - 1) / partSize
+	slots := make(chan struct{}, concurrency)
+	results := make(chan chan partResult, concurrency)
+	go func() {
+		defer close(results)
+		for i := int64(0); i < parts; i++ {
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			start := i * partSize
+			end := min(start+partSize, obj.Size) - 1
+
+			result := make(chan partResult, 1)
+			go func() {
+				data, err := s.getRange(ctx, obj, start, end, params.OnRetry)
+				result <- partResult{data: data, err: err}
+			}()
+			results <- result
+		}
+	}()
+
+	var written int64
+	for result := range results {
+		part := <-result
+		<-slots
+		if part.err != nil {
+			return written, part.err
+		}
+		n, err := w.Write(part.data)
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return written, err
+	}
+
+	// Verify the download
+	if written != obj.Size {
+		return written, fmt.Errorf("size mismatch for %s: expected %d, got %d", obj.Key, obj.Size, written)
+	}
+	if sum != nil {
+		if got := sum.Sum(); got != expected {
+			return written, fmt.Errorf("checksum mismatch for %s: expected %s, got %s", obj.Key, expected, got)
+		}
+	}
+	return written, nil
+}
+
+// getRange downloads the bytes from start to end, inclusive, of obj.
+func (s *Storage) getRange(ctx context.Context, obj *Object, start, end int64, onRetry func()) ([]byte, error) {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(obj.Key),
+		Range:  aws.String(fmt.Sprintf("bytes=%d-%d", start, end)),
+	}
+	if obj.ETag != "" {
+		input.IfMatch = aws.String(obj.ETag)
+	}
+
+	var data []byte
+	err := s.do(ctx, fmt.Sprintf("get %s bytes %d-%d", obj.Key, start, end), onRetry, func() error {
+		res, err := s.client.GetObject(ctx, input)
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+
+		data, err = io.ReadAll(res.Body)
+		if err != nil {
+			return &readError{err: err}
+		}
+		if int64(len(data)) != end-start+1 {
+			return fmt.Errorf("got %d bytes, expected %d", len(data), end-start+1)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to download %s: %w", obj.Key, err)
+	}
+	return data, nil
+}
+
+// readError is a failure reading a response body, e.g. because the
+// connection dropped. Unlike other errors of the body, the SDK doesn't see
+// it, so it is marked retryable here.
+type readError struct {
+	err error
+}
+
+func (e *readError) Error() string {
+	return e.err.Error()
+}
+
+func (e *readError) Unwrap() error {
+	return e.err
+}
+
+func (e *readError) RetryableError() bool {
+	return true
+}
+
+// objectHash returns a hash of the object's data written in order and the
+// value it must sum to: the CRC32C checksum S3 has for obj, or else its
+// ETag. The ETag is the MD5 digest of an object uploaded in one request, or
+// the digest of its parts' digests suffixed with the part count, unless S3
+// encrypts the object with KMS or a customer key. It returns nil if neither
+// can be computed, e.g. because the part sizes can't be told.
+func (s *Storage) objectHash(ctx context.Context, obj *Object) (*objectHash, string, error) {
+	if obj.Checksum != "" {
+		h, err := s.partHash(ctx, obj, checksumParts(obj.Checksum), &objectHash{
+			newHash: func() hash.Hash { return crc32.New(crc32cTable) },
+			encode:  base64.StdEncoding.EncodeToString,
+		})
+		return h, obj.Checksum, err
+	}
+	if obj.SSE {
+		return nil, "", nil
+	}
+
+	etag := strings.Trim(obj.ETag, `"`)
+	digest, count, multipart := strings.Cut(etag, "-")
+	if _, err := hex.DecodeString(digest); err != nil || len(digest) != 2*md5.Size {
+		return nil, "", nil
+	}
+	parts := 0
+	if multipart {
+		n, err := strconv.Atoi(count)
+		if err != nil || n < 1 {
+			return nil, "", nil
+		}
+		parts = n
+	}
+	h, err := s.partHash(ctx, obj, parts, &objectHash{
+		newHash: md5.New,
+		encode:  hex.EncodeToString,
+	})
+	return h, etag, err
+}
+
+// partHash sets up h for obj uploaded in parts parts, 0 for an object
+// uploaded in one request. It returns nil if the part sizes can't be told.
+func (s *Storage) partHash(ctx context.Context, obj *Object, parts int, h *objectHash) (*objectHash, error) {
+	h.hash = h.newHash()
+	if parts == 0 {
+		return h, nil
+	}
+
+	layout, ok, err := s.detectLayout(ctx, obj, parts, 0)
+	if err != nil || !ok {
+		return nil, err
+	}
+	h.partSize = layout.partSize
+	return h, nil
+}
+
+// objectHash computes an S3 checksum or ETag from the object's data written
+// in order.
+type objectHash struct {
+	// newHash returns the hash of the data, and of the part digests
+	newHash func() hash.Hash
+	// encode formats a digest, e.g. in hex
+	encode func([]byte) string
+	hash   hash.Hash
+	// partSize returns the size of part n, starting at 1. It is nil for
+	// objects uploaded in one request.
+	partSize func(n int) int64
+	parts    int
+	left     int64
+	sums     []byte
+}
+
+func (h *objectHash) Write(p []byte) (int, error) {
+	if h.partSize == nil {
+		return h.hash.Write(p)
+	}
+
+	n := len(p)
+	for len(p) > 0 {
+		if h.left == 0 {
+			h.endPart()
+			h.parts++
+			h.left = h.partSize(h.parts)
+		}
+		k := int(min(h.left, int64(len(p))))
+		h.hash.Write(p[:k])
+		h.left -= int64(k)
+		p = p[k:]
+	}
+	return n, nil
+}
+
+// endPart adds the digest of the current part, if any, to the part digests.
+func (h *objectHash) endPart() {
+	if h.parts > 0 {
+		h.sums = h.hash.Sum(h.sums)
+		h.hash.Reset()
+	}
+}
+
+// Sum returns the checksum or ETag, without quotes. It must be called once,
+// after all data was written.
+func (h *objectHash) Sum() string {
+	if h.partSize == nil {
+		return h.encode(h.hash.Sum(nil))
+	}
+	h.endPart()
+	sum := h.newHash()
+	sum.Write(h.sums)
+	return fmt.Sprintf("%s-%d", h.encode(sum.Sum(nil)), h.parts)
+}
+
+// download writes the object to w for backends that read objects whole,
+// verifying its size.
+func download(ctx context.Context, b Backend, params *DownloadParams, w io.Writer) (int64, error) {
+	if params == nil {
+		return 0, errors.New("params cannot be nil")
+	}
+	if params.Key == "" {
+		return 0, errors.New("key is required")
+	}
+
+	obj, err := b.Stat(ctx, params.Key)
+	if err != nil {
+		return 0, err
+	}
+	if obj == nil {
+		return 0, fmt.Errorf("object %s not found: %w", params.Key, os.ErrNotExist)
+	}
+	body, err := b.Get(ctx, params.Key)
+	if err != nil {
+		return 0, err
+	}
+	defer body.Close()
+
+	written, err := io.Copy(w, &contextReader{ctx: ctx, r: body})
+	if err != nil {
+		return written, fmt.Errorf("failed to download %s: %w", obj.Key, err)
+	}
+	if written != obj.Size {
+		return written, fmt.Errorf("size mismatch for %s: expected %d, got %d", obj.Key, obj.Size, written)
+	}
+	return written, nil
+}
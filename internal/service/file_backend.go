@@ -0,0 +1,341 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/fidrasofyan/db-backup/internal/throttle"
+)
+
+// tempFileExt marks a file that is still being written. It is renamed to its
+// key once complete, so a key never holds a partial file. It differs from the
+// .partial extension of dumps in progress, so cleanup-uploads never deletes
+// them when the storage path overlaps local_dir.
+const tempFileExt = ".upload-tmp"
+
+// fileSystem is the part of a file system FileBackend needs. Names are slash
+// separated.
+type fileSystem interface {
+	Create(name string) (io.WriteCloser, error)
+	Open(name string) (io.ReadCloser, error)
+	Stat(name string) (os.FileInfo, error)
+	// Rename replaces newname if it exists
+	Rename(oldname, newname string) error
+	Remove(name string) error
+	MkdirAll(name string) error
+	// Walk calls fn for every file under root. A missing root has no files.
+	Walk(root string, fn func(name string, info os.FileInfo) error) error
+	Close() error
+}
+
+// FileBackend stores objects as files under a root directory, on the local
+// file system or on an SFTP server. Files are uploaded whole, the part size
+// and concurrency of uploads don't apply. Temporary files left behind by an
+// interrupted upload are reported by ListMultipartUploads.
+type FileBackend struct {
+	fs      fileSystem
+	root    string
+	limiter *throttle.Limiter
+}
+
+// name returns the file name of key.
+func (b *FileBackend) name(key string) string {
+	return path.Join(b.root, key)
+}
+
+// key returns the key of the file name.
+func (b *FileBackend) key(name string) string {
+	if b.root == "." {
+		return name
+	}
+	return strings.TrimPrefix(strings.TrimPrefix(name, b.root), "/")
+}
+
+// walk calls fn with the key of every file under prefix.
+func (b *FileBackend) walk(prefix string, fn func(key string, info os.FileInfo)) error {
+	// Only walk the directory the prefix is in
+	dir, _ := path.Split(prefix)
+	return b.fs.Walk(b.name(dir), func(name string, info os.FileInfo) error {
+		if key := b.key(name); strings.HasPrefix(key, prefix) {
+			fn(key, info)
+		}
+		return nil
+	})
+}
+
+// write stores everything read from r under key and returns its size.
+func (b *FileBackend) write(ctx context.Context, key string, r io.Reader) (int64, error) {
+	name := b.name(key)
+	if err := b.fs.MkdirAll(path.Dir(name)); err != nil {
+		return 0, fmt.Errorf("failed to create directory: %w", err)
+	}
+
+	tmp := name + tempFileExt
+	file, err := b.fs.Create(tmp)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create file: %w", err)
+	}
+	n, err := io.Copy(file, b.limiter.Reader(ctx, io.NopCloser(&contextReader{ctx: ctx, r: r})))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = b.fs.Rename(tmp, name)
+	}
+	if err != nil {
+		b.fs.Remove(tmp)
+		return 0, fmt.Errorf("failed to write %s: %w", key, err)
+	}
+	return n, nil
+}
+
+func (b *FileBackend) Put(ctx context.Context, key string, data []byte) error {
+	_, err := b.write(ctx, key, bytes.NewReader(data))
+	return err
+}
+
+func (b *FileBackend) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	file, err := b.fs.Open(b.name(key))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get object %s: %w", key, err)
+	}
+	return file, nil
+}
+
+func (b *FileBackend) Stat(ctx context.Context, key string) (*Object, error) {
+	info, err := b.fs.Stat(b.name(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return nil, nil
+	}
+	return &Object{
+		Key:          key,
+		Size:         info.Size(),
+		LastModified: info.ModTime(),
+	}, nil
+}
+
+func (b *FileBackend) List(ctx context.Context, prefix string) ([]Object, error) {
+	var objects []Object
+	err := b.walk(prefix, func(key string, info os.FileInfo) {
+		if strings.HasSuffix(key, tempFileExt) {
+			return
+		}
+		objects = append(objects, Object{
+			Key:          key,
+			Size:         info.Size(),
+			LastModified: info.ModTime(),
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list objects: %w", err)
+	}
+
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Key < objects[j].Key
+	})
+	return objects, nil
+}
+
+func (b *FileBackend) Remove(ctx context.Context, key string) error {
+	if err := b.fs.Remove(b.name(key)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (b *FileBackend) RemoveMany(ctx context.Context, keys []string) error {
+	var errs []error
+	for _, key := range keys {
+		if err := b.Remove(ctx, key); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", key, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (b *FileBackend) Upload(ctx context.Context, params *UploadParams) error {
+	if params == nil {
+		return errors.New("params cannot be nil")
+	}
+	if params.Key == "" || params.Filepath == "" {
+		return errors.New("key and filepath are required")
+	}
+
+	file, err := os.Open(params.Filepath)
+	if err != nil {
+		return fmt.Errorf("failed to open file: %v", err)
+	}
+	defer file.Close()
+
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to get file info: %v", err)
+	}
+	if fileInfo.Size() == 0 {
+		return ErrEmptyFile
+	}
+
+	_, err = b.write(ctx, params.Key, file)
+	return err
+}
+
+func (b *FileBackend) UploadStream(ctx context.Context, params *UploadStreamParams, r io.Reader) (int64, error) {
+	if params == nil {
+		return 0, errors.New("params cannot be nil")
+	}
+	if params.Key == "" {
+		return 0, errors.New("key is required")
+	}
+
+	// Don't create a file for an empty stream
+	br := bufio.NewReader(r)
+	if _, err := br.Peek(1); err == io.EOF {
+		return 0, ErrEmptyFile
+	}
+	return b.write(ctx, params.Key, br)
+}
+
+// Download reads the object whole; the part size and concurrency don't apply.
+func (b *FileBackend) Download(ctx context.Context, params *DownloadParams, w io.Writer) (int64, error) {
+	return download(ctx, b, params, w)
+}
+
+func (b *FileBackend) MatchesFile(ctx context.Context, obj *Object, path string, partSize int64, cacheFile string) (bool, error) {
+	return fileMatches(obj, path, cacheFile, nil)
+}
+
+func (b *FileBackend) ListMultipartUploads(ctx context.Context, prefix string) ([]MultipartUpload, error) {
+	var uploads []MultipartUpload
+	err := b.walk(prefix, func(key string, info os.FileInfo) {
+		if !strings.HasSuffix(key, tempFileExt) {
+			return
+		}
+		uploads = append(uploads, MultipartUpload{
+			Key:       strings.TrimSuffix(key, tempFileExt),
+			Initiated: info.ModTime(),
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list temporary files: %w", err)
+	}
+	return uploads, nil
+}
+
+func (b *FileBackend) AbortMultipartUpload(ctx context.Context, key, uploadID string) error {
+	if err := b.Remove(ctx, key+tempFileExt); err != nil {
+		return fmt.Errorf("failed to delete temporary file of %s: %w", key, err)
+	}
+	return nil
+}
+
+func (b *FileBackend) Close() error {
+	return b.fs.Close()
+}
+
+// contextReader stops reading once ctx is done.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+type NewLocalBackendParams struct {
+	// Path is the directory backups are stored in. It is created if missing.
+	Path string
+	// UploadRate limits the bandwidth of all uploads together. The zero
+	// Schedule is unlimited.
+	UploadRate throttle.Schedule
+}
+
+// NewLocalBackend returns a backend storing backups in a local directory,
+// e.g. a mounted NAS share.
+func NewLocalBackend(params *NewLocalBackendParams) (*FileBackend, error) {
+	if params == nil {
+		return nil, errors.New("params cannot be nil")
+	}
+	if params.Path == "" {
+		return nil, errors.New("path is required")
+	}
+	if err := os.MkdirAll(params.Path, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create %s: %w", params.Path, err)
+	}
+
+	return &FileBackend{
+		fs:      osFS{},
+		root:    path.Clean(filepath.ToSlash(params.Path)),
+		limiter: throttle.NewLimiter(params.UploadRate),
+	}, nil
+}
+
+// osFS is the local file system.
+type osFS struct{}
+
+func (osFS) Create(name string) (io.WriteCloser, error) {
+	return os.Create(filepath.FromSlash(name))
+}
+
+func (osFS) Open(name string) (io.ReadCloser, error) {
+	return os.Open(filepath.FromSlash(name))
+}
+
+func (osFS) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(filepath.FromSlash(name))
+}
+
+func (osFS) Rename(oldname, newname string) error {
+	return os.Rename(filepath.FromSlash(oldname), filepath.FromSlash(newname))
+}
+
+func (osFS) Remove(name string) error {
+	return os.Remove(filepath.FromSlash(name))
+}
+
+func (osFS) MkdirAll(name string) error {
+	return os.MkdirAll(filepath.FromSlash(name), 0755)
+}
+
+func (osFS) Walk(root string, fn func(name string, info os.FileInfo) error) error {
+	root = filepath.FromSlash(root)
+	return filepath.WalkDir(root, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if name == root && errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		return fn(filepath.ToSlash(name), info)
+	})
+}
+
+func (osFS) Close() error {
+	return nil
+}
@@ -0,0 +1,151 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryBackend keeps objects in memory. It is meant for tests of code
+// working with a Backend.
+type MemoryBackend struct {
+	mu      sync.Mutex
+	objects map[string]memoryObject
+}
+
+type memoryObject struct {
+	data     []byte
+	modified time.Time
+}
+
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{objects: map[string]memoryObject{}}
+}
+
+func (b *MemoryBackend) object(key string, obj memoryObject) Object {
+	checksum, _ := crc32cOf(bytes.NewReader(obj.data))
+	return Object{
+		Key:          key,
+		Size:         int64(len(obj.data)),
+		LastModified: obj.modified,
+		Checksum:     checksum,
+	}
+}
+
+func (b *MemoryBackend) Put(ctx context.Context, key string, data []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.objects[key] = memoryObject{data: bytes.Clone(data), modified: time.Now()}
+	return nil
+}
+
+func (b *MemoryBackend) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	obj, ok := b.objects[key]
+	if !ok {
+		return nil, fmt.Errorf("failed to get object %s: %w", key, os.ErrNotExist)
+	}
+	return io.NopCloser(bytes.NewReader(obj.data)), nil
+}
+
+func (b *MemoryBackend) Stat(ctx context.Context, key string) (*Object, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	obj, ok := b.objects[key]
+	if !ok {
+		return nil, nil
+	}
+	o := b.object(key, obj)
+	return &o, nil
+}
+
+func (b *MemoryBackend) List(ctx context.Context, prefix string) ([]Object, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var objects []Object
+	for key, obj := range b.objects {
+		if strings.HasPrefix(key, prefix) {
+			objects = append(objects, b.object(key, obj))
+		}
+	}
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Key < objects[j].Key
+	})
+	return objects, nil
+}
+
+func (b *MemoryBackend) Remove(ctx context.Context, key string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delete(b.objects, key)
+	return nil
+}
+
+func (b *MemoryBackend) RemoveMany(ctx context.Context, keys []string) error {
+	for _, key := range keys {
+		b.Remove(ctx, key)
+	}
+	return nil
+}
+
+func (b *MemoryBackend) Upload(ctx context.Context, params *UploadParams) error {
+	if params == nil {
+		return errors.New("params cannot be nil")
+	}
+	data, err := os.ReadFile(params.Filepath)
+	if err != nil {
+		return fmt.Errorf("failed to read file: %v", err)
+	}
+	if len(data) == 0 {
+		return ErrEmptyFile
+	}
+	return b.Put(ctx, params.Key, data)
+}
+
+func (b *MemoryBackend) UploadStream(ctx context.Context, params *UploadStreamParams, r io.Reader) (int64, error) {
+	if params == nil {
+		return 0, errors.New("params cannot be nil")
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read stream: %w", err)
+	}
+	if len(data) == 0 {
+		return 0, ErrEmptyFile
+	}
+	return int64(len(data)), b.Put(ctx, params.Key, data)
+}
+
+// Download reads the object whole; the part size and concurrency don't apply.
+func (b *MemoryBackend) Download(ctx context.Context, params *DownloadParams, w io.Writer) (int64, error) {
+	return download(ctx, b, params, w)
+}
+
+func (b *MemoryBackend) MatchesFile(ctx context.Context, obj *Object, path string, partSize int64, cacheFile string) (bool, error) {
+	return fileMatches(obj, path, cacheFile, nil)
+}
+
+func (b *MemoryBackend) ListMultipartUploads(ctx context.Context, prefix string) ([]MultipartUpload, error) {
+	return nil, nil
+}
+
+func (b *MemoryBackend) AbortMultipartUpload(ctx context.Context, key, uploadID string) error {
+	return nil
+}
+
+func (b *MemoryBackend) Close() error {
+	return nil
+}
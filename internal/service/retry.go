@@ -0,0 +1,32 @@
+package service
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsretry "github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/fidrasofyan/db-backup/internal/retry"
+)
+
+var retryables = awsretry.IsErrorRetryables(awsretry.DefaultRetryables)
+
+// do runs an S3 request with the storage's retry policy. Only errors the
+// SDK classifies as transient, such as throttling, 5xx responses and
+// connection errors, are retried. onRetry, if not nil, is called on every
+// retry. fn must rewind any request body it sends.
+func (s *Storage) do(ctx context.Context, op string, onRetry func(), fn func() error) error {
+	return s.retry.Do(ctx, func() error {
+		err := fn()
+		if err != nil && retryables.IsErrorRetryable(err) != aws.TrueTernary {
+			return retry.Permanent(err)
+		}
+		return err
+	}, func(attempt int, delay time.Duration, err error) {
+		log.Printf("retrying %s (attempt %d of %d) in %v: %v\n", op, attempt, s.retry.MaxAttempts, delay.Round(time.Millisecond), err)
+		if onRetry != nil {
+			onRetry()
+		}
+	})
+}
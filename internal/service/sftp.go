@@ -0,0 +1,260 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fidrasofyan/db-backup/internal/throttle"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+type NewSFTPBackendParams struct {
+	Host string
+	// Port defaults to 22
+	Port     string
+	User     string
+	Password string
+	// PrivateKeyFile is an unencrypted private key, used instead of or
+	// besides Password
+	PrivateKeyFile string
+	// KnownHostsFile verifies the server's host key. It defaults to
+	// ~/.ssh/known_hosts.
+	KnownHostsFile string
+	// Path is the directory backups are stored in, relative to the login
+	// directory unless absolute
+	Path string
+	// UploadRate limits the bandwidth of all uploads together. The zero
+	// Schedule is unlimited.
+	UploadRate throttle.Schedule
+}
+
+// NewSFTPBackend returns a backend storing backups on an SFTP server, e.g. a
+// NAS. It connects on first use and reconnects if the connection is lost.
+func NewSFTPBackend(params *NewSFTPBackendParams) (*FileBackend, error) {
+	// Validate parameters
+	if params == nil {
+		return nil, errors.New("params cannot be nil")
+	}
+	if params.Host == "" || params.User == "" {
+		return nil, errors.New("host and user are required")
+	}
+	if params.Password == "" && params.PrivateKeyFile == "" {
+		return nil, errors.New("password or private key file is required")
+	}
+	if params.Path == "" {
+		return nil, errors.New("path is required")
+	}
+	port := params.Port
+	if port == "" {
+		port = "22"
+	}
+
+	var auth []ssh.AuthMethod
+	if params.PrivateKeyFile != "" {
+		key, err := os.ReadFile(params.PrivateKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read private key: %v", err)
+		}
+		signer, err := ssh.ParsePrivateKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse private key: %v", err)
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if params.Password != "" {
+		auth = append(auth, ssh.Password(params.Password))
+	}
+
+	knownHostsFile := params.KnownHostsFile
+	if knownHostsFile == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, fmt.Errorf("failed to find known_hosts: %v", err)
+		}
+		knownHostsFile = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	hostKeyCallback, err := knownhosts.New(knownHostsFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load known hosts: %v", err)
+	}
+
+	return &FileBackend{
+		fs: &sftpFS{
+			addr: net.JoinHostPort(params.Host, port),
+			config: &ssh.ClientConfig{
+				User:            params.User,
+				Auth:            auth,
+				HostKeyCallback: hostKeyCallback,
+				Timeout:         30 * time.Second,
+			},
+		},
+		root:    path.Clean(params.Path),
+		limiter: throttle.NewLimiter(params.UploadRate),
+	}, nil
+}
+
+// sftpFS is the file system of an SFTP server.
+type sftpFS struct {
+	addr   string
+	config *ssh.ClientConfig
+
+	mu     sync.Mutex
+	conn   *ssh.Client
+	client *sftp.Client
+}
+
+// connect returns the SFTP client, connecting if needed.
+func (f *sftpFS) connect() (*sftp.Client, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.client != nil {
+		return f.client, nil
+	}
+	conn, err := ssh.Dial("tcp", f.addr, f.config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", f.addr, err)
+	}
+	client, err := sftp.NewClient(conn, sftp.UseConcurrentWrites(true))
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to start SFTP session on %s: %w", f.addr, err)
+	}
+	f.conn, f.client = conn, client
+	return client, nil
+}
+
+// disconnect closes the connection if it is still client's.
+func (f *sftpFS) disconnect(client *sftp.Client) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.client != client || client == nil {
+		return
+	}
+	f.client.Close()
+	f.conn.Close()
+	f.conn, f.client = nil, nil
+}
+
+// do runs fn with a connected client. If the connection was lost, e.g. after
+// idling between daemon runs, it reconnects and runs fn once more.
+func (f *sftpFS) do(fn func(client *sftp.Client) error) error {
+	client, err := f.connect()
+	if err != nil {
+		return err
+	}
+	err = fn(client)
+	if !errors.Is(err, sftp.ErrSSHFxConnectionLost) {
+		return err
+	}
+
+	f.disconnect(client)
+	client, err = f.connect()
+	if err != nil {
+		return err
+	}
+	return fn(client)
+}
+
+func (f *sftpFS) Create(name string) (file io.WriteCloser, err error) {
+	err = f.do(func(client *sftp.Client) (err error) {
+		file, err = client.Create(name)
+		return err
+	})
+	return file, err
+}
+
+func (f *sftpFS) Open(name string) (file io.ReadCloser, err error) {
+	err = f.do(func(client *sftp.Client) (err error) {
+		file, err = client.Open(name)
+		return err
+	})
+	return file, err
+}
+
+func (f *sftpFS) Stat(name string) (info os.FileInfo, err error) {
+	err = f.do(func(client *sftp.Client) (err error) {
+		info, err = client.Stat(name)
+		return err
+	})
+	return info, err
+}
+
+func (f *sftpFS) Rename(oldname, newname string) error {
+	return f.do(func(client *sftp.Client) error {
+		if _, ok := client.HasExtension("posix-rename@openssh.com"); ok {
+			return client.PosixRename(oldname, newname)
+		}
+		// Plain SFTP rename fails if newname exists
+		if err := client.Remove(newname); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return client.Rename(oldname, newname)
+	})
+}
+
+func (f *sftpFS) Remove(name string) error {
+	return f.do(func(client *sftp.Client) error {
+		return client.Remove(name)
+	})
+}
+
+func (f *sftpFS) MkdirAll(name string) error {
+	return f.do(func(client *sftp.Client) error {
+		return client.MkdirAll(name)
+	})
+}
+
+func (f *sftpFS) Walk(root string, fn func(name string, info os.FileInfo) error) error {
+	// Collect the files first, so fn isn't called twice if do runs again
+	type file struct {
+		name string
+		info os.FileInfo
+	}
+	var files []file
+	err := f.do(func(client *sftp.Client) error {
+		files = nil
+		walker := client.Walk(root)
+		for walker.Step() {
+			if err := walker.Err(); err != nil {
+				if walker.Path() == root && errors.Is(err, os.ErrNotExist) {
+					return nil
+				}
+				return err
+			}
+			if !walker.Stat().IsDir() {
+				files = append(files, file{name: walker.Path(), info: walker.Stat()})
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range files {
+		if err := fn(entry.name, entry.info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *sftpFS) Close() error {
+	f.mu.Lock()
+	client := f.client
+	f.mu.Unlock()
+
+	f.disconnect(client)
+	return nil
+}
@@ -1,12 +1,15 @@
 package service
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
 	"io"
 	"log"
 	"os"
+	"sort"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
@@ -14,6 +17,9 @@ import (
 	"github.com/aws/aws-sdk-go-v2/credentials"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	"github.com/fidrasofyan/db-backup/internal/retry"
+	"github.com/fidrasofyan/db-backup/internal/throttle"
 	"golang.org/x/sync/errgroup"
 )
 
@@ -21,45 +27,268 @@ var (
 	ErrEmptyFile = errors.New("empty file")
 )
 
+// checksumAlgorithm is the checksum sent with every upload, see checksum.go
+const checksumAlgorithm = types.ChecksumAlgorithmCrc32c
+
+// S3 multipart upload limits
+const (
+	MaxParts    = 10000
+	MinPartSize = 5 * 1024 * 1024
+	MaxPartSize = 5 * 1024 * 1024 * 1024
+)
+
+// partSize returns the smallest part size of at least size that uploads
+// totalSize in MaxParts parts, rounded up to a whole MiB.
+func partSize(totalSize, size int64) int64 {
+	const mib = 1024 * 1024
+	minSize := (totalSize + MaxParts - 1) / MaxParts
+	minSize = (minSize + mib - 1) / mib * mib
+	return max(size, minSize)
+}
+
+// streamPartSize returns the size of part partNumber of a stream of unknown
+// size. The size doubles every MaxParts/10 parts, so streams of a few
+// terabytes still fit in MaxParts parts while small ones use small parts.
+func streamPartSize(partNumber int32, size int64) int64 {
+	for n := int32(MaxParts / 10); n < partNumber && size < MaxPartSize; n += MaxParts / 10 {
+		size *= 2
+	}
+	return min(size, MaxPartSize)
+}
+
+// Storage is the S3 backend. It stores backups in one bucket.
 type Storage struct {
 	client *s3.Client
+	bucket string
+	retry  retry.Policy
 }
 
-func (s *Storage) IsFileExists(ctx context.Context, bucket, key string) (*bool, error) {
-	res, err := s.client.HeadObject(ctx, &s3.HeadObjectInput{
-		Bucket: aws.String(bucket),
-		Key:    aws.String(key),
+func (s *Storage) Remove(ctx context.Context, key string) error {
+	err := s.do(ctx, "delete "+key, nil, func() error {
+		_, err := s.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+			Bucket: aws.String(s.bucket),
+			Key:    aws.String(key),
+		})
+		return err
 	})
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// RemoveMany deletes keys in batches of up to 1000, the DeleteObjects limit.
+// Keys that failed to delete are reported in the returned error.
+func (s *Storage) RemoveMany(ctx context.Context, keys []string) error {
+	const batchSize = 1000
+
+	var errs []error
+	for start := 0; start < len(keys); start += batchSize {
+		end := min(start+batchSize, len(keys))
+
+		objects := make([]types.ObjectIdentifier, 0, end-start)
+		for _, key := range keys[start:end] {
+			objects = append(objects, types.ObjectIdentifier{Key: aws.String(key)})
+		}
+
+		var res *s3.DeleteObjectsOutput
+		err := s.do(ctx, "delete objects", nil, func() (err error) {
+			res, err = s.client.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+				Bucket: aws.String(s.bucket),
+				Delete: &types.Delete{
+					Objects: objects,
+					Quiet:   aws.Bool(true),
+				},
+			})
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("failed to delete objects: %w", err)
+		}
+		for _, e := range res.Errors {
+			errs = append(errs, fmt.Errorf("%s: %s", aws.ToString(e.Key), aws.ToString(e.Message)))
+		}
+	}
 
-	var nfe *types.NotFound
-	if err != nil && !errors.As(err, &nfe) {
+	return errors.Join(errs...)
+}
+
+type Object struct {
+	Key          string
+	Size         int64
+	ETag         string
+	LastModified time.Time
+	// Checksum is the CRC32C checksum reported by Stat, empty if the object
+	// has none
+	Checksum string
+	// SSE is set by Stat if S3 encrypts the object with KMS or a customer
+	// key. Its ETag isn't an MD5 digest of its data then.
+	SSE bool
+}
+
+// Stat returns the object's metadata, or nil if it doesn't exist.
+func (s *Storage) Stat(ctx context.Context, key string) (*Object, error) {
+	var res *s3.HeadObjectOutput
+	err := s.do(ctx, "head "+key, nil, func() (err error) {
+		res, err = s.client.HeadObject(ctx, &s3.HeadObjectInput{
+			Bucket:       aws.String(s.bucket),
+			Key:          aws.String(key),
+			ChecksumMode: types.ChecksumModeEnabled,
+		})
+		return err
+	})
+	if err != nil {
+		var nfe *types.NotFound
+		if errors.As(err, &nfe) {
+			return nil, nil
+		}
 		return nil, err
 	}
 
-	if res != nil && res.ETag != nil {
-		return aws.Bool(true), nil
+	return &Object{
+		Key:          key,
+		Size:         aws.ToInt64(res.ContentLength),
+		ETag:         aws.ToString(res.ETag),
+		LastModified: aws.ToTime(res.LastModified),
+		Checksum:     aws.ToString(res.ChecksumCRC32C),
+		SSE: res.ServerSideEncryption == types.ServerSideEncryptionAwsKms ||
+			res.ServerSideEncryption == types.ServerSideEncryptionAwsKmsDsse ||
+			aws.ToString(res.SSECustomerAlgorithm) != "",
+	}, nil
+}
+
+// MatchesFile reports whether obj, as returned by Stat, has the size and
+// content of the local file at path, uploaded by Upload with uploadPartSize.
+func (s *Storage) MatchesFile(ctx context.Context, obj *Object, path string, uploadPartSize int64, cacheFile string) (bool, error) {
+	return fileMatches(obj, path, cacheFile, func(parts int) (partLayout, bool, error) {
+		// The checksum of a multipart object depends on its part sizes, try
+		// the ones Upload would use before asking S3
+		if uploadPartSize <= 0 {
+			uploadPartSize = MinPartSize
+		}
+		return s.detectLayout(ctx, obj, parts, partSize(obj.Size, uploadPartSize))
+	})
+}
+
+// List returns every object under prefix, following pagination until the
+// listing is exhausted.
+func (s *Storage) List(ctx context.Context, prefix string) ([]Object, error) {
+	paginator := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(prefix),
+	})
+
+	var objects []Object
+	for paginator.HasMorePages() {
+		var page *s3.ListObjectsV2Output
+		err := s.do(ctx, "list "+prefix, nil, func() (err error) {
+			page, err = paginator.NextPage(ctx)
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to list objects: %w", err)
+		}
+		for _, obj := range page.Contents {
+			objects = append(objects, Object{
+				Key:          aws.ToString(obj.Key),
+				Size:         aws.ToInt64(obj.Size),
+				ETag:         aws.ToString(obj.ETag),
+				LastModified: aws.ToTime(obj.LastModified),
+			})
+		}
 	}
 
-	return aws.Bool(false), nil
+	return objects, nil
+}
+
+type MultipartUpload struct {
+	Key       string
+	UploadID  string
+	Initiated time.Time
 }
 
-func (s *Storage) Remove(ctx context.Context, bucket, key string) error {
-	_, err := s.client.DeleteObject(ctx, &s3.DeleteObjectInput{
-		Bucket: aws.String(bucket),
-		Key:    aws.String(key),
+// ListMultipartUploads returns the incomplete multipart uploads under prefix.
+func (s *Storage) ListMultipartUploads(ctx context.Context, prefix string) ([]MultipartUpload, error) {
+	paginator := s3.NewListMultipartUploadsPaginator(s.client, &s3.ListMultipartUploadsInput{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(prefix),
 	})
-	if err != nil {
+
+	var uploads []MultipartUpload
+	for paginator.HasMorePages() {
+		var page *s3.ListMultipartUploadsOutput
+		err := s.do(ctx, "list uploads "+prefix, nil, func() (err error) {
+			page, err = paginator.NextPage(ctx)
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to list multipart uploads: %w", err)
+		}
+		for _, upload := range page.Uploads {
+			uploads = append(uploads, MultipartUpload{
+				Key:       aws.ToString(upload.Key),
+				UploadID:  aws.ToString(upload.UploadId),
+				Initiated: aws.ToTime(upload.Initiated),
+			})
+		}
+	}
+
+	return uploads, nil
+}
+
+// AbortMultipartUpload aborts an incomplete multipart upload and frees its
+// parts.
+func (s *Storage) AbortMultipartUpload(ctx context.Context, key, uploadID string) error {
+	err := s.do(ctx, "abort upload "+key, nil, func() error {
+		_, err := s.client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+			Bucket:   aws.String(s.bucket),
+			Key:      aws.String(key),
+			UploadId: aws.String(uploadID),
+		})
 		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to abort multipart upload of %s: %w", key, err)
 	}
 	return nil
 }
 
+// Get opens the object for reading. The caller must close the returned body.
+func (s *Storage) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	var res *s3.GetObjectOutput
+	err := s.do(ctx, "get "+key, nil, func() (err error) {
+		res, err = s.client.GetObject(ctx, &s3.GetObjectInput{
+			Bucket: aws.String(s.bucket),
+			Key:    aws.String(key),
+		})
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get object %s: %w", key, err)
+	}
+	return res.Body, nil
+}
+
+// Put uploads data as a single object, e.g. a snapshot chunk.
+func (s *Storage) Put(ctx context.Context, key string, data []byte) error {
+	_, err := s.singlePartUpload(ctx, key, bytes.NewReader(data), nil)
+	return err
+}
+
 type UploadParams struct {
 	PartSize    int64
 	Concurrency int
-	Bucket      string
 	Key         string
 	Filepath    string
+	// StateFile, if set, is where the progress of a multipart upload is
+	// saved. A failed upload is then kept instead of aborted, and the next
+	// call with the same StateFile only uploads the missing parts.
+	StateFile string
+	// ChecksumCache, if set, is the cache file of the checksums of Filepath
+	// used by MatchesFile. The checksum of the upload is added to it.
+	ChecksumCache string
+	// OnRetry, if set, is called on every retried request
+	OnRetry func()
 }
 
 func (s *Storage) Upload(ctx context.Context, params *UploadParams) error {
@@ -67,14 +296,14 @@ func (s *Storage) Upload(ctx context.Context, params *UploadParams) error {
 	if params == nil {
 		return errors.New("params cannot be nil")
 	}
-	if params.Bucket == "" || params.Key == "" || params.Filepath == "" {
-		return errors.New("bucket, key, and filepath are required")
+	if params.Key == "" || params.Filepath == "" {
+		return errors.New("key and filepath are required")
 	}
 	if params.Concurrency <= 0 {
 		params.Concurrency = 1
 	}
 	if params.PartSize <= 0 {
-		params.PartSize = 5 * 1024 * 1024 // Default 5MB
+		params.PartSize = MinPartSize
 	}
 
 	// Open file
@@ -94,23 +323,48 @@ func (s *Storage) Upload(ctx context.Context, params *UploadParams) error {
 		return ErrEmptyFile
 	}
 
+	// Grow the parts of big files to stay within the part count limit
+	params.PartSize = partSize(totalSize, params.PartSize)
+	if params.PartSize > MaxPartSize {
+		return fmt.Errorf("file is too big to upload: %d bytes", totalSize)
+	}
+
 	// For small file, use single part
 	if totalSize <= params.PartSize {
-		return s.singlePartUpload(ctx, params.Bucket, params.Key, file)
+		checksum, err := s.singlePartUpload(ctx, params.Key, file, params.OnRetry)
+		if err != nil {
+			return err
+		}
+		loadChecksumCache(params.ChecksumCache, fileInfo).set(partLayout{}, checksum)
+		return nil
 	}
 
-	// Initialize multipart upload
-	initResp, err := s.client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
-		Bucket: aws.String(params.Bucket),
-		Key:    aws.String(params.Key),
-	})
+	// Resume the upload recorded in the state file, or start a new one
+	state, err := s.resumeUpload(ctx, params, fileInfo)
 	if err != nil {
-		return fmt.Errorf("failed to initiate multipart upload: %v", err)
+		return err
+	}
+	if state == nil || state.UploadID == "" {
+		initResp, err := s.createMultipartUpload(ctx, params.Key, params.OnRetry)
+		if err != nil {
+			return fmt.Errorf("failed to initiate multipart upload: %v", err)
+		}
+		if state == nil {
+			state = &uploadState{}
+		}
+		state.UploadID = aws.ToString(initResp.UploadId)
+		if params.StateFile != "" {
+			if err := state.save(); err != nil {
+				log.Printf("Warning: %v\n", err)
+			}
+		}
 	}
+	uploadID := aws.String(state.UploadID)
 
 	// Calculate parts
 	totalParts := int((totalSize + params.PartSize - 1) / params.PartSize)
 	completedParts := make([]types.CompletedPart, totalParts)
+	partChecksums := make([]string, totalParts)
 
 	// Upload parts concurrently
 	g, gCtx := errgroup.WithContext(ctx)
@@ -133,22 +387,39 @@ func (s *Storage) Upload(ctx context.Context, params *UploadParams) error {
 			default:
 			}
 
-			sectionReader := io.NewSectionReader(file, offset, currentPartSize)
+			body := io.NewSectionReader(file, offset, currentPartSize)
+			checksum, err := crc32cOf(body)
+			if err != nil {
+				return fmt.Errorf("failed to read part %d: %w", partNumber, err)
+			}
+			partChecksums[partNumber-1] = checksum
+
+			// Skip parts uploaded by an earlier attempt, unless S3 got
+			// other content for them
+			if etag, uploaded, ok := state.part(partNumber); ok && (uploaded == checksum || uploaded == "") {
+				completedParts[partNumber-1] = types.CompletedPart{
+					ETag:           aws.String(etag),
+					PartNumber:     aws.Int32(partNumber),
+					ChecksumCRC32C: aws.String(checksum),
+				}
+				return nil
+			}
 
-			resp, err := s.client.UploadPart(ctx, &s3.UploadPartInput{
-				Bucket:     aws.String(params.Bucket),
+			part, err := s.uploadPart(ctx, &s3.UploadPartInput{
+				Bucket:     aws.String(s.bucket),
 				Key:        aws.String(params.Key),
-				UploadId:   initResp.UploadId,
+				UploadId:   uploadID,
 				PartNumber: aws.Int32(partNumber),
-				Body:       sectionReader,
-			})
+			}, body, checksum, params.OnRetry)
 			if err != nil {
 				return fmt.Errorf("failed to upload part %d: %w", partNumber, err)
 			}
 
-			completedParts[partNumber-1] = types.CompletedPart{
-				ETag:       resp.ETag,
-				PartNumber: aws.Int32(partNumber),
+			completedParts[partNumber-1] = part
+			if params.StateFile != "" {
+				if err := state.setPart(partNumber, aws.ToString(part.ETag)); err != nil {
+					log.Printf("Warning: %v\n", err)
+				}
 			}
 			return nil
 		})
@@ -156,52 +427,355 @@ func (s *Storage) Upload(ctx context.Context, params *UploadParams) error {
 
 	// Wait for all uploads or first error
 	if err := g.Wait(); err != nil {
-		// Abort multipart upload
-		s.abortMultipartUpload(params.Bucket, params.Key, initResp.UploadId)
+		// Keep a resumable upload for the next attempt
+		if params.StateFile == "" {
+			s.abortMultipartUpload(params.Key, uploadID)
+		}
 		return fmt.Errorf("multipart upload failed: %v", err)
 	}
 
 	// Complete multipart upload
-	_, err = s.client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
-		Bucket:   aws.String(params.Bucket),
+	res, err := s.completeMultipartUpload(ctx, params.Key, uploadID, completedParts, params.OnRetry)
+	if err != nil {
+		// Try to abort the upload if completion fails
+		s.abortMultipartUpload(params.Key, uploadID)
+		if params.StateFile != "" {
+			if err := state.remove(); err != nil {
+				log.Printf("Warning: %v\n", err)
+			}
+		}
+		return fmt.Errorf("failed to complete multipart upload: %v", err)
+	}
+
+	if params.StateFile != "" {
+		if err := state.remove(); err != nil {
+			log.Printf("Warning: %v\n", err)
+		}
+	}
+	checksum := compositeChecksum(partChecksums)
+	if err := s.verifyUpload(ctx, params.Key, checksum, res.ChecksumCRC32C); err != nil {
+		return err
+	}
+	loadChecksumCache(params.ChecksumCache, fileInfo).set(partLayout{size: params.PartSize}, checksum)
+	return nil
+}
+
+// resumeUpload returns the state of the upload to continue. Without a state
+// file, it returns nil. Otherwise it returns the saved state with the parts
+// confirmed by ListParts, or a fresh state when there is nothing to resume.
+func (s *Storage) resumeUpload(ctx context.Context, params *UploadParams, info os.FileInfo) (*uploadState, error) {
+	if params.StateFile == "" {
+		return nil, nil
+	}
+
+	fresh := &uploadState{
+		Bucket:   s.bucket,
+		Key:      params.Key,
+		Size:     info.Size(),
+		ModTime:  info.ModTime(),
+		PartSize: params.PartSize,
+		Checksum: checksumAlgorithm,
+		Parts:    map[int32]string{},
+		path:     params.StateFile,
+	}
+
+	state, err := loadUploadState(params.StateFile)
+	if err != nil {
+		log.Printf("Warning: %v\n", err)
+		return fresh, nil
+	}
+	if state == nil {
+		return fresh, nil
+	}
+	if !state.matches(s.bucket, params, info) {
+		// The file or the settings changed since, the old parts are useless
+		if state.UploadID != "" && state.Bucket == s.bucket && state.Key == params.Key {
+			s.abortMultipartUpload(state.Key, aws.String(state.UploadID))
+		}
+		return fresh, nil
+	}
+
+	// Only trust parts that the saved state and S3 agree on
+	paginator := s3.NewListPartsPaginator(s.client, &s3.ListPartsInput{
+		Bucket:   aws.String(s.bucket),
 		Key:      aws.String(params.Key),
-		UploadId: initResp.UploadId,
-		MultipartUpload: &types.CompletedMultipartUpload{
-			Parts: completedParts,
-		},
+		UploadId: aws.String(state.UploadID),
 	})
+	uploaded := map[int32]string{}
+	checksums := map[int32]string{}
+	sizes := map[int32]int64{}
+	for paginator.HasMorePages() {
+		var page *s3.ListPartsOutput
+		err := s.do(ctx, "list parts "+params.Key, params.OnRetry, func() (err error) {
+			page, err = paginator.NextPage(ctx)
+			return err
+		})
+		if err != nil {
+			var apiErr smithy.APIError
+			if errors.As(err, &apiErr) && apiErr.ErrorCode() == "NoSuchUpload" {
+				// Completed or aborted in the meantime
+				return fresh, nil
+			}
+			return nil, fmt.Errorf("failed to list uploaded parts: %w", err)
+		}
+		for _, part := range page.Parts {
+			uploaded[aws.ToInt32(part.PartNumber)] = aws.ToString(part.ETag)
+			checksums[aws.ToInt32(part.PartNumber)] = aws.ToString(part.ChecksumCRC32C)
+			sizes[aws.ToInt32(part.PartNumber)] = aws.ToInt64(part.Size)
+		}
+	}
+
+	fresh.UploadID = state.UploadID
+	fresh.checksums = map[int32]string{}
+	for partNumber, etag := range state.Parts {
+		if uploaded[partNumber] != etag {
+			continue
+		}
+		// Some S3 compatible services don't report part checksums. The
+		// saved ETag and the part size must do then.
+		if checksums[partNumber] == "" {
+			offset := int64(partNumber-1) * params.PartSize
+			if sizes[partNumber] != min(params.PartSize, info.Size()-offset) {
+				continue
+			}
+		}
+		fresh.Parts[partNumber] = etag
+		fresh.checksums[partNumber] = checksums[partNumber]
+	}
+	log.Printf("resuming upload of %s: %d parts already uploaded\n", params.Key, len(fresh.Parts))
+	return fresh, nil
+}
+
+type UploadStreamParams struct {
+	PartSize    int64
+	Concurrency int
+	Key         string
+	// OnRetry, if set, is called on every retried request
+	OnRetry func()
+}
 
+// UploadStream uploads everything read from r without knowing its size in
+// advance. At most Concurrency+1 parts are buffered in memory at once. Parts
+// grow as the stream gets longer, see streamPartSize. It returns the number
+// of bytes uploaded.
+func (s *Storage) UploadStream(ctx context.Context, params *UploadStreamParams, r io.Reader) (int64, error) {
+	// Validate parameters
+	if params == nil {
+		return 0, errors.New("params cannot be nil")
+	}
+	if params.Key == "" {
+		return 0, errors.New("key is required")
+	}
+	if params.Concurrency <= 0 {
+		params.Concurrency = 1
+	}
+	if params.PartSize <= 0 {
+		params.PartSize = MinPartSize
+	}
+
+	// Read the first part to decide between single and multipart upload
+	buf := make([]byte, params.PartSize)
+	n, err := io.ReadFull(r, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		if n == 0 {
+			return 0, ErrEmptyFile
+		}
+		if _, err := s.singlePartUpload(ctx, params.Key, bytes.NewReader(buf[:n]), params.OnRetry); err != nil {
+			return 0, err
+		}
+		return int64(n), nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to read stream: %w", err)
+	}
+
+	// Initialize multipart upload
+	initResp, err := s.createMultipartUpload(ctx, params.Key, params.OnRetry)
+	if err != nil {
+		return 0, fmt.Errorf("failed to initiate multipart upload: %v", err)
+	}
+
+	// Upload parts concurrently while reading the next ones
+	g, gCtx := errgroup.WithContext(ctx)
+	g.SetLimit(params.Concurrency)
+
+	var (
+		mu             sync.Mutex
+		completedParts []types.CompletedPart
+		totalSize      int64
+		readErr        error
+	)
+
+	for partNumber := int32(1); ; partNumber++ {
+		part := buf[:n]
+		totalSize += int64(n)
+
+		g.Go(func() error {
+			checksum, err := crc32cOf(bytes.NewReader(part))
+			if err != nil {
+				return err
+			}
+			completedPart, err := s.uploadPart(gCtx, &s3.UploadPartInput{
+				Bucket:     aws.String(s.bucket),
+				Key:        aws.String(params.Key),
+				UploadId:   initResp.UploadId,
+				PartNumber: aws.Int32(partNumber),
+			}, bytes.NewReader(part), checksum, params.OnRetry)
+			if err != nil {
+				return fmt.Errorf("failed to upload part %d: %w", partNumber, err)
+			}
+
+			mu.Lock()
+			completedParts = append(completedParts, completedPart)
+			mu.Unlock()
+			return nil
+		})
+
+		if gCtx.Err() != nil {
+			break
+		}
+
+		// Read next part
+		buf = make([]byte, streamPartSize(partNumber+1, params.PartSize))
+		n, err = io.ReadFull(r, buf)
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			readErr = fmt.Errorf("failed to read stream: %w", err)
+			break
+		}
+		if partNumber == MaxParts {
+			readErr = errors.New("stream is too big to upload")
+			break
+		}
+	}
+
+	// Wait for all uploads or first error
+	if err := g.Wait(); err != nil || readErr != nil {
+		// Abort multipart upload
+		s.abortMultipartUpload(params.Key, initResp.UploadId)
+		if readErr != nil {
+			return 0, readErr
+		}
+		return 0, fmt.Errorf("multipart upload failed: %v", err)
+	}
+
+	// Parts must be listed in ascending order
+	sort.Slice(completedParts, func(i, j int) bool {
+		return *completedParts[i].PartNumber < *completedParts[j].PartNumber
+	})
+
+	// Complete multipart upload
+	res, err := s.completeMultipartUpload(ctx, params.Key, initResp.UploadId, completedParts, params.OnRetry)
 	if err != nil {
 		// Try to abort the upload if completion fails
-		s.abortMultipartUpload(params.Bucket, params.Key, initResp.UploadId)
-		return fmt.Errorf("failed to complete multipart upload: %v", err)
+		s.abortMultipartUpload(params.Key, initResp.UploadId)
+		return 0, fmt.Errorf("failed to complete multipart upload: %v", err)
 	}
 
-	return nil
+	partChecksums := make([]string, len(completedParts))
+	for i, part := range completedParts {
+		partChecksums[i] = aws.ToString(part.ChecksumCRC32C)
+	}
+	if err := s.verifyUpload(ctx, params.Key, compositeChecksum(partChecksums), res.ChecksumCRC32C); err != nil {
+		return 0, err
+	}
+	return totalSize, nil
 }
 
-func (s *Storage) singlePartUpload(ctx context.Context, bucket, key string, file *os.File) error {
+// singlePartUpload uploads file as a single part and returns its checksum.
+func (s *Storage) singlePartUpload(ctx context.Context, key string, file io.ReadSeeker, onRetry func()) (string, error) {
 	if _, err := file.Seek(0, io.SeekStart); err != nil {
-		return fmt.Errorf("failed to seek to beginning of file: %w", err)
+		return "", fmt.Errorf("failed to seek to beginning of file: %w", err)
+	}
+	checksum, err := crc32cOf(file)
+	if err != nil {
+		return "", err
+	}
+
+	var res *s3.PutObjectOutput
+	err = s.do(ctx, "put "+key, onRetry, func() (err error) {
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return retry.Permanent(fmt.Errorf("failed to seek to beginning of file: %w", err))
+		}
+
+		res, err = s.client.PutObject(ctx, &s3.PutObjectInput{
+			Bucket:            aws.String(s.bucket),
+			Key:               aws.String(key),
+			Body:              file,
+			ChecksumAlgorithm: checksumAlgorithm,
+			ChecksumCRC32C:    aws.String(checksum),
+		})
+		return err
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to upload file: %w", err)
 	}
+	return checksum, s.verifyUpload(ctx, key, checksum, res.ChecksumCRC32C)
+}
 
-	_, err := s.client.PutObject(ctx, &s3.PutObjectInput{
-		Bucket: aws.String(bucket),
-		Key:    aws.String(key),
-		Body:   file,
+func (s *Storage) createMultipartUpload(ctx context.Context, key string, onRetry func()) (*s3.CreateMultipartUploadOutput, error) {
+	var res *s3.CreateMultipartUploadOutput
+	err := s.do(ctx, "create upload "+key, onRetry, func() (err error) {
+		res, err = s.client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+			Bucket:            aws.String(s.bucket),
+			Key:               aws.String(key),
+			ChecksumAlgorithm: checksumAlgorithm,
+		})
+		return err
+	})
+	return res, err
+}
+
+// uploadPart uploads body, whose CRC32C is checksum, as the part described
+// by input, rewinding body before every attempt.
+func (s *Storage) uploadPart(ctx context.Context, input *s3.UploadPartInput, body io.ReadSeeker, checksum string, onRetry func()) (types.CompletedPart, error) {
+	op := fmt.Sprintf("upload part %d of %s", aws.ToInt32(input.PartNumber), aws.ToString(input.Key))
+	input.ChecksumAlgorithm = checksumAlgorithm
+	input.ChecksumCRC32C = aws.String(checksum)
+
+	var res *s3.UploadPartOutput
+	err := s.do(ctx, op, onRetry, func() (err error) {
+		if _, err := body.Seek(0, io.SeekStart); err != nil {
+			return retry.Permanent(err)
+		}
+		input.Body = body
+		res, err = s.client.UploadPart(ctx, input)
+		return err
 	})
 	if err != nil {
-		return fmt.Errorf("failed to upload file: %w", err)
+		return types.CompletedPart{}, err
 	}
-	return nil
+	return types.CompletedPart{
+		ETag:           res.ETag,
+		PartNumber:     input.PartNumber,
+		ChecksumCRC32C: aws.String(checksum),
+	}, nil
 }
 
-func (s *Storage) abortMultipartUpload(bucket, key string, uploadId *string) {
+func (s *Storage) completeMultipartUpload(ctx context.Context, key string, uploadID *string, parts []types.CompletedPart, onRetry func()) (*s3.CompleteMultipartUploadOutput, error) {
+	var res *s3.CompleteMultipartUploadOutput
+	err := s.do(ctx, "complete upload "+key, onRetry, func() (err error) {
+		res, err = s.client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+			Bucket:   aws.String(s.bucket),
+			Key:      aws.String(key),
+			UploadId: uploadID,
+			MultipartUpload: &types.CompletedMultipartUpload{
+				Parts: parts,
+			},
+		})
+		return err
+	})
+	return res, err
+}
+
+func (s *Storage) abortMultipartUpload(key string, uploadId *string) {
 	abortCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
 	_, err := s.client.AbortMultipartUpload(abortCtx, &s3.AbortMultipartUploadInput{
-		Bucket:   aws.String(bucket),
+		Bucket:   aws.String(s.bucket),
 		Key:      aws.String(key),
 		UploadId: uploadId,
 	})
@@ -210,11 +784,22 @@ func (s *Storage) abortMultipartUpload(bucket, key string, uploadId *string) {
 	}
 }
 
+// Close does nothing, the S3 client needs no cleanup.
+func (s *Storage) Close() error {
+	return nil
+}
+
 type NewStorageParams struct {
 	AWSEndpoint        string
 	AWSRegion          string
 	AWSAccessKeyID     string
 	AWSSecretAccessKey string
+	Bucket             string
+	// Retry is applied to every request. The zero Policy tries once.
+	Retry retry.Policy
+	// UploadRate limits the bandwidth of all uploads together. The zero
+	// Schedule is unlimited.
+	UploadRate throttle.Schedule
 }
 
 func NewStorage(ctx context.Context, params *NewStorageParams) (*Storage, error) {
@@ -231,6 +816,9 @@ func NewStorage(ctx context.Context, params *NewStorageParams) (*Storage, error)
 	if params.AWSAccessKeyID == "" || params.AWSSecretAccessKey == "" {
 		return nil, errors.New("AWS credentials are required")
 	}
+	if params.Bucket == "" {
+		return nil, errors.New("bucket is required")
+	}
 
 	// Load AWS config
 	cfg, err := config.LoadDefaultConfig(
@@ -249,12 +837,19 @@ func NewStorage(ctx context.Context, params *NewStorageParams) (*Storage, error)
 		return nil, fmt.Errorf("failed to load AWS config: %v", err)
 	}
 
-	// Create S3 client
+	// Create S3 client. Retries are done by Storage, so they can be
+	// configured, logged and counted.
 	s3Client := s3.NewFromConfig(cfg, func(o *s3.Options) {
 		o.UsePathStyle = true
+		o.Retryer = aws.NopRetryer{}
+		if limiter := throttle.NewLimiter(params.UploadRate); limiter != nil {
+			o.HTTPClient = &throttledClient{client: o.HTTPClient, limiter: limiter}
+		}
 	})
 
 	return &Storage{
 		client: s3Client,
+		bucket: params.Bucket,
+		retry:  params.Retry,
 	}, nil
 }
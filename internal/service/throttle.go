@@ -0,0 +1,24 @@
+package service
+
+import (
+	"net/http"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/fidrasofyan/db-backup/internal/throttle"
+)
+
+// throttledClient limits the bandwidth of request bodies, so every upload of
+// a Storage shares one budget no matter how many parts run concurrently.
+// Throttling the wire instead of the body readers keeps payload hashing
+// done by the SDK from counting against the limit.
+type throttledClient struct {
+	client  aws.HTTPClient
+	limiter *throttle.Limiter
+}
+
+func (c *throttledClient) Do(req *http.Request) (*http.Response, error) {
+	if req.Body != nil && req.Body != http.NoBody {
+		req.Body = c.limiter.Reader(req.Context(), req.Body)
+	}
+	return c.client.Do(req)
+}
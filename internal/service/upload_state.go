@@ -0,0 +1,108 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// uploadState is the progress of a multipart upload. It is persisted in a
+// small JSON file next to the uploaded file, so an upload interrupted by a
+// failure or a killed process can be resumed instead of started over.
+type uploadState struct {
+	Bucket   string    `json:"bucket"`
+	Key      string    `json:"key"`
+	UploadID string    `json:"upload_id"`
+	Size     int64     `json:"size"`
+	ModTime  time.Time `json:"mod_time"`
+	PartSize int64     `json:"part_size"`
+	// Checksum is the checksum algorithm of the upload's parts
+	Checksum types.ChecksumAlgorithm `json:"checksum"`
+	// Parts maps the completed part numbers to their ETags
+	Parts map[int32]string `json:"parts"`
+
+	// checksums maps the completed part numbers to the checksums S3 has
+	// for them, empty if it didn't report them
+	checksums map[int32]string
+	path      string
+	mu        sync.Mutex
+}
+
+// loadUploadState reads the state file at path, or returns nil if there is
+// none.
+func loadUploadState(path string) (*uploadState, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read upload state: %v", err)
+	}
+
+	state := &uploadState{path: path}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("failed to parse upload state %s: %v", path, err)
+	}
+	return state, nil
+}
+
+// matches reports whether the state belongs to an upload of the same file
+// to the same object with the same part size and checksum algorithm.
+func (st *uploadState) matches(bucket string, params *UploadParams, info os.FileInfo) bool {
+	return st.UploadID != "" &&
+		st.Bucket == bucket &&
+		st.Key == params.Key &&
+		st.Size == info.Size() &&
+		st.ModTime.Equal(info.ModTime()) &&
+		st.PartSize == params.PartSize &&
+		st.Checksum == checksumAlgorithm
+}
+
+// setPart records a completed part and saves the state.
+func (st *uploadState) setPart(partNumber int32, etag string) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	st.Parts[partNumber] = etag
+	return st.save()
+}
+
+// part returns the ETag and checksum of a part completed by an earlier
+// attempt. The checksum is empty if S3 didn't report it; the part was
+// matched by its ETag and size then.
+func (st *uploadState) part(partNumber int32) (string, string, bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	etag, ok := st.Parts[partNumber]
+	return etag, st.checksums[partNumber], ok
+}
+
+// save writes the state atomically, so a crash never leaves a torn file.
+// The caller must hold mu or own the state exclusively.
+func (st *uploadState) save() error {
+	data, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	tmp := st.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return fmt.Errorf("failed to write upload state: %v", err)
+	}
+	if err := os.Rename(tmp, st.path); err != nil {
+		return fmt.Errorf("failed to write upload state: %v", err)
+	}
+	return nil
+}
+
+func (st *uploadState) remove() error {
+	if err := os.Remove(st.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove upload state: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package tasks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/fidrasofyan/db-backup/internal/config"
+	"github.com/fidrasofyan/db-backup/internal/service"
+)
+
+// NewBackend returns the storage backend selected by storage.type.
+func NewBackend(ctx context.Context, cfg *config.Config) (service.Backend, error) {
+	switch cfg.Storage.Type {
+	case "local":
+		backend, err := service.NewLocalBackend(&service.NewLocalBackendParams{
+			Path:       cfg.Storage.Path,
+			UploadRate: cfg.UploadRate(),
+		})
+		if err != nil {
+			return nil, err
+		}
+		return backend, nil
+	case "sftp":
+		backend, err := service.NewSFTPBackend(&service.NewSFTPBackendParams{
+			Host:           cfg.Storage.SFTP.Host,
+			Port:           cfg.Storage.SFTP.Port,
+			User:           cfg.Storage.SFTP.User,
+			Password:       cfg.Storage.SFTP.Password,
+			PrivateKeyFile: cfg.Storage.SFTP.PrivateKeyFile,
+			KnownHostsFile: cfg.Storage.SFTP.KnownHostsFile,
+			Path:           cfg.Storage.Path,
+			UploadRate:     cfg.UploadRate(),
+		})
+		if err != nil {
+			return nil, err
+		}
+		return backend, nil
+	default:
+		storage, err := service.NewStorage(ctx, &service.NewStorageParams{
+			AWSEndpoint:        cfg.AWS.Endpoint,
+			AWSRegion:          cfg.AWS.Region,
+			AWSAccessKeyID:     cfg.AWS.AccessKeyID,
+			AWSSecretAccessKey: cfg.AWS.SecretAccessKey,
+			Bucket:             cfg.AWS.Bucket,
+			Retry:              cfg.Retry.Upload.Policy(),
+			UploadRate:         cfg.UploadRate(),
+		})
+		if err != nil {
+			return nil, err
+		}
+		return storage, nil
+	}
+}
+
+// Destination is a place backups are uploaded to.
+type Destination struct {
+	*config.DestinationConfig
+	Backend service.Backend
+	primary bool
+}
+
+// stateFile returns the path of the saved progress of uploading the file at
+// path to the destination. The primary keeps the name used before
+// destinations existed, so interrupted uploads resume after upgrading.
+func (d *Destination) stateFile(path string) string {
+	if d.primary {
+		return path + uploadStateExt
+	}
+	return path + "." + d.Name + uploadStateExt
+}
+
+// config returns a copy of cfg storing backups in the destination, like
+// config.Config.WithDestination.
+func (d *Destination) config(cfg *config.Config) *config.Config {
+	destCfg := *cfg
+	destCfg.AWS, destCfg.Storage, destCfg.RemoteDir = d.AWS, d.Storage, d.Prefix
+	return &destCfg
+}
+
+// Destinations are the destinations of a run, the primary first.
+type Destinations []*Destination
+
+// NewDestinations creates the backend of every configured destination.
+func NewDestinations(ctx context.Context, cfg *config.Config) (Destinations, error) {
+	var dests Destinations
+	for i := range cfg.Destinations {
+		dest := &Destination{
+			DestinationConfig: &cfg.Destinations[i],
+			primary:           i == 0,
+		}
+		backend, err := NewBackend(ctx, dest.config(cfg))
+		if err != nil {
+			dests.Close()
+			return nil, fmt.Errorf("destination %s: %w", dest.Name, err)
+		}
+		dest.Backend = backend
+		dests = append(dests, dest)
+	}
+	return dests, nil
+}
+
+// Primary returns the first destination, which also receives streamed dumps
+// and snapshot chunks.
+func (d Destinations) Primary() *Destination {
+	return d[0]
+}
+
+// Close closes the backends of all destinations.
+func (d Destinations) Close() error {
+	var errs []error
+	for _, dest := range d {
+		if err := dest.Backend.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// removeFileStates deletes the saved progress of uploading the file at path
+// to any of the destinations, and its cached checksums.
+func (d Destinations) removeFileStates(path string) {
+	for _, dest := range d {
+		removeUploadState(dest.stateFile(path))
+	}
+	if err := os.Remove(path + checksumCacheExt); err != nil && !os.IsNotExist(err) {
+		log.Printf("Warning: failed to delete checksum cache: %v\n", err)
+	}
+}
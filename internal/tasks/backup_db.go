@@ -1,91 +1,404 @@
 package tasks
 
 import (
-	"compress/gzip"
 	"context"
 	"fmt"
+	"io"
 	"log"
 	"os"
-	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/fidrasofyan/db-backup/internal/compression"
 	"github.com/fidrasofyan/db-backup/internal/config"
+	"github.com/fidrasofyan/db-backup/internal/dumper"
+	"github.com/fidrasofyan/db-backup/internal/encryption"
+	"github.com/fidrasofyan/db-backup/internal/report"
+	"github.com/fidrasofyan/db-backup/internal/retry"
+	"github.com/fidrasofyan/db-backup/internal/service"
 )
 
-func commandExists(cmd string) bool {
-	_, err := exec.LookPath(cmd)
-	return err == nil
+// DatabasesFailedError lists the databases whose backup failed while the
+// others were backed up.
+type DatabasesFailedError struct {
+	Total  int
+	Failed []FailedDatabase
 }
 
-func BackupDB(ctx context.Context, cfg *config.Config) error {
-	// Prerequisites
-	var backupCommand string
-	if commandExists("mysqldump") {
-		backupCommand = "mysqldump"
-	} else if commandExists("mariadb-dump") {
-		backupCommand = "mariadb-dump"
-	} else {
-		return fmt.Errorf("mysqldump or mariadb-dump command not found")
+type FailedDatabase struct {
+	Name string
+	Err  error
+}
+
+func (e *DatabasesFailedError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "backup failed for %d of %d databases:", len(e.Failed), e.Total)
+	for _, f := range e.Failed {
+		fmt.Fprintf(&b, "\n  - %s: %v", f.Name, f.Err)
+	}
+	return b.String()
+}
+
+// Backup dumps every configured database and archives every configured
+// directory. A failing backup doesn't stop the others: its error is recorded
+// in run and a *DatabasesFailedError is returned once all backups were
+// attempted. Directories are reported like databases, under their name.
+func Backup(ctx context.Context, cfg *config.Config, storageService service.Backend, run *report.Run) error {
+	enc, err := encryption.New(cfg.Encryption)
+	if err != nil {
+		return err
+	}
+
+	manifest := &Manifest{StartedAt: time.Now()}
+
+	var jobs []backupJob
+	for i, dbConfig := range cfg.DBConfigurations {
+		jobs = append(jobs, backupJob{
+			name:        dbConfig.DBName,
+			host:        dbConfig.Host,
+			hostLimited: true,
+			backup: func(logger *log.Logger) (*ManifestFile, error) {
+				return backupDBConfig(ctx, i, enc, cfg, storageService, dbConfig, logger)
+			},
+		})
+	}
+	for i, dirConfig := range cfg.BackupDirs {
+		jobs = append(jobs, backupJob{
+			name: dirConfig.Name,
+			backup: func(logger *log.Logger) (*ManifestFile, error) {
+				return backupDirConfig(ctx, i, enc, cfg, storageService, dirConfig, logger)
+			},
+		})
 	}
 
-	for _, dbConfig := range cfg.DBConfigurations {
-		if err := backupSingleDB(ctx, backupCommand, cfg, dbConfig); err != nil {
+	// Back up in parallel, limited globally and per host so one server isn't
+	// overloaded
+	concurrency := max(cfg.DumpConcurrency, 1)
+	perHost := max(cfg.DumpConcurrencyPerHost, 1)
+
+	var (
+		wg        sync.WaitGroup
+		limit     = make(chan struct{}, concurrency)
+		hostLimit = map[string]chan struct{}{}
+		files     = make([]*ManifestFile, len(jobs))
+		errs      = make([]error, len(jobs))
+	)
+
+	for i, job := range jobs {
+		var hostSem chan struct{}
+		if job.hostLimited {
+			var ok bool
+			hostSem, ok = hostLimit[job.host]
+			if !ok {
+				hostSem = make(chan struct{}, perHost)
+				hostLimit[job.host] = hostSem
+			}
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			// Take the host slot first so jobs waiting for a busy host don't
+			// hold a global slot
+			if hostSem != nil {
+				hostSem <- struct{}{}
+				defer func() { <-hostSem }()
+			}
+			limit <- struct{}{}
+			defer func() { <-limit }()
+
+			logger := newDBLogger(job.name)
+			run.Update(job.name, func(d *report.Database) {
+				d.StartedAt = time.Now()
+			})
+
+			// Retry transient failures such as a dropped connection. Each
+			// attempt writes a new file and removes its partial file on
+			// failure.
+			var file *ManifestFile
+			policy := cfg.Retry.Dump.Policy()
+			err := policy.Do(ctx, func() (err error) {
+				file, err = job.backup(logger)
+				return err
+			}, func(attempt int, delay time.Duration, err error) {
+				logger.Printf("retrying backup (attempt %d of %d) in %v: %v\n", attempt, policy.MaxAttempts, delay.Round(time.Second), err)
+				run.Update(job.name, func(d *report.Database) {
+					d.DumpRetries++
+				})
+			})
+			if err != nil {
+				logger.Printf("Error: %v\n", err)
+				run.Update(job.name, func(d *report.Database) {
+					d.FinishedAt = time.Now()
+					d.Error = err.Error()
+				})
+				errs[i] = err
+				return
+			}
+			files[i] = file
+
+			run.Update(job.name, func(d *report.Database) {
+				d.FinishedAt = file.FinishedAt
+				d.DumpSize = file.Size
+				if cfg.Streaming {
+					d.Uploaded++
+					d.UploadedBytes += file.Size
+				}
+			})
+		}()
+	}
+	wg.Wait()
+
+	// Collect results in config order
+	var failed []FailedDatabase
+	for i, job := range jobs {
+		if errs[i] != nil {
+			failed = append(failed, FailedDatabase{Name: job.name, Err: errs[i]})
+			continue
+		}
+		manifest.Files = append(manifest.Files, *files[i])
+	}
+
+	// Write manifest next to the dumps so it gets uploaded with them
+	if len(manifest.Files) > 0 {
+		manifest.FinishedAt = time.Now()
+		manifestFile, err := writeManifest(cfg.LocalDir, manifest)
+		if err != nil {
 			return err
 		}
+		log.Printf("manifest written: %s\n", manifestFile)
+	}
+
+	if len(failed) > 0 {
+		return &DatabasesFailedError{Total: len(jobs), Failed: failed}
 	}
 
-	log.Println("backup database complete!")
+	log.Println("backup complete!")
 	return nil
 }
 
-func backupSingleDB(ctx context.Context, backupCommand string, cfg *config.Config, dbConfig config.BackupDBConfig) error {
-	log.Printf("backing up database: %s:%s/%s\n", dbConfig.Host, dbConfig.Port, dbConfig.DBName)
+// backupJob backs up one database or directory.
+type backupJob struct {
+	name string
+	host string
+	// hostLimited jobs count against dump_concurrency_per_host of host.
+	// Directories are read from the local disk and only share the global
+	// limit.
+	hostLimited bool
+	backup      func(logger *log.Logger) (*ManifestFile, error)
+}
 
-	// Create file
-	filename := fmt.Sprintf(
-		"%s/%s_%s.sql.gz",
-		cfg.LocalDir,
+// backupDBConfig resolves the dumper of backup_db[i] and backs it up.
+func backupDBConfig(ctx context.Context, i int, enc encryption.Encryptor, cfg *config.Config, storageService service.Backend, dbConfig config.BackupDBConfig, logger *log.Logger) (*ManifestFile, error) {
+	// Prerequisites
+	// Configuration errors fail the same way on every attempt
+	d, err := dbDumper(i, dbConfig)
+	if err != nil {
+		return nil, retry.Permanent(err)
+	}
+	binary, err := d.Binary()
+	if err != nil {
+		return nil, retry.Permanent(err)
+	}
+	version, err := d.Version(ctx, binary)
+	if err != nil {
+		return nil, err
+	}
+	comp, err := compression.New(compressionConfig(cfg, dbConfig.Compression))
+	if err != nil {
+		return nil, retry.Permanent(fmt.Errorf("backup_db[%d]: %v", i, err))
+	}
+
+	file, err := backupSingleDB(ctx, d, binary, comp, enc, cfg, storageService, dbConfig, logger)
+	if err != nil {
+		return nil, err
+	}
+	file.DumperVersion = version
+	return file, nil
+}
+
+func backupSingleDB(ctx context.Context, d dumper.Dumper, binary string, comp compression.Compressor, enc encryption.Encryptor, cfg *config.Config, storageService service.Backend, dbConfig config.BackupDBConfig, logger *log.Logger) (*ManifestFile, error) {
+	startedAt := time.Now()
+	logger.Printf("backing up database: %s:%s/%s\n", dbConfig.Host, dbConfig.Port, dbConfig.DBName)
+
+	name := fmt.Sprintf(
+		"%s_%s%s%s",
 		dbConfig.DBName,
-		time.Now().Format("20060102-150405"),
+		startedAt.Format(BackupTimeFormat),
+		d.Extension(dbConfig),
+		comp.Extension(),
 	)
-	file, err := os.Create(filename)
+
+	file, err := writeBackup(ctx, cfg, storageService, comp, enc, name, logger, func(w io.Writer) error {
+		// Backup command
+		cmd := d.Command(ctx, binary, dbConfig)
+		cmd.Stdout = w
+		stderr := newLineWriter(logger)
+		cmd.Stderr = stderr
+
+		// Run
+		err := cmd.Run()
+		stderr.Flush()
+		return err
+	})
 	if err != nil {
-		return fmt.Errorf("backup db failed: %v", err)
-	}
-	defer file.Close()
-
-	// Create gzip writer
-	gzipWriter := gzip.NewWriter(file)
-	defer gzipWriter.Close()
-
-	// Backup command
-	cmd := exec.CommandContext(
-		ctx,
-		backupCommand,
-		"--quick",
-		"--single-transaction",
-		"--routines",
-		"--triggers",
-		"--events",
-		"-h"+dbConfig.Host,
-		"-P"+dbConfig.Port,
-		"-u"+dbConfig.User,
-		dbConfig.DBName,
+		return nil, fmt.Errorf("backup db failed: %v", err)
+	}
+
+	file.Database = dbConfig.DBName
+	file.DatabaseType = dbConfig.Type
+	file.StartedAt = startedAt
+	return file, nil
+}
+
+// writeBackup stores the stream written by write under name, compressed and
+// encrypted, in local_dir and/or streamed to S3. name gets the encryption
+// extension appended. The returned file has its name, size, checksum and S3
+// key set.
+func writeBackup(ctx context.Context, cfg *config.Config, storageService service.Backend, comp compression.Compressor, enc encryption.Encryptor, name string, logger *log.Logger, write func(w io.Writer) error) (*ManifestFile, error) {
+	if enc != nil {
+		name += enc.Extension()
+	}
+	filename := filepath.Join(cfg.LocalDir, name)
+	// Write under a temporary name so a concurrent upload never picks up a
+	// partial dump
+	partialFilename := filename + partialFileExt
+	s3Key := fmt.Sprintf("%s/%s", cfg.RemoteDir, name)
+
+	// Checksum the bytes exactly as they are stored
+	checksum := newChecksumWriter()
+
+	var (
+		outputs = []io.Writer{checksum}
+		file    *os.File
+		err     error
 	)
 
-	// Pass password via environment variable (more secure)
-	cmd.Env = append(os.Environ(), "MYSQL_PWD="+dbConfig.Password)
-	cmd.Stdout = gzipWriter
-	cmd.Stderr = os.Stderr
+	// Create file
+	writeLocal := !cfg.Streaming || cfg.StreamingKeepLocal
+	if writeLocal {
+		file, err = os.Create(partialFilename)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		outputs = append(outputs, file)
+	}
 
-	// Run
-	if err := cmd.Run(); err != nil {
-		// Cleanup: close writers and remove partial file
-		gzipWriter.Close()
-		file.Close()
-		os.Remove(filename)
-		return fmt.Errorf("backup db failed: %v", err)
+	// Stream to S3: the upload reads from the pipe while the dump runs
+	var (
+		pipeWriter *io.PipeWriter
+		uploadCh   chan error
+	)
+	if cfg.Streaming {
+		var pipeReader *io.PipeReader
+		pipeReader, pipeWriter = io.Pipe()
+		uploadCh = make(chan error, 1)
+
+		logger.Printf("streaming to: %s\n", s3Key)
+
+		go func() {
+			_, err := storageService.UploadStream(ctx, &service.UploadStreamParams{
+				PartSize:    cfg.UploadPartSize(),
+				Concurrency: cfg.UploadPartConcurrency,
+				Key:         s3Key,
+			}, pipeReader)
+			if err != nil {
+				// Unblock the dump if the upload gave up early
+				pipeReader.CloseWithError(err)
+			}
+			uploadCh <- err
+		}()
+		outputs = append(outputs, pipeWriter)
 	}
 
-	return nil
+	// abort releases the outputs when the pipeline can't be set up
+	abort := func(err error) {
+		if pipeWriter != nil {
+			pipeWriter.CloseWithError(err)
+			<-uploadCh
+		}
+		if file != nil {
+			file.Close()
+			os.Remove(partialFilename)
+		}
+	}
+
+	// Create encryption writer: dump -> compression -> encryption -> outputs
+	var out io.Writer = io.MultiWriter(outputs...)
+	var encWriter io.WriteCloser
+	if enc != nil {
+		encWriter, err = enc.Encrypt(out)
+		if err != nil {
+			abort(err)
+			return nil, err
+		}
+		out = encWriter
+	}
+
+	// Create compression writer
+	compWriter, err := comp.Compress(out)
+	if err != nil {
+		if encWriter != nil {
+			encWriter.Close()
+		}
+		abort(err)
+		return nil, err
+	}
+	defer compWriter.Close()
+
+	err = write(compWriter)
+
+	// Flush writers in order so every layer writes its trailer
+	if closeErr := compWriter.Close(); err == nil {
+		err = closeErr
+	}
+	if encWriter != nil {
+		if closeErr := encWriter.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if file != nil {
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+	}
+
+	// Finish the upload. A failed dump aborts it instead of completing it.
+	if pipeWriter != nil {
+		if err != nil {
+			pipeWriter.CloseWithError(err)
+		} else {
+			pipeWriter.Close()
+		}
+		if uploadErr := <-uploadCh; err == nil && uploadErr != nil {
+			err = fmt.Errorf("failed to stream to S3: %v", uploadErr)
+		}
+	}
+
+	if err != nil {
+		// Cleanup: remove partial file
+		if file != nil {
+			os.Remove(partialFilename)
+		}
+		return nil, err
+	}
+
+	if file != nil {
+		if err := os.Rename(partialFilename, filename); err != nil {
+			os.Remove(partialFilename)
+			return nil, err
+		}
+	}
+
+	return &ManifestFile{
+		Name:       name,
+		Size:       checksum.size,
+		SHA256:     checksum.Sum(),
+		S3Key:      s3Key,
+		FinishedAt: time.Now(),
+	}, nil
 }
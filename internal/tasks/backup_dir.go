@@ -0,0 +1,281 @@
+package tasks
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fidrasofyan/db-backup/internal/compression"
+	"github.com/fidrasofyan/db-backup/internal/config"
+	"github.com/fidrasofyan/db-backup/internal/encryption"
+	"github.com/fidrasofyan/db-backup/internal/retry"
+	"github.com/fidrasofyan/db-backup/internal/service"
+)
+
+// tarFileExt is the extension of directory archives, before compression and
+// encryption
+const tarFileExt = ".tar"
+
+// backupDirConfig archives or snapshots backup_dirs[i], depending on its mode.
+func backupDirConfig(ctx context.Context, i int, enc encryption.Encryptor, cfg *config.Config, storageService service.Backend, dirConfig config.BackupDirConfig, logger *log.Logger) (*ManifestFile, error) {
+	comp, err := compression.New(compressionConfig(cfg, dirConfig.Compression))
+	if err != nil {
+		return nil, retry.Permanent(fmt.Errorf("backup_dirs[%d]: %v", i, err))
+	}
+
+	// Never archive the archive being written
+	localDir, err := filepath.Abs(cfg.LocalDir)
+	if err != nil {
+		return nil, fmt.Errorf("backup dir failed: %v", err)
+	}
+
+	walker := &dirWalker{
+		ctx:      ctx,
+		config:   dirConfig,
+		logger:   logger,
+		localDir: localDir,
+		visited:  map[string]bool{},
+	}
+
+	if dirConfig.Mode == "snapshot" {
+		return backupDirSnapshot(ctx, comp, enc, cfg, storageService, dirConfig, walker, logger)
+	}
+
+	startedAt := time.Now()
+	logger.Printf("backing up directories: %s\n", strings.Join(dirConfig.Paths, ", "))
+
+	name := fmt.Sprintf(
+		"%s_%s%s%s",
+		dirConfig.Name,
+		startedAt.Format(BackupTimeFormat),
+		tarFileExt,
+		comp.Extension(),
+	)
+
+	file, err := writeBackup(ctx, cfg, storageService, comp, enc, name, logger, func(w io.Writer) error {
+		tw := tar.NewWriter(w)
+		if err := walker.walk(func(path string, info os.FileInfo, link string) error {
+			return addTarEntry(tw, logger, path, info, link)
+		}); err != nil {
+			return err
+		}
+		return tw.Close()
+	})
+	if err != nil {
+		return nil, fmt.Errorf("backup dir failed: %v", err)
+	}
+
+	file.Database = dirConfig.Name
+	file.DatabaseType = "dir"
+	file.StartedAt = startedAt
+	return file, nil
+}
+
+// dirWalker visits the files of a backup_dirs entry.
+type dirWalker struct {
+	ctx    context.Context
+	config config.BackupDirConfig
+	logger *log.Logger
+	// localDir is skipped so archives don't contain themselves
+	localDir string
+	// visited holds the resolved directories already walked, so symlink
+	// loops are not followed forever
+	visited map[string]bool
+	// fn is called for every directory, regular file and symlink. link is
+	// the target of symlinks.
+	fn func(path string, info os.FileInfo, link string) error
+}
+
+// walk calls fn for the configured paths and everything below them.
+// Directories are visited before their contents.
+func (w *dirWalker) walk(fn func(path string, info os.FileInfo, link string) error) error {
+	w.fn = fn
+	for _, root := range w.config.Paths {
+		if err := w.addRoot(root); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addRoot walks root, which is made absolute.
+func (w *dirWalker) addRoot(root string) error {
+	abs, err := filepath.Abs(root)
+	if err != nil {
+		return err
+	}
+	info, err := w.stat(abs)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return w.addDir(abs, abs, info)
+	}
+	return w.add(abs, info)
+}
+
+func (w *dirWalker) stat(path string) (os.FileInfo, error) {
+	if w.config.FollowSymlinks {
+		return os.Stat(path)
+	}
+	return os.Lstat(path)
+}
+
+func (w *dirWalker) addDir(root, dir string, info os.FileInfo) error {
+	if w.config.FollowSymlinks {
+		resolved, err := filepath.EvalSymlinks(dir)
+		if err != nil {
+			return err
+		}
+		if w.visited[resolved] {
+			w.logger.Printf("Warning: skipping %s: directory already archived\n", dir)
+			return nil
+		}
+		w.visited[resolved] = true
+	}
+
+	if err := w.fn(dir, info, ""); err != nil {
+		return err
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := w.ctx.Err(); err != nil {
+			return err
+		}
+
+		path := filepath.Join(dir, entry.Name())
+		if path == w.localDir || w.match(w.config.Exclude, root, path) {
+			continue
+		}
+
+		info, err := w.stat(path)
+		if err != nil {
+			// Files may disappear while the directory is walked
+			if os.IsNotExist(err) {
+				w.logger.Printf("Warning: skipping %s: %v\n", path, err)
+				continue
+			}
+			return err
+		}
+		if info.IsDir() {
+			if err := w.addDir(root, path, info); err != nil {
+				return err
+			}
+			continue
+		}
+		if len(w.config.Include) > 0 && !w.match(w.config.Include, root, path) {
+			continue
+		}
+		if err := w.add(path, info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// match reports whether path matches one of patterns. Patterns without a
+// slash match the base name, others the path relative to root.
+func (w *dirWalker) match(patterns []string, root, path string) bool {
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return false
+	}
+	for _, pattern := range patterns {
+		name := filepath.Base(path)
+		if strings.Contains(pattern, "/") {
+			name = filepath.ToSlash(rel)
+		}
+		if ok, _ := filepath.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// add visits a regular file or symlink.
+func (w *dirWalker) add(path string, info os.FileInfo) error {
+	switch {
+	case info.Mode()&os.ModeSymlink != 0:
+		target, err := os.Readlink(path)
+		if err != nil {
+			return err
+		}
+		return w.fn(path, info, target)
+	case info.Mode().IsRegular():
+		return w.fn(path, info, "")
+	default:
+		w.logger.Printf("Warning: skipping %s: unsupported file type %s\n", path, info.Mode().Type())
+		return nil
+	}
+}
+
+// entryName returns the archive name of path: the absolute path without the
+// leading slash, e.g. etc/nginx/nginx.conf, like tar does.
+func entryName(path string) string {
+	return strings.TrimPrefix(filepath.ToSlash(path), "/")
+}
+
+// addTarEntry writes a directory, regular file or symlink to tw.
+func addTarEntry(tw *tar.Writer, logger *log.Logger, path string, info os.FileInfo, link string) error {
+	header, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return err
+	}
+	header.Name = entryName(path)
+	if info.IsDir() {
+		// The filesystem root has no entry of its own
+		if header.Name == "" {
+			return nil
+		}
+		header.Name += "/"
+	}
+	if !info.Mode().IsRegular() {
+		return tw.WriteHeader(header)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		// Files may disappear while the directory is archived
+		if os.IsNotExist(err) {
+			logger.Printf("Warning: skipping %s: %v\n", path, err)
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+
+	// The header fixes the size: a file that shrank while being read is
+	// padded with zeros, one that grew is truncated
+	n, err := io.Copy(tw, io.LimitReader(f, info.Size()))
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %v", path, err)
+	}
+	if n < info.Size() {
+		logger.Printf("Warning: %s shrank while being archived\n", path)
+		if _, err := io.CopyN(tw, zeroReader{}, info.Size()-n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
@@ -0,0 +1,123 @@
+package tasks
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/fidrasofyan/db-backup/internal/compression"
+	"github.com/fidrasofyan/db-backup/internal/config"
+	"github.com/fidrasofyan/db-backup/internal/encryption"
+)
+
+const BackupTimeFormat = "20060102-150405"
+
+// dumpFileExts are the extensions produced by the dumpers, directory
+// archives and snapshot indexes, before compression and encryption
+var dumpFileExts = []string{".sql", ".dump", tarFileExt, snapshotFileExt}
+
+// partialFileExt marks dumps that are still being written
+const partialFileExt = ".partial"
+
+// uploadStateExt marks the saved progress of an interrupted upload of the
+// file without it. The state is written to a ".tmp" file first.
+const uploadStateExt = ".upload"
+
+func isUploadState(name string) bool {
+	return strings.HasSuffix(strings.TrimSuffix(name, ".tmp"), uploadStateExt)
+}
+
+// checksumCacheExt marks the cached checksums of the file without it, which
+// spare reading files already uploaded to compare them. The cache is written
+// to a ".tmp" file first.
+const checksumCacheExt = ".crc32c"
+
+func isChecksumCache(name string) bool {
+	return strings.HasSuffix(strings.TrimSuffix(name, ".tmp"), checksumCacheExt)
+}
+
+// parseBackupName splits a backup filename of the form
+// [dbname]_[timestamp][ext] into its database name, timestamp and extension,
+// e.g. mydb_20240101-020000.sql.gz or mydb_20240101-020000.sql.zst.age.
+func parseBackupName(name string) (string, time.Time, string, bool) {
+	// The timestamp format YYYYMMDD-HHMMSS has no underscores, so the last
+	// underscore separates it from the database name
+	i := strings.LastIndex(name, "_")
+	if i <= 0 {
+		return "", time.Time{}, "", false
+	}
+	rest := name[i+1:]
+	if len(rest) <= len(BackupTimeFormat) {
+		return "", time.Time{}, "", false
+	}
+
+	ts, err := time.ParseInLocation(BackupTimeFormat, rest[:len(BackupTimeFormat)], time.Local)
+	if err != nil {
+		return "", time.Time{}, "", false
+	}
+
+	ext := rest[len(BackupTimeFormat):]
+	if !slices.Contains(dumpFileExts, dumpExt(ext)) {
+		return "", time.Time{}, "", false
+	}
+
+	return name[:i], ts, ext, true
+}
+
+// trimEncryptionExt removes a trailing encryption extension from ext.
+func trimEncryptionExt(ext string) string {
+	ext = strings.TrimSuffix(ext, encryption.AgeFileExt)
+	return strings.TrimSuffix(ext, encryption.AESGCMFileExt)
+}
+
+// dumpExt returns the dumper's extension of a backup with extension ext,
+// e.g. ".sql" for ".sql.gz.age".
+func dumpExt(ext string) string {
+	return compression.TrimExtension(trimEncryptionExt(ext))
+}
+
+// backupTarget is a database or directory whose backups are named after Name.
+type backupTarget struct {
+	Name      string
+	Retention *config.RetentionConfig
+}
+
+// backupTargets returns the configured databases followed by the configured
+// directories.
+func backupTargets(cfg *config.Config) []backupTarget {
+	var targets []backupTarget
+	for _, dbConfig := range cfg.DBConfigurations {
+		targets = append(targets, backupTarget{Name: dbConfig.DBName, Retention: dbConfig.Retention})
+	}
+	for _, dirConfig := range cfg.BackupDirs {
+		targets = append(targets, backupTarget{Name: dirConfig.Name, Retention: dirConfig.Retention})
+	}
+	return targets
+}
+
+// compressionConfig returns override, falling back to the global compression.
+func compressionConfig(cfg *config.Config, override *config.CompressionConfig) *config.CompressionConfig {
+	if override != nil {
+		return override
+	}
+	return cfg.Compression
+}
+
+// openBackupReader decrypts and decompresses a backup with extension ext read
+// from r, returning the plain dump stream.
+func openBackupReader(r io.Reader, ext string, enc encryption.Encryptor) (io.ReadCloser, error) {
+	if encryption.IsEncrypted(ext) {
+		if enc == nil || !strings.HasSuffix(ext, enc.Extension()) {
+			return nil, fmt.Errorf("backup is encrypted (%s) but matching encryption is not configured", ext)
+		}
+		decrypted, err := enc.Decrypt(r)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt: %v", err)
+		}
+		r = decrypted
+	}
+
+	return compression.NewReader(r, trimEncryptionExt(ext))
+}
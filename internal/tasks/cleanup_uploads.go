@@ -0,0 +1,69 @@
+package tasks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+type CleanupUploadsParams struct {
+	// OlderThan keeps uploads started more recently, which may still be in
+	// progress or resumable by the next run
+	OlderThan time.Duration
+	// DryRun only lists the uploads that would be aborted
+	DryRun bool
+}
+
+// CleanupUploads aborts stale incomplete multipart uploads under the prefix
+// of every destination. Their parts are billed as storage until aborted, but
+// are never listed as objects.
+func CleanupUploads(ctx context.Context, dests Destinations, params *CleanupUploadsParams) error {
+	if len(dests) == 1 {
+		return cleanupUploads(ctx, dests.Primary(), params)
+	}
+
+	var errs []error
+	for _, dest := range dests {
+		log.Printf("destination: %s\n", dest.Name)
+		if err := cleanupUploads(ctx, dest, params); err != nil {
+			errs = append(errs, fmt.Errorf("destination %s: %w", dest.Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func cleanupUploads(ctx context.Context, dest *Destination, params *CleanupUploadsParams) error {
+	storageService := dest.Backend
+	prefix := strings.TrimLeft(dest.Prefix, "/") + "/"
+	uploads, err := storageService.ListMultipartUploads(ctx, prefix)
+	if err != nil {
+		return err
+	}
+
+	cutoff := time.Now().Add(-params.OlderThan)
+	var abortedCounter, keptCounter int
+	for _, upload := range uploads {
+		if upload.Initiated.After(cutoff) {
+			keptCounter++
+			continue
+		}
+
+		if params.DryRun {
+			log.Printf("would abort upload: %s (started %s)\n", upload.Key, upload.Initiated.Format(time.RFC3339))
+			abortedCounter++
+			continue
+		}
+
+		log.Printf("aborting upload: %s (started %s)\n", upload.Key, upload.Initiated.Format(time.RFC3339))
+		if err := storageService.AbortMultipartUpload(ctx, upload.Key, upload.UploadID); err != nil {
+			return fmt.Errorf("cleanup failed: %w", err)
+		}
+		abortedCounter++
+	}
+
+	log.Printf("aborted: %d | kept: %d\n", abortedCounter, keptCounter)
+	return nil
+}
@@ -0,0 +1,51 @@
+package tasks
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fidrasofyan/db-backup/internal/config"
+	"github.com/fidrasofyan/db-backup/internal/service"
+)
+
+func TestCleanupUploadsKeepsDumpsInProgress(t *testing.T) {
+	// The storage path contains local_dir
+	root := t.TempDir()
+	cfg := testConfig(t)
+	cfg.LocalDir = filepath.Join(root, "backups")
+	if err := os.Mkdir(cfg.LocalDir, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	backend, err := service.NewLocalBackend(&service.NewLocalBackendParams{Path: root})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dest := &Destination{
+		DestinationConfig: &config.DestinationConfig{Name: "default", Prefix: "backups"},
+		Backend:           backend,
+		primary:           true,
+	}
+
+	dump := writeFile(t, cfg, "app_20240101-020000.sql.gz.partial", "dumping")
+	upload := writeFile(t, cfg, "app_20231231-020000.sql.gz.upload-tmp", "interrupted")
+	old := time.Now().Add(-48 * time.Hour)
+	for _, path := range []string{dump, upload} {
+		if err := os.Chtimes(path, old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	params := &CleanupUploadsParams{OlderThan: 24 * time.Hour}
+	if err := CleanupUploads(context.Background(), Destinations{dest}, params); err != nil {
+		t.Fatalf("CleanupUploads() = %v", err)
+	}
+	if _, err := os.Stat(dump); err != nil {
+		t.Errorf("dump in progress deleted: %v", err)
+	}
+	if _, err := os.Stat(upload); !os.IsNotExist(err) {
+		t.Errorf("interrupted upload not deleted: %v", err)
+	}
+}
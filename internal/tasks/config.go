@@ -0,0 +1,38 @@
+package tasks
+
+import (
+	"fmt"
+
+	"github.com/fidrasofyan/db-backup/internal/config"
+	"github.com/fidrasofyan/db-backup/internal/dumper"
+)
+
+// LoadConfig loads and validates the config at configPath. Every command
+// loads its config through it, so the engine specific fields of backup_db
+// entries, which the config package can't check without importing the
+// dumpers, fail at load time too.
+func LoadConfig(configPath string) (*config.Config, error) {
+	cfg, err := config.New(configPath)
+	if err != nil {
+		return nil, err
+	}
+	for i, dbConfig := range cfg.DBConfigurations {
+		if _, err := dbDumper(i, dbConfig); err != nil {
+			return nil, err
+		}
+	}
+	return cfg, nil
+}
+
+// dbDumper returns the dumper of backup_db[i] after validating dbConfig
+// with it.
+func dbDumper(i int, dbConfig config.BackupDBConfig) (dumper.Dumper, error) {
+	d, err := dumper.Get(dbConfig.Type)
+	if err != nil {
+		return nil, fmt.Errorf("backup_db[%d].type is invalid: %v", i, err)
+	}
+	if err := d.Validate(dbConfig); err != nil {
+		return nil, fmt.Errorf("backup_db[%d]: %v", i, err)
+	}
+	return d, nil
+}
@@ -0,0 +1,77 @@
+package tasks
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		db      string
+		extra   string
+		wantErr string
+	}{
+		{
+			name: "valid",
+			db:   "{type: mysql, host: localhost, port: 3306, user: backup, password: secret, dbname: app}",
+		},
+		{
+			name:    "unknown type",
+			db:      "{type: oracle, host: localhost, port: 1521, user: backup, password: secret, dbname: app}",
+			wantErr: `backup_db[0].type is invalid: unsupported database type "oracle"`,
+		},
+		{
+			name:    "missing password",
+			db:      "{type: mysql, host: localhost, port: 3306, user: backup, dbname: app}",
+			wantErr: "backup_db[0]: password is required",
+		},
+		{
+			name:    "missing host",
+			db:      "{type: postgres, port: 5432, user: backup, password: secret, dbname: app}",
+			wantErr: "backup_db[0]: host is required",
+		},
+		{
+			name: "age encrypted snapshots without content key",
+			db:   "{type: postgres, host: localhost, port: 5432, user: backup, password: secret, dbname: app}",
+			extra: "backup_dirs: [{name: uploads, paths: [/srv], mode: snapshot}]\n" +
+				"encryption: {type: age, recipients: [age1ql3z7hjy54pw3hyww5ayyfg7zqgvc7w3j2elw8zmrj2kg5sfn9aqmcac8p]}\n",
+			wantErr: "encryption.content_key is required",
+		},
+		{
+			name: "age encrypted snapshots",
+			db:   "{type: postgres, host: localhost, port: 5432, user: backup, password: secret, dbname: app}",
+			extra: "backup_dirs: [{name: uploads, paths: [/srv], mode: snapshot}]\n" +
+				"encryption: {type: age, recipients: [age1ql3z7hjy54pw3hyww5ayyfg7zqgvc7w3j2elw8zmrj2kg5sfn9aqmcac8p], content_key: secret}\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, "config.yaml")
+			data := "local_dir: " + filepath.Join(dir, "backups") + "\n" +
+				"remote_dir: backups\n" +
+				"storage: {type: local, path: " + filepath.Join(dir, "remote") + "}\n" +
+				"backup_db:\n  - " + tt.db + "\n" + tt.extra
+			if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			cfg, err := LoadConfig(path)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("LoadConfig() = %v", err)
+				}
+				if len(cfg.DBConfigurations) != 1 {
+					t.Errorf("backup_db = %+v", cfg.DBConfigurations)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("LoadConfig() = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
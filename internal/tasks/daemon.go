@@ -0,0 +1,324 @@
+package tasks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fidrasofyan/db-backup/internal/config"
+	"github.com/fidrasofyan/db-backup/internal/metrics"
+	"github.com/robfig/cron/v3"
+)
+
+type DaemonParams struct {
+	ConfigPath string
+	// Keep overrides the retention config, see DeleteOldBackup
+	Keep int
+	// Timeout limits a single scheduled run
+	Timeout time.Duration
+}
+
+// Daemon runs backups in-process on the cron schedules from the config.
+type Daemon struct {
+	params *DaemonParams
+	cron   *cron.Cron
+	// ctx is the parent of every run; cancelling it aborts running jobs
+	ctx context.Context
+
+	// metrics is updated after every run and served on metrics.listen
+	metrics *metrics.Registry
+	server  *http.Server
+
+	// uploadMu serializes the retention and upload phase of jobs, which
+	// work on all of local_dir and share the saved upload states
+	uploadMu sync.Mutex
+
+	mu      sync.Mutex
+	cfg     *config.Config
+	dests   *daemonDestinations
+	entries []cron.EntryID
+	// running holds the databases of jobs in progress, so a run is skipped
+	// instead of overlapping a previous one, including across reloads
+	running map[string]bool
+}
+
+type daemonJob struct {
+	schedule     string
+	cronSchedule cron.Schedule
+	cfg          *config.Config
+	dests        *daemonDestinations
+}
+
+// daemonDestinations are the destinations of one loaded config. They are
+// closed once replaced by a reload and no job uses them anymore.
+type daemonDestinations struct {
+	Destinations
+	jobs sync.WaitGroup
+	// retired is set under Daemon.mu once the destinations were replaced
+	retired bool
+}
+
+func NewDaemon(ctx context.Context, params *DaemonParams) *Daemon {
+	if params.Timeout <= 0 {
+		params.Timeout = 60 * time.Minute
+	}
+	return &Daemon{
+		params:  params,
+		cron:    cron.New(),
+		ctx:     ctx,
+		metrics: metrics.NewRegistry(),
+		running: map[string]bool{},
+	}
+}
+
+// Start schedules the jobs from the config and starts the scheduler and the
+// metrics endpoint, if configured. The metrics address is not reloaded.
+func (d *Daemon) Start() error {
+	if err := d.Reload(); err != nil {
+		return err
+	}
+
+	cfg := d.config()
+	if cfg.Metrics.Textfile != "" {
+		if err := d.metrics.LoadTextfile(cfg.Metrics.Textfile); err != nil {
+			log.Printf("Warning: %v\n", err)
+		}
+		d.metrics.Prune(backupNames(cfg))
+	}
+	if cfg.Metrics.Listen != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", d.metrics.Handler())
+		d.server = &http.Server{
+			Addr:              cfg.Metrics.Listen,
+			Handler:           mux,
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+		listener, err := net.Listen("tcp", cfg.Metrics.Listen)
+		if err != nil {
+			return fmt.Errorf("failed to start metrics endpoint: %v", err)
+		}
+		go func() {
+			if err := d.server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				log.Printf("Error: metrics endpoint: %v\n", err)
+			}
+		}()
+		log.Printf("serving metrics on %s/metrics\n", cfg.Metrics.Listen)
+	}
+
+	d.cron.Start()
+	return nil
+}
+
+func (d *Daemon) config() *config.Config {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.cfg
+}
+
+// Reload re-reads the config and replaces the scheduled jobs. Running jobs
+// finish with the config they started with. On error the current schedule is
+// kept.
+func (d *Daemon) Reload() error {
+	cfg, err := LoadConfig(d.params.ConfigPath)
+	if err != nil {
+		return err
+	}
+
+	// Group databases and directories by schedule so those sharing a
+	// schedule run together, like backup-db does
+	var jobs []*daemonJob
+	bySchedule := map[string]*daemonJob{}
+	jobFor := func(name, schedule string) *daemonJob {
+		if schedule == "" {
+			schedule = cfg.Schedule
+		}
+		if schedule == "" {
+			log.Printf("Warning: %s has no schedule and will not be backed up\n", name)
+			return nil
+		}
+
+		job, ok := bySchedule[schedule]
+		if !ok {
+			jobCfg := *cfg
+			jobCfg.DBConfigurations = nil
+			jobCfg.BackupDirs = nil
+			job = &daemonJob{
+				schedule: schedule,
+				cfg:      &jobCfg,
+			}
+			bySchedule[schedule] = job
+			jobs = append(jobs, job)
+		}
+		return job
+	}
+	for _, dbConfig := range cfg.DBConfigurations {
+		if job := jobFor(dbConfig.DBName, dbConfig.Schedule); job != nil {
+			job.cfg.DBConfigurations = append(job.cfg.DBConfigurations, dbConfig)
+		}
+	}
+	for _, dirConfig := range cfg.BackupDirs {
+		if job := jobFor(dirConfig.Name, dirConfig.Schedule); job != nil {
+			job.cfg.BackupDirs = append(job.cfg.BackupDirs, dirConfig)
+		}
+	}
+	if len(jobs) == 0 {
+		return errors.New("no schedule configured: set schedule, backup_db[].schedule or backup_dirs[].schedule")
+	}
+	for _, job := range jobs {
+		job.cronSchedule, err = cron.ParseStandard(job.schedule)
+		if err != nil {
+			return fmt.Errorf("schedule %q is invalid: %v", job.schedule, err)
+		}
+	}
+
+	// Create storage backends
+	dests, err := NewDestinations(d.ctx, cfg)
+	if err != nil {
+		return err
+	}
+	jobDests := &daemonDestinations{Destinations: dests}
+	for _, job := range jobs {
+		job.dests = jobDests
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, id := range d.entries {
+		d.cron.Remove(id)
+	}
+	d.entries = nil
+	d.cfg = cfg
+	d.retireDestinations()
+	d.dests = jobDests
+
+	for _, job := range jobs {
+		id := d.cron.Schedule(job.cronSchedule, cron.FuncJob(func() {
+			d.run(job)
+		}))
+		d.entries = append(d.entries, id)
+
+		log.Printf("scheduled %s: %s (next run: %s)\n", job.schedule, strings.Join(jobDBNames(job), ", "), job.cronSchedule.Next(time.Now()).Format(time.RFC3339))
+	}
+
+	return nil
+}
+
+// retireDestinations closes the current destinations once the jobs using them
+// have finished. d.mu must be held.
+func (d *Daemon) retireDestinations() {
+	dests := d.dests
+	if dests == nil {
+		return
+	}
+	dests.retired = true
+	go func() {
+		dests.jobs.Wait()
+		if err := dests.Close(); err != nil {
+			log.Printf("Warning: %v\n", err)
+		}
+	}()
+}
+
+// Stop stops scheduling new runs. The returned context is done once the
+// running jobs have finished and the storage backends are closed.
+func (d *Daemon) Stop() context.Context {
+	stopCtx := d.cron.Stop()
+
+	// Keep serving metrics until the running jobs are done
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		defer cancel()
+		<-stopCtx.Done()
+		if d.server != nil {
+			shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer shutdownCancel()
+			d.server.Shutdown(shutdownCtx)
+		}
+
+		d.mu.Lock()
+		dests := d.dests
+		d.mu.Unlock()
+		if dests != nil {
+			if err := dests.Close(); err != nil {
+				log.Printf("Warning: %v\n", err)
+			}
+		}
+	}()
+	return ctx
+}
+
+func (d *Daemon) run(job *daemonJob) {
+	names := jobDBNames(job)
+
+	d.mu.Lock()
+	// The job fired just before a reload removed it
+	if job.dests.retired {
+		d.mu.Unlock()
+		return
+	}
+	for _, name := range names {
+		if d.running[name] {
+			d.mu.Unlock()
+			log.Printf("Warning: skipping run of %s: previous run of %s is still in progress\n", job.schedule, name)
+			return
+		}
+	}
+	for _, name := range names {
+		d.running[name] = true
+	}
+	job.dests.jobs.Add(1)
+	d.mu.Unlock()
+
+	defer func() {
+		d.mu.Lock()
+		for _, name := range names {
+			delete(d.running, name)
+		}
+		d.mu.Unlock()
+		job.dests.jobs.Done()
+	}()
+
+	ctx, cancel := context.WithTimeout(d.ctx, d.params.Timeout)
+	defer cancel()
+
+	log.Printf("starting scheduled backup: %s\n", strings.Join(names, ", "))
+	start := time.Now()
+
+	run, err := RunBackup(ctx, job.cfg, job.dests.Destinations, &RunBackupParams{
+		Keep:       d.params.Keep,
+		UploadLock: &d.uploadMu,
+	})
+
+	// Update metrics
+	cfg := d.config()
+	d.metrics.Record(run)
+	d.metrics.Prune(backupNames(cfg))
+	if cfg.Metrics.Textfile != "" {
+		if err := d.metrics.WriteTextfile(cfg.Metrics.Textfile); err != nil {
+			log.Printf("Warning: %v\n", err)
+		}
+	}
+
+	if err := SendNotifications(cfg, run); err != nil {
+		log.Printf("Warning: %v\n", err)
+	}
+
+	if err != nil {
+		log.Printf("Error: scheduled backup of %s failed: %v\n", strings.Join(names, ", "), err)
+		return
+	}
+
+	log.Printf("scheduled backup complete: %s (took %s)\n", strings.Join(names, ", "), time.Since(start).Round(time.Second))
+}
+
+func jobDBNames(job *daemonJob) []string {
+	return backupNames(job.cfg)
+}
@@ -5,28 +5,88 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"path"
 	"path/filepath"
-	"sort"
 	"strings"
 	"time"
 
 	"github.com/fidrasofyan/db-backup/internal/config"
+	"github.com/fidrasofyan/db-backup/internal/report"
+	"github.com/fidrasofyan/db-backup/internal/retention"
 	"github.com/fidrasofyan/db-backup/internal/service"
 )
 
 type backupFile struct {
-	Path    string
-	ModTime time.Time
-	Name    string
+	Path      string
+	Name      string
+	Timestamp time.Time
 }
 
-func DeleteOldBackup(ctx context.Context, cfg *config.Config, storageService *service.Storage, keep int) error {
-	if keep <= 0 {
+// retentionPolicy returns the policy for target in dest, or in local_dir if
+// dest is nil. A positive keep (the --keep flag) overrides the config with
+// "keep the newest keep backups". The retention of a destination overrides
+// that of its targets.
+func retentionPolicy(cfg *config.Config, dest *Destination, target backupTarget, keep int) retention.Policy {
+	if keep > 0 {
+		return retention.Policy{KeepLast: keep}
+	}
+	if dest != nil && dest.Retention != nil {
+		return dest.Retention.Policy()
+	}
+	if target.Retention != nil {
+		return target.Retention.Policy()
+	}
+	return cfg.Retention.Policy()
+}
+
+// retentionEnabled reports whether any database or directory has a policy in
+// dest, see retentionPolicy.
+func retentionEnabled(cfg *config.Config, dest *Destination, keep int) bool {
+	for _, target := range backupTargets(cfg) {
+		if !retentionPolicy(cfg, dest, target, keep).IsZero() {
+			return true
+		}
+	}
+	return false
+}
+
+// expiredFiles returns the paths of the backups among files that the
+// retention of dest would delete. It is empty if dest has no retention of
+// its own.
+func expiredFiles(cfg *config.Config, dest *Destination, files []FileInfo, now time.Time) map[string]bool {
+	expired := map[string]bool{}
+	if dest.Retention == nil {
+		return expired
+	}
+	for _, target := range backupTargets(cfg) {
+		policy := retentionPolicy(cfg, dest, target, 0)
+		if policy.IsZero() {
+			continue
+		}
+		var backups []retention.Backup
+		for _, f := range files {
+			if dbName, ts, _, ok := parseBackupName(f.Name); ok && dbName == target.Name {
+				backups = append(backups, retention.Backup{ID: f.Path, Timestamp: ts})
+			}
+		}
+		for _, b := range retention.Apply(policy, backups, now) {
+			expired[b.ID] = true
+		}
+	}
+	return expired
+}
+
+// DeleteOldBackup applies retention to the files in local_dir, for
+// retention_mode local. Their copies are deleted from the destinations without
+// a retention of their own; the others are pruned by deleteOldRemoteBackup.
+func DeleteOldBackup(ctx context.Context, cfg *config.Config, dests Destinations, keep int, run *report.Run) error {
+	// Nothing to do if no database or directory has a policy
+	if !retentionEnabled(cfg, nil, keep) {
 		return nil
 	}
 
-	// 1. Scan directory for backup files
-	var allFiles []backupFile
+	// 1. Scan directory for backup files and manifests
+	var allFiles, manifests []backupFile
 	err := filepath.WalkDir(cfg.LocalDir, func(path string, d os.DirEntry, err error) error {
 		if err != nil {
 			return err
@@ -35,25 +95,18 @@ func DeleteOldBackup(ctx context.Context, cfg *config.Config, storageService *se
 			return nil
 		}
 
-		// Only match *.sql.gz files
-		matched, err := filepath.Match("*.sql.gz", d.Name())
-		if err != nil {
-			return fmt.Errorf("failed to match file: %v", err)
-		}
-		if !matched {
+		if isManifestName(d.Name()) {
+			manifests = append(manifests, backupFile{Path: path, Name: d.Name()})
 			return nil
 		}
-
-		info, err := d.Info()
-		if err != nil {
-			return fmt.Errorf("failed to get file info: %v", err)
+		// Only match backup files
+		if _, ts, _, ok := parseBackupName(d.Name()); ok {
+			allFiles = append(allFiles, backupFile{
+				Path:      path,
+				Name:      d.Name(),
+				Timestamp: ts,
+			})
 		}
-
-		allFiles = append(allFiles, backupFile{
-			Path:    path,
-			ModTime: info.ModTime(),
-			Name:    info.Name(),
-		})
 		return nil
 	})
 	if err != nil {
@@ -62,60 +115,219 @@ func DeleteOldBackup(ctx context.Context, cfg *config.Config, storageService *se
 
 	// 2. Process each database from configuration
 	var deletedCounter int32
+	deleted := map[string]bool{}
+	now := time.Now()
+
+	for _, target := range backupTargets(cfg) {
+		policy := retentionPolicy(cfg, nil, target, keep)
+		if policy.IsZero() {
+			continue
+		}
+		// Never rotate away good backups of a database whose new dump failed
+		if run.Failed(target.Name) {
+			log.Printf("DB: %s | skipping rotation: backup failed in this run\n", target.Name)
+			continue
+		}
 
-	for _, dbConfig := range cfg.DBConfigurations {
-		var dbFiles []backupFile
-		prefix := dbConfig.DBName + "_"
+		var backups []retention.Backup
+		files := map[string]backupFile{}
 
 		for _, f := range allFiles {
 			// Check if file belongs to this database
-			// Format: [dbname]_[timestamp].sql.gz
-			if strings.HasPrefix(f.Name, prefix) {
-				// Ensure it's exactly [dbname] followed by one underscore and then the timestamp
-				// (the timestamp format YYYYMMDD-HHMMSS has no underscores)
-				rest := strings.TrimSuffix(f.Name[len(prefix):], ".sql.gz")
-				if !strings.Contains(rest, "_") {
-					dbFiles = append(dbFiles, f)
-				}
+			// Format: [dbname]_[timestamp][ext], e.g. mydb_20240101-020000.sql.gz
+			if dbName, _, _, ok := parseBackupName(f.Name); ok && dbName == target.Name {
+				backups = append(backups, retention.Backup{ID: f.Path, Timestamp: f.Timestamp})
+				files[f.Path] = f
 			}
 		}
 
-		if len(dbFiles) <= keep {
-			log.Printf("DB: %s | keep: %d | total files: %d | deleted: 0\n", dbConfig.DBName, keep, len(dbFiles))
+		// Decide by the timestamp encoded in the filename
+		filesToDelete := retention.Apply(policy, backups, now)
+		for _, b := range filesToDelete {
+			file := files[b.ID]
+			log.Printf("DB: %s | deleting file: %s\n", target.Name, file.Path)
+			if err := deleteLocalFile(ctx, cfg, dests, keep, file); err != nil {
+				return err
+			}
+			deleted[file.Path] = true
+			deletedCounter++
+		}
+		log.Printf("DB: %s | policy: %s | total files: %d | deleted: %d\n", target.Name, policy, len(backups), len(filesToDelete))
+		run.Update(target.Name, func(d *report.Database) {
+			d.Deleted += len(filesToDelete)
+		})
+	}
+
+	// 3. Delete manifests of deleted backups only
+	var remaining []string
+	for _, f := range allFiles {
+		if !deleted[f.Path] {
+			remaining = append(remaining, f.Name)
+		}
+	}
+	var manifestsDeleted int
+	for _, file := range manifests {
+		f, err := os.Open(file.Path)
+		if err != nil {
+			return fmt.Errorf("file %s error: %v", file.Path, err)
+		}
+		m, err := decodeManifest(f)
+		f.Close()
+		if err != nil {
+			log.Printf("Warning: %s: %v\n", file.Path, err)
+			continue
+		}
+		if !manifestObsolete(m, remaining) {
 			continue
 		}
+		log.Printf("deleting manifest: %s\n", file.Path)
+		if err := deleteLocalFile(ctx, cfg, dests, keep, file); err != nil {
+			return err
+		}
+		manifestsDeleted++
+	}
 
-		// Sort files by ModTime descending (newest first)
-		sort.Slice(dbFiles, func(i, j int) bool {
-			return dbFiles[i].ModTime.After(dbFiles[j].ModTime)
-		})
+	log.Printf("Rotation complete. Total deleted: %d | manifests deleted: %d\n", deletedCounter, manifestsDeleted)
+	return nil
+}
 
-		// Files to delete are from index keep onwards
-		filesToDelete := dbFiles[keep:]
-		for _, file := range filesToDelete {
-			log.Printf("DB: %s | deleting file: %s\n", dbConfig.DBName, file.Path)
-			if err := os.Remove(file.Path); err != nil {
-				return fmt.Errorf("file %s error: failed to delete from local: %v", file.Path, err)
-			}
+// deleteLocalFile deletes a file in local_dir and its copies in the
+// destinations following local_dir.
+func deleteLocalFile(ctx context.Context, cfg *config.Config, dests Destinations, keep int, file backupFile) error {
+	if err := os.Remove(file.Path); err != nil {
+		return fmt.Errorf("file %s error: failed to delete from local: %v", file.Path, err)
+	}
+	dests.removeFileStates(file.Path)
 
-			// Use relative path to include subdirectories for S3 key
-			relPath, err := filepath.Rel(cfg.LocalDir, file.Path)
-			if err != nil {
-				return fmt.Errorf("file %s error: failed to get relative path: %v", file.Name, err)
-			}
-			s3Key := fmt.Sprintf("%s/%s", strings.TrimLeft(cfg.RemoteDir, "/"), relPath)
+	// Use relative path to include subdirectories for S3 key
+	relPath, err := filepath.Rel(cfg.LocalDir, file.Path)
+	if err != nil {
+		return fmt.Errorf("file %s error: failed to get relative path: %v", file.Name, err)
+	}
+
+	// Delete file from the destinations following local_dir
+	for _, dest := range dests {
+		if dest.Retention != nil && keep <= 0 {
+			continue
+		}
+		s3Key := fmt.Sprintf("%s/%s", strings.TrimLeft(dest.Prefix, "/"), filepath.ToSlash(relPath))
+		if err := dest.Backend.Remove(ctx, s3Key); err != nil {
+			log.Printf("Warning: failed to delete %s from %s: %v\n", s3Key, dest.Name, err)
+		}
+	}
+	return nil
+}
+
+// deleteOldRemoteBackup applies retention to the objects under the prefix of
+// dest, one of dests, so backups uploaded from other hosts or whose local copy
+// is gone are pruned too. In retention_mode remote, pruning the primary also
+// deletes the local copies that exist.
+func deleteOldRemoteBackup(ctx context.Context, cfg *config.Config, dests Destinations, dest *Destination, keep int, run *report.Run) error {
+	// Nothing to do if no database or directory has a policy
+	if !retentionEnabled(cfg, dest, keep) {
+		return nil
+	}
 
-			// Delete file from S3
-			err = storageService.Remove(ctx, cfg.AWS.Bucket, s3Key)
-			if err != nil {
-				log.Printf("Warning: failed to delete %s from S3: %v\n", s3Key, err)
+	// 1. List bucket for backup objects
+	storageService := dest.Backend
+	prefix := dest.Prefix + "/"
+	objects, err := storageService.List(ctx, prefix)
+	if err != nil {
+		return err
+	}
+
+	// 2. Process each database from configuration
+	var keysToDelete []string
+	now := time.Now()
+
+	for _, target := range backupTargets(cfg) {
+		policy := retentionPolicy(cfg, dest, target, keep)
+		if policy.IsZero() {
+			continue
+		}
+		// Never rotate away good backups of a database whose new dump failed
+		if run.Failed(target.Name) {
+			log.Printf("DB: %s | skipping rotation: backup failed in this run\n", target.Name)
+			continue
+		}
+
+		var backups []retention.Backup
+		for _, obj := range objects {
+			// Format: [dbname]_[timestamp][ext], e.g. mydb_20240101-020000.sql.gz
+			if dbName, ts, _, ok := parseBackupName(path.Base(obj.Key)); ok && dbName == target.Name {
+				backups = append(backups, retention.Backup{ID: obj.Key, Timestamp: ts})
 			}
+		}
 
-			deletedCounter++
+		// Decide by the timestamp encoded in the filename
+		objectsToDelete := retention.Apply(policy, backups, now)
+		for _, b := range objectsToDelete {
+			log.Printf("DB: %s | deleting object: %s\n", target.Name, b.ID)
+			keysToDelete = append(keysToDelete, b.ID)
+		}
+		log.Printf("DB: %s | policy: %s | total objects: %d | deleted: %d\n", target.Name, policy, len(backups), len(objectsToDelete))
+		run.Update(target.Name, func(d *report.Database) {
+			d.Deleted += len(objectsToDelete)
+		})
+	}
+
+	// 3. Delete manifests of deleted backups only
+	deleted := map[string]bool{}
+	for _, key := range keysToDelete {
+		deleted[key] = true
+	}
+	var remaining []string
+	for _, obj := range objects {
+		if !deleted[obj.Key] {
+			remaining = append(remaining, path.Base(obj.Key))
+		}
+	}
+	backupsDeleted := len(keysToDelete)
+	for _, obj := range objects {
+		if !isManifestName(path.Base(obj.Key)) {
+			continue
+		}
+		m, err := loadRemoteManifest(ctx, storageService, obj.Key)
+		if err != nil {
+			log.Printf("Warning: %s: %v\n", obj.Key, err)
+			continue
+		}
+		if manifestObsolete(m, remaining) {
+			log.Printf("deleting manifest: %s\n", obj.Key)
+			keysToDelete = append(keysToDelete, obj.Key)
 		}
-		log.Printf("DB: %s | keep: %d | total files: %d | deleted: %d\n", dbConfig.DBName, keep, len(dbFiles), len(filesToDelete))
 	}
 
-	log.Printf("Rotation complete. Total deleted: %d\n", deletedCounter)
+	// 4. Delete from S3 in batches
+	if err := storageService.RemoveMany(ctx, keysToDelete); err != nil {
+		return fmt.Errorf("failed to delete from S3: %v", err)
+	}
+	run.UpdateDestination(dest.Name, func(d *report.Destination) {
+		d.Deleted += backupsDeleted
+	})
+
+	// 5. Delete local copies that exist
+	if cfg.RetentionMode == "remote" && dest.primary {
+		for _, key := range keysToDelete {
+			localPath := filepath.Join(cfg.LocalDir, filepath.FromSlash(strings.TrimPrefix(key, prefix)))
+			if err := os.Remove(localPath); err != nil && !os.IsNotExist(err) {
+				log.Printf("Warning: failed to delete local file %s: %v\n", localPath, err)
+			}
+			dests.removeFileStates(localPath)
+		}
+	}
+
+	log.Printf("Rotation complete. Total deleted: %d | manifests deleted: %d\n", backupsDeleted, len(keysToDelete)-backupsDeleted)
 	return nil
 }
+
+// loadRemoteManifest downloads and decodes the manifest at key.
+func loadRemoteManifest(ctx context.Context, storageService service.Backend, key string) (*Manifest, error) {
+	body, err := storageService.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	return decodeManifest(body)
+}
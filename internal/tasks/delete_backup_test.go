@@ -0,0 +1,150 @@
+package tasks
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/fidrasofyan/db-backup/internal/config"
+	"github.com/fidrasofyan/db-backup/internal/report"
+)
+
+// writeTestManifest writes a manifest listing files of database app.
+func writeTestManifest(t *testing.T, cfg *config.Config, name string, files ...string) string {
+	t.Helper()
+	var m Manifest
+	for _, f := range files {
+		m.Files = append(m.Files, ManifestFile{Name: f, Database: "app"})
+	}
+	data, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return writeFile(t, cfg, name, string(data))
+}
+
+// localFiles returns the names of the files in local_dir, sorted.
+func localFiles(t *testing.T, cfg *config.Config) []string {
+	t.Helper()
+	entries, err := os.ReadDir(cfg.LocalDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	return names
+}
+
+func TestDeleteOldBackup(t *testing.T) {
+	ctx := context.Background()
+	cfg := testConfig(t)
+	cfg.Retention = &config.RetentionConfig{KeepLast: 2}
+	oldest := writeFile(t, cfg, "app_20240101-020000.sql.gz", "1")
+	writeFile(t, cfg, "app_20240102-020000.sql.gz", "2")
+	writeFile(t, cfg, "app_20240103-020000.sql.gz", "3")
+	writeFile(t, cfg, "app_20240101-020000.sql.gz"+checksumCacheExt, "{}")
+	writeFile(t, cfg, "app_20240101-020000.sql.gz"+uploadStateExt, "{}")
+	writeFile(t, cfg, "app_20240101-020000.sql.gz.offsite"+uploadStateExt, "{}")
+	writeTestManifest(t, cfg, "manifest_20240101-020000.json", "app_20240101-020000.sql.gz")
+	writeTestManifest(t, cfg, "manifest_20240103-020000.json", "app_20240103-020000.sql.gz")
+
+	// The primary follows local_dir, offsite has its own retention
+	primary := testDestination("primary", "backups", true)
+	offsite := testDestination("offsite", "offsite", false)
+	offsite.Retention = &config.RetentionConfig{KeepLast: 3}
+	dests := Destinations{primary, offsite}
+	for _, dest := range dests {
+		if err := Upload(ctx, cfg, dest, report.New()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	run := report.New()
+	if err := DeleteOldBackup(ctx, cfg, dests, 0, run); err != nil {
+		t.Fatalf("DeleteOldBackup() = %v", err)
+	}
+
+	want := []string{"app_20240102-020000.sql.gz", "app_20240103-020000.sql.gz", "manifest_20240103-020000.json"}
+	if files := localFiles(t, cfg); !slices.Equal(files, want) {
+		t.Errorf("local files = %q, want %q", files, want)
+	}
+	wantKeys := []string{"backups/app_20240102-020000.sql.gz", "backups/app_20240103-020000.sql.gz", "backups/manifest_20240103-020000.json"}
+	if keys := objectKeys(t, primary.Backend); !slices.Equal(keys, wantKeys) {
+		t.Errorf("primary objects = %q, want %q", keys, wantKeys)
+	}
+	if keys := objectKeys(t, offsite.Backend); len(keys) != 5 {
+		t.Errorf("offsite objects = %q, want them untouched", keys)
+	}
+	if _, err := os.Stat(oldest); !os.IsNotExist(err) {
+		t.Errorf("oldest backup not deleted: %v", err)
+	}
+	if dbs := run.Databases(); len(dbs) != 1 || dbs[0].Deleted != 1 {
+		t.Errorf("database report = %+v, want 1 deleted file", dbs)
+	}
+}
+
+func TestDeleteOldBackupSkipsFailedDatabases(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.Retention = &config.RetentionConfig{KeepLast: 1}
+	writeFile(t, cfg, "app_20240101-020000.sql.gz", "1")
+	writeFile(t, cfg, "app_20240102-020000.sql.gz", "2")
+
+	run := report.New()
+	run.Update("app", func(d *report.Database) {
+		d.Error = "dump failed"
+	})
+	dests := Destinations{testDestination("primary", "backups", true)}
+	if err := DeleteOldBackup(context.Background(), cfg, dests, 0, run); err != nil {
+		t.Fatalf("DeleteOldBackup() = %v", err)
+	}
+	if files := localFiles(t, cfg); len(files) != 2 {
+		t.Errorf("local files = %q, want both backups kept", files)
+	}
+}
+
+func TestDeleteOldRemoteBackup(t *testing.T) {
+	ctx := context.Background()
+	cfg := testConfig(t)
+	cfg.RetentionMode = "remote"
+	cfg.Retention = &config.RetentionConfig{KeepLast: 1}
+	primary := testDestination("primary", "backups", true)
+	dests := Destinations{primary}
+
+	// Backups uploaded from another host only exist in the bucket
+	for _, key := range []string{"backups/app_20231231-020000.sql.gz", "backups/sub/app_20240101-020000.sql.gz"} {
+		if err := primary.Backend.Put(ctx, key, []byte("other host")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(cfg.LocalDir, "sub"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, cfg, "sub/app_20240101-020000.sql.gz", "other host")
+	writeFile(t, cfg, "app_20240102-020000.sql.gz", "2")
+	writeTestManifest(t, cfg, "manifest_20240102-020000.json", "app_20240102-020000.sql.gz")
+	if err := Upload(ctx, cfg, primary, report.New()); err != nil {
+		t.Fatal(err)
+	}
+
+	run := report.New()
+	if err := deleteOldRemoteBackup(ctx, cfg, dests, primary, 0, run); err != nil {
+		t.Fatalf("deleteOldRemoteBackup() = %v", err)
+	}
+
+	want := []string{"backups/app_20240102-020000.sql.gz", "backups/manifest_20240102-020000.json"}
+	if keys := objectKeys(t, primary.Backend); !slices.Equal(keys, want) {
+		t.Errorf("objects = %q, want %q", keys, want)
+	}
+	// The local copies of pruned objects are deleted too
+	if _, err := os.Stat(filepath.Join(cfg.LocalDir, "sub", "app_20240101-020000.sql.gz")); !os.IsNotExist(err) {
+		t.Errorf("local copy not deleted: %v", err)
+	}
+	if d := destinationReport(t, run, "primary"); d.Deleted != 2 {
+		t.Errorf("destination report = %+v, want 2 deleted backups", d)
+	}
+}
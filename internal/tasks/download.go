@@ -0,0 +1,135 @@
+package tasks
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fidrasofyan/db-backup/internal/config"
+	"github.com/fidrasofyan/db-backup/internal/encryption"
+	"github.com/fidrasofyan/db-backup/internal/service"
+)
+
+type DownloadParams struct {
+	// Name is the database or directory whose backup is downloaded
+	Name string
+	// At is either "latest" or a timestamp in the YYYYMMDD-HHMMSS format
+	At string
+	// Out is the file to write, or an existing directory to write the
+	// backup into under its own name
+	Out string
+	// Decompress decrypts and decompresses the backup while downloading,
+	// writing the plain dump, e.g. a .sql file
+	Decompress bool
+	// PartSize and Concurrency are the size and number of the ranges
+	// downloaded in parallel
+	PartSize    int64
+	Concurrency int
+}
+
+// Download fetches a backup from remote_dir into a local file and returns its
+// path. The file is written under a temporary name and only renamed once the
+// download was verified.
+func Download(ctx context.Context, cfg *config.Config, storageService service.Backend, params *DownloadParams) (string, error) {
+	// Pick backup
+	backups, err := ListRemoteBackups(ctx, cfg, storageService, params.Name)
+	if err != nil {
+		return "", err
+	}
+	backup, err := selectBackup(backups, params.At)
+	if err != nil {
+		return "", err
+	}
+
+	// Prerequisites
+	var enc encryption.Encryptor
+	name := path.Base(backup.Key)
+	if params.Decompress {
+		enc, err = encryption.New(cfg.Encryption)
+		if err != nil {
+			return "", err
+		}
+		name = strings.TrimSuffix(name, backup.Ext) + dumpExt(backup.Ext)
+	}
+	out := params.Out
+	if info, err := os.Stat(out); err == nil && info.IsDir() {
+		out = filepath.Join(out, name)
+	}
+
+	log.Printf("downloading %s (%d bytes) to: %s\n", backup.Key, backup.Size, out)
+	start := time.Now()
+
+	partialOut := out + partialFileExt
+	file, err := os.Create(partialOut)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(partialOut)
+	defer file.Close()
+
+	downloadParams := &service.DownloadParams{
+		Key:         backup.Key,
+		PartSize:    params.PartSize,
+		Concurrency: params.Concurrency,
+	}
+	if params.Decompress {
+		err = downloadDecompressed(ctx, storageService, downloadParams, backup.Ext, enc, file)
+	} else {
+		_, err = storageService.Download(ctx, downloadParams, file)
+	}
+	if err != nil {
+		return "", fmt.Errorf("download failed: %w", err)
+	}
+
+	if err := file.Close(); err != nil {
+		return "", err
+	}
+	if err := os.Rename(partialOut, out); err != nil {
+		return "", err
+	}
+
+	log.Printf("download complete (took %s)\n", time.Since(start).Round(time.Millisecond))
+	return out, nil
+}
+
+// downloadDecompressed downloads the backup with extension ext and writes the
+// plain dump to w.
+func downloadDecompressed(ctx context.Context, storageService service.Backend, params *service.DownloadParams, ext string, enc encryption.Encryptor, w io.Writer) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// The download writes into the pipe while it is decompressed
+	pipeReader, pipeWriter := io.Pipe()
+	downloadCh := make(chan error, 1)
+	go func() {
+		_, err := storageService.Download(ctx, params, pipeWriter)
+		pipeWriter.CloseWithError(err)
+		downloadCh <- err
+	}()
+
+	dumpReader, err := openBackupReader(pipeReader, ext, enc)
+	if err == nil {
+		_, err = io.Copy(w, dumpReader)
+		dumpReader.Close()
+	}
+	if err != nil {
+		// Stop the download if decompressing failed first. Errors of the
+		// download reach here through the pipe.
+		cancel()
+		pipeReader.CloseWithError(err)
+		<-downloadCh
+		return err
+	}
+
+	// The compressed stream may end before the object does
+	if _, err := io.Copy(io.Discard, pipeReader); err != nil {
+		return err
+	}
+	return <-downloadCh
+}
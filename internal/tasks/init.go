@@ -22,6 +22,7 @@ type BackupDBConfig struct {
 	User     string `yaml:"user"`
 	Password string `yaml:"password"`
 	DBName   string `yaml:"dbname"`
+	Format   string `yaml:"format,omitempty"`
 }
 
 type Config struct {
@@ -0,0 +1,145 @@
+package tasks
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fidrasofyan/db-backup/internal/config"
+	"github.com/fidrasofyan/db-backup/internal/service"
+)
+
+type ListBackupsParams struct {
+	// Name limits the listing to one database or directory. Empty lists all.
+	Name string
+}
+
+// BackupList is the backups of one database or directory.
+type BackupList struct {
+	Name string `json:"name"`
+	// Latest is the timestamp of the newest backup, if there is one
+	Latest *time.Time `json:"latest,omitempty"`
+	// LatestAge is how long ago the newest backup was taken
+	LatestAge time.Duration `json:"-"`
+	// LatestAgeSeconds is LatestAge for JSON output
+	LatestAgeSeconds int64          `json:"latest_age_seconds,omitempty"`
+	Backups          []ListedBackup `json:"backups"`
+}
+
+type ListedBackup struct {
+	// File is the path relative to local_dir and remote_dir
+	File      string    `json:"file"`
+	Timestamp time.Time `json:"timestamp"`
+	Size      int64     `json:"size"`
+	// Location is local, remote or both
+	Location string `json:"location"`
+}
+
+// ListBackups returns the backups in local_dir and under remote_dir, grouped
+// by database or directory and sorted by name, newest backup first. The
+// configured databases and directories are listed even without backups.
+func ListBackups(ctx context.Context, cfg *config.Config, storageService service.Backend, params *ListBackupsParams) ([]BackupList, error) {
+	backups := map[string]*ListedBackup{}
+	names := map[string]string{}
+	add := func(file string, ts time.Time, size int64, location string) {
+		if b, ok := backups[file]; ok {
+			b.Location = "both"
+			return
+		}
+		backups[file] = &ListedBackup{
+			File:      file,
+			Timestamp: ts,
+			Size:      size,
+			Location:  location,
+		}
+	}
+
+	// 1. Scan directory for backup files
+	err := filepath.WalkDir(cfg.LocalDir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		name, ts, _, ok := parseBackupName(d.Name())
+		if !ok || (params.Name != "" && name != params.Name) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(cfg.LocalDir, path)
+		if err != nil {
+			return err
+		}
+		file := filepath.ToSlash(relPath)
+		names[file] = name
+		add(file, ts, info.Size(), "local")
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan directory: %v", err)
+	}
+
+	// 2. List bucket for backup objects
+	prefix := cfg.RemoteDir + "/"
+	objects, err := storageService.List(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	for _, obj := range objects {
+		name, ts, _, ok := parseBackupName(path.Base(obj.Key))
+		if !ok || (params.Name != "" && name != params.Name) {
+			continue
+		}
+		file := strings.TrimPrefix(obj.Key, prefix)
+		names[file] = name
+		add(file, ts, obj.Size, "remote")
+	}
+
+	// 3. Group by database or directory
+	lists := map[string]*BackupList{}
+	for _, target := range backupTargets(cfg) {
+		if params.Name == "" || target.Name == params.Name {
+			lists[target.Name] = &BackupList{Name: target.Name}
+		}
+	}
+	for file, b := range backups {
+		name := names[file]
+		list, ok := lists[name]
+		if !ok {
+			list = &BackupList{Name: name}
+			lists[name] = list
+		}
+		list.Backups = append(list.Backups, *b)
+	}
+	if params.Name != "" && len(lists) == 0 {
+		return nil, fmt.Errorf("%s is not configured and has no backups", params.Name)
+	}
+
+	now := time.Now()
+	result := make([]BackupList, 0, len(lists))
+	for _, list := range lists {
+		sort.Slice(list.Backups, func(i, j int) bool {
+			return list.Backups[i].Timestamp.After(list.Backups[j].Timestamp)
+		})
+		if len(list.Backups) > 0 {
+			latest := list.Backups[0].Timestamp
+			list.Latest = &latest
+			list.LatestAge = now.Sub(latest)
+			list.LatestAgeSeconds = int64(list.LatestAge.Seconds())
+		}
+		result = append(result, *list)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	return result, nil
+}
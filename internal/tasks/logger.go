@@ -0,0 +1,52 @@
+package tasks
+
+import (
+	"bytes"
+	"log"
+	"sync"
+)
+
+// newDBLogger returns a logger that prefixes every line with the database
+// name, so the output of parallel dumps can be told apart.
+func newDBLogger(dbName string) *log.Logger {
+	return log.New(log.Writer(), "["+dbName+"] ", log.Flags()|log.Lmsgprefix)
+}
+
+// lineWriter forwards complete lines written to it to a logger, so the
+// stderr of concurrent commands doesn't interleave mid-line.
+type lineWriter struct {
+	mu     sync.Mutex
+	logger *log.Logger
+	buf    []byte
+}
+
+func newLineWriter(logger *log.Logger) *lineWriter {
+	return &lineWriter{logger: logger}
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		w.logger.Println(string(w.buf[:i]))
+		w.buf = w.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+// Flush logs a trailing line without newline.
+func (w *lineWriter) Flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if len(w.buf) > 0 {
+		w.logger.Println(string(w.buf))
+		w.buf = nil
+	}
+}
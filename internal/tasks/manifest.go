@@ -0,0 +1,194 @@
+package tasks
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const manifestPrefix = "manifest_"
+
+// Manifest records what a backup run produced.
+type Manifest struct {
+	StartedAt  time.Time      `json:"started_at"`
+	FinishedAt time.Time      `json:"finished_at"`
+	Files      []ManifestFile `json:"files"`
+}
+
+type ManifestFile struct {
+	Name          string    `json:"name"`
+	Database      string    `json:"database"`
+	DatabaseType  string    `json:"database_type"`
+	DumperVersion string    `json:"dumper_version"`
+	Size          int64     `json:"size"`
+	SHA256        string    `json:"sha256"`
+	S3Key         string    `json:"s3_key"`
+	StartedAt     time.Time `json:"started_at"`
+	FinishedAt    time.Time `json:"finished_at"`
+}
+
+// manifestName returns the filename of the manifest of a run started at t.
+// Runs started in the same second, e.g. by the daemon, are told apart by n.
+func manifestName(t time.Time, n int) string {
+	if n > 0 {
+		return fmt.Sprintf("%s%s.%d.json", manifestPrefix, t.Format(BackupTimeFormat), n)
+	}
+	return manifestPrefix + t.Format(BackupTimeFormat) + ".json"
+}
+
+// parseManifestName parses a filename written by manifestName.
+func parseManifestName(name string) (time.Time, int, bool) {
+	rest, found := strings.CutPrefix(name, manifestPrefix)
+	if !found {
+		return time.Time{}, 0, false
+	}
+	rest, found = strings.CutSuffix(rest, ".json")
+	if !found || len(rest) < len(BackupTimeFormat) {
+		return time.Time{}, 0, false
+	}
+	ts, err := time.Parse(BackupTimeFormat, rest[:len(BackupTimeFormat)])
+	if err != nil {
+		return time.Time{}, 0, false
+	}
+
+	n := 0
+	if suffix := rest[len(BackupTimeFormat):]; suffix != "" {
+		digits, found := strings.CutPrefix(suffix, ".")
+		if !found {
+			return time.Time{}, 0, false
+		}
+		n, err = strconv.Atoi(digits)
+		if err != nil || n < 1 {
+			return time.Time{}, 0, false
+		}
+	}
+	return ts, n, true
+}
+
+// isManifestName reports whether name is a manifest filename.
+func isManifestName(name string) bool {
+	_, _, ok := parseManifestName(name)
+	return ok
+}
+
+// latestManifestKey returns the newest manifest key among keys.
+func latestManifestKey(keys []string) (string, bool) {
+	var (
+		latest   string
+		latestTs time.Time
+		latestN  int
+	)
+	for _, key := range keys {
+		ts, n, ok := parseManifestName(path.Base(key))
+		if !ok {
+			continue
+		}
+		if latest == "" || ts.After(latestTs) || (ts.Equal(latestTs) && n > latestN) {
+			latest, latestTs, latestN = key, ts, n
+		}
+	}
+	return latest, latest != ""
+}
+
+// manifestObsolete reports whether none of the backups m lists are left among
+// remaining, the filenames of the existing backups. A listed backup only
+// counts as deleted if a newer backup of its database remains, so manifests
+// of dumps streamed without a local copy aren't pruned from local_dir.
+func manifestObsolete(m *Manifest, remaining []string) bool {
+	exists := map[string]bool{}
+	newest := map[string]time.Time{}
+	for _, name := range remaining {
+		exists[name] = true
+		if dbName, ts, _, ok := parseBackupName(name); ok && ts.After(newest[dbName]) {
+			newest[dbName] = ts
+		}
+	}
+
+	for _, f := range m.Files {
+		if exists[f.Name] {
+			return false
+		}
+		dbName, ts, _, ok := parseBackupName(f.Name)
+		if !ok || !newest[dbName].After(ts) {
+			return false
+		}
+	}
+	return true
+}
+
+// decodeManifest reads a manifest written by writeManifest.
+func decodeManifest(r io.Reader) (*Manifest, error) {
+	var manifest Manifest
+	if err := json.NewDecoder(r).Decode(&manifest); err != nil {
+		return nil, fmt.Errorf("failed to decode manifest: %v", err)
+	}
+	return &manifest, nil
+}
+
+func writeManifest(localDir string, m *Manifest) (string, error) {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("failed to encode manifest: %v", err)
+	}
+
+	// Write under a temporary name so a concurrent upload never picks up a
+	// partial manifest, then link it to the first free name
+	partialFile, err := os.CreateTemp(localDir, manifestPrefix+"*.json"+partialFileExt)
+	if err != nil {
+		return "", fmt.Errorf("failed to write manifest: %v", err)
+	}
+	partialFilename := partialFile.Name()
+	defer os.Remove(partialFilename)
+
+	_, err = partialFile.Write(data)
+	if closeErr := partialFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(partialFilename, 0644)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to write manifest: %v", err)
+	}
+
+	for n := 0; ; n++ {
+		filename := filepath.Join(localDir, manifestName(m.StartedAt, n))
+		err := os.Link(partialFilename, filename)
+		if os.IsExist(err) {
+			continue
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to write manifest: %v", err)
+		}
+		return filename, nil
+	}
+}
+
+// checksumWriter counts and hashes everything written to it.
+type checksumWriter struct {
+	hash hash.Hash
+	size int64
+}
+
+func newChecksumWriter() *checksumWriter {
+	return &checksumWriter{hash: sha256.New()}
+}
+
+func (w *checksumWriter) Write(p []byte) (int, error) {
+	n, err := w.hash.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *checksumWriter) Sum() string {
+	return hex.EncodeToString(w.hash.Sum(nil))
+}
@@ -0,0 +1,90 @@
+package tasks
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLatestManifestKey(t *testing.T) {
+	tests := []struct {
+		name string
+		keys []string
+		want string
+	}{
+		{
+			name: "newest timestamp",
+			keys: []string{"r/manifest_20240101-020000.json", "r/manifest_20240102-020000.json", "r/manifest_20231231-020000.json"},
+			want: "r/manifest_20240102-020000.json",
+		},
+		{
+			name: "same second",
+			keys: []string{"r/manifest_20240101-020000.1.json", "r/manifest_20240101-020000.json"},
+			want: "r/manifest_20240101-020000.1.json",
+		},
+		{
+			name: "numeric suffix",
+			keys: []string{"r/manifest_20240101-020000.10.json", "r/manifest_20240101-020000.2.json"},
+			want: "r/manifest_20240101-020000.10.json",
+		},
+		{
+			name: "other objects",
+			keys: []string{"r/mydb_20250101-020000.sql.gz", "r/manifest_20240101-020000.json", "r/manifest_20240101-020000.x.json"},
+			want: "r/manifest_20240101-020000.json",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := latestManifestKey(tt.keys)
+			if !ok || got != tt.want {
+				t.Errorf("latestManifestKey() = %q, %v, want %q", got, ok, tt.want)
+			}
+		})
+	}
+
+	if _, ok := latestManifestKey([]string{"r/mydb_20250101-020000.sql.gz"}); ok {
+		t.Error("latestManifestKey() found a manifest among backups")
+	}
+}
+
+func TestManifestObsolete(t *testing.T) {
+	m := &Manifest{
+		StartedAt: time.Date(2024, 1, 1, 2, 0, 0, 0, time.UTC),
+		Files: []ManifestFile{
+			{Name: "a_20240101-020000.sql.gz"},
+			{Name: "b_20240101-020001.sql.gz"},
+		},
+	}
+	tests := []struct {
+		name      string
+		remaining []string
+		want      bool
+	}{
+		{
+			name:      "all deleted",
+			remaining: []string{"a_20240102-020000.sql.gz", "b_20240102-020000.sql.gz"},
+			want:      true,
+		},
+		{
+			name:      "one left",
+			remaining: []string{"a_20240102-020000.sql.gz", "b_20240101-020001.sql.gz", "b_20240102-020000.sql.gz"},
+			want:      false,
+		},
+		{
+			name:      "never stored",
+			remaining: []string{"a_20240102-020000.sql.gz"},
+			want:      false,
+		},
+		{
+			name:      "nothing left",
+			remaining: nil,
+			want:      false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := manifestObsolete(m, tt.remaining); got != tt.want {
+				t.Errorf("manifestObsolete() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
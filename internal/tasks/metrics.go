@@ -0,0 +1,28 @@
+package tasks
+
+import (
+	"github.com/fidrasofyan/db-backup/internal/config"
+	"github.com/fidrasofyan/db-backup/internal/metrics"
+	"github.com/fidrasofyan/db-backup/internal/report"
+)
+
+// WriteMetricsTextfile records run in metrics.textfile. The last success time
+// of databases that failed in this run is carried over from the existing file.
+func WriteMetricsTextfile(cfg *config.Config, run *report.Run) error {
+	registry := metrics.NewRegistry()
+	if err := registry.LoadTextfile(cfg.Metrics.Textfile); err != nil {
+		return err
+	}
+	registry.Record(run)
+	registry.Prune(backupNames(cfg))
+	return registry.WriteTextfile(cfg.Metrics.Textfile)
+}
+
+// backupNames returns the names of the configured databases and directories.
+func backupNames(cfg *config.Config) []string {
+	var names []string
+	for _, target := range backupTargets(cfg) {
+		names = append(names, target.Name)
+	}
+	return names
+}
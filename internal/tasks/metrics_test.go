@@ -0,0 +1,94 @@
+package tasks
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fidrasofyan/db-backup/internal/config"
+	"github.com/fidrasofyan/db-backup/internal/report"
+)
+
+// recordRun returns a run in which name finished with success.
+func recordRun(name string, success bool, size int64) *report.Run {
+	run := report.New()
+	run.Update(name, func(d *report.Database) {
+		d.StartedAt = run.StartedAt
+		d.FinishedAt = run.StartedAt.Add(time.Minute)
+		d.Success = success
+		d.DumpSize = size
+		if !success {
+			d.Error = "dump failed"
+		}
+	})
+	return run
+}
+
+// metricValue returns the value of metric for database name in the textfile.
+func metricValue(t *testing.T, path, metric, name string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prefix := metric + `{database="` + name + `"} `
+	for _, line := range strings.Split(string(data), "\n") {
+		if value, found := strings.CutPrefix(line, prefix); found {
+			return value
+		}
+	}
+	t.Fatalf("no %s for %s in %s", metric, name, data)
+	return ""
+}
+
+func TestWriteMetricsTextfileKeepsOtherCommands(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.BackupDirs = []config.BackupDirConfig{{Name: "uploads"}}
+	cfg.Metrics.Textfile = filepath.Join(t.TempDir(), "db_backup.prom")
+
+	// backup-db, then backup-dir sharing the textfile
+	if err := WriteMetricsTextfile(cfg, recordRun("app", true, 2048)); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteMetricsTextfile(cfg, recordRun("uploads", true, 512)); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct{ metric, name, want string }{
+		{"db_backup_last_run_success", "app", "1"},
+		{"db_backup_dump_size_bytes", "app", "2048"},
+		{"db_backup_duration_seconds", "app", "60"},
+		{"db_backup_last_run_success", "uploads", "1"},
+		{"db_backup_dump_size_bytes", "uploads", "512"},
+	} {
+		if got := metricValue(t, cfg.Metrics.Textfile, tt.metric, tt.name); got != tt.want {
+			t.Errorf("%s for %s = %s, want %s", tt.metric, tt.name, got, tt.want)
+		}
+	}
+	lastSuccess := metricValue(t, cfg.Metrics.Textfile, "db_backup_last_success_timestamp_seconds", "app")
+	if lastSuccess == "0" {
+		t.Fatal("last success time of app was reset")
+	}
+
+	// A failed run keeps the last success time
+	if err := WriteMetricsTextfile(cfg, recordRun("app", false, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if got := metricValue(t, cfg.Metrics.Textfile, "db_backup_last_run_success", "app"); got != "0" {
+		t.Errorf("db_backup_last_run_success for app = %s, want 0", got)
+	}
+	if got := metricValue(t, cfg.Metrics.Textfile, "db_backup_last_success_timestamp_seconds", "app"); got != lastSuccess {
+		t.Errorf("last success time of app = %s, want %s", got, lastSuccess)
+	}
+
+	// Databases removed from the config are dropped
+	cfg.BackupDirs = nil
+	if err := WriteMetricsTextfile(cfg, recordRun("app", true, 2048)); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(cfg.Metrics.Textfile); strings.Contains(string(data), "uploads") {
+		t.Errorf("removed directory still exported:\n%s", data)
+	}
+}
@@ -0,0 +1,28 @@
+package tasks
+
+import (
+	"context"
+	"time"
+
+	"github.com/fidrasofyan/db-backup/internal/config"
+	"github.com/fidrasofyan/db-backup/internal/notify"
+	"github.com/fidrasofyan/db-backup/internal/report"
+)
+
+// SendNotifications sends the run report to the configured sinks. It uses its
+// own timeout, since the run's context may be the reason the run failed.
+func SendNotifications(cfg *config.Config, run *report.Run) error {
+	if len(cfg.Notifications) == 0 {
+		return nil
+	}
+
+	dispatcher, err := notify.New(cfg.Notifications)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+
+	return dispatcher.Notify(ctx, run.Summary())
+}
@@ -0,0 +1,166 @@
+package tasks
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/fidrasofyan/db-backup/internal/config"
+	"github.com/fidrasofyan/db-backup/internal/dumper"
+	"github.com/fidrasofyan/db-backup/internal/encryption"
+	"github.com/fidrasofyan/db-backup/internal/service"
+)
+
+type RemoteBackup struct {
+	Key       string
+	Size      int64
+	Timestamp time.Time
+	Ext       string
+}
+
+type RestoreDBParams struct {
+	// DBName selects the backup_db entry whose backups are restored
+	DBName string
+	// At is either "latest" or a timestamp in the YYYYMMDD-HHMMSS format
+	At string
+	// TargetDB is the database to restore into. Defaults to DBName.
+	TargetDB string
+}
+
+// ListRemoteBackups returns the backups of dbName found under remote_dir,
+// newest first.
+func ListRemoteBackups(ctx context.Context, cfg *config.Config, storageService service.Backend, dbName string) ([]RemoteBackup, error) {
+	objects, err := storageService.List(ctx, cfg.RemoteDir+"/")
+	if err != nil {
+		return nil, err
+	}
+
+	var backups []RemoteBackup
+	for _, obj := range objects {
+		name, ts, ext, ok := parseBackupName(path.Base(obj.Key))
+		if !ok || name != dbName {
+			continue
+		}
+		backups = append(backups, RemoteBackup{
+			Key:       obj.Key,
+			Size:      obj.Size,
+			Timestamp: ts,
+			Ext:       ext,
+		})
+	}
+
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].Timestamp.After(backups[j].Timestamp)
+	})
+
+	return backups, nil
+}
+
+func RestoreDB(ctx context.Context, cfg *config.Config, storageService service.Backend, params *RestoreDBParams) error {
+	dbConfig, err := findDBConfig(cfg, params.DBName)
+	if err != nil {
+		return err
+	}
+
+	targetDB := params.TargetDB
+	if targetDB == "" {
+		targetDB = dbConfig.DBName
+	}
+
+	// Pick backup
+	backups, err := ListRemoteBackups(ctx, cfg, storageService, dbConfig.DBName)
+	if err != nil {
+		return err
+	}
+	backup, err := selectBackup(backups, params.At)
+	if err != nil {
+		return err
+	}
+
+	// Prerequisites
+	enc, err := encryption.New(cfg.Encryption)
+	if err != nil {
+		return err
+	}
+	d, err := dumper.Get(dbConfig.Type)
+	if err != nil {
+		return err
+	}
+	restorer, ok := d.(dumper.Restorer)
+	if !ok {
+		return fmt.Errorf("restore is not supported for database type %s", dbConfig.Type)
+	}
+	createCmd, cmd, err := restorer.RestoreCommands(ctx, dbConfig, targetDB, dumpExt(backup.Ext))
+	if err != nil {
+		return err
+	}
+
+	log.Printf("restoring %s into database: %s:%s/%s\n", backup.Key, dbConfig.Host, dbConfig.Port, targetDB)
+
+	// Create target database if it doesn't exist yet
+	createCmd.Stderr = os.Stderr
+	if err := createCmd.Run(); err != nil {
+		return fmt.Errorf("restore db failed: failed to create database %s: %v", targetDB, err)
+	}
+
+	// Download and decompress on the fly
+	body, err := storageService.Get(ctx, backup.Key)
+	if err != nil {
+		return fmt.Errorf("restore db failed: %v", err)
+	}
+	defer body.Close()
+
+	dumpReader, err := openBackupReader(body, backup.Ext, enc)
+	if err != nil {
+		return fmt.Errorf("restore db failed: %v", err)
+	}
+	defer dumpReader.Close()
+
+	// Restore
+	cmd.Stdin = dumpReader
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("restore db failed: %v", err)
+	}
+
+	log.Println("restore database complete!")
+	return nil
+}
+
+func findDBConfig(cfg *config.Config, dbName string) (config.BackupDBConfig, error) {
+	for _, dbConfig := range cfg.DBConfigurations {
+		if dbConfig.DBName == dbName {
+			return dbConfig, nil
+		}
+	}
+	return config.BackupDBConfig{}, fmt.Errorf("database %s is not configured in backup_db", dbName)
+}
+
+// selectBackup picks the backup matching at from backups sorted newest first.
+func selectBackup(backups []RemoteBackup, at string) (RemoteBackup, error) {
+	if len(backups) == 0 {
+		return RemoteBackup{}, fmt.Errorf("no backups found")
+	}
+
+	if at == "" || at == "latest" {
+		return backups[0], nil
+	}
+
+	ts, err := time.ParseInLocation(BackupTimeFormat, at, time.Local)
+	if err != nil {
+		return RemoteBackup{}, fmt.Errorf("invalid timestamp %s: expected latest or YYYYMMDD-HHMMSS", at)
+	}
+	for _, b := range backups {
+		if b.Timestamp.Equal(ts) {
+			return b, nil
+		}
+	}
+
+	return RemoteBackup{}, fmt.Errorf("no backup found at %s", at)
+}
@@ -0,0 +1,136 @@
+package tasks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/fidrasofyan/db-backup/internal/config"
+	"github.com/fidrasofyan/db-backup/internal/report"
+)
+
+type RunBackupParams struct {
+	// Keep overrides the retention config, see DeleteOldBackup
+	Keep     int
+	NoUpload bool
+	// UploadLock, if set, is held during retention and upload, which work on
+	// all of local_dir rather than only the backups of the run
+	UploadLock sync.Locker
+}
+
+// RunBackup dumps every configured database and archives every configured
+// directory, applies retention and uploads
+// the results to every destination, in the order required by
+// cfg.RetentionMode. Databases whose dump failed are skipped by retention
+// while the others are still rotated and uploaded. Failures of optional
+// destinations are only reported as warnings. The returned report is complete
+// even when an error is returned.
+func RunBackup(ctx context.Context, cfg *config.Config, dests Destinations, params *RunBackupParams) (*report.Run, error) {
+	run := report.New()
+	dbErr, err := runBackup(ctx, cfg, dests, params, run)
+
+	// A database succeeded if its dump and the rest of the pipeline did;
+	// databases that didn't fail themselves inherit the pipeline's error
+	for _, name := range backupNames(cfg) {
+		run.Update(name, func(d *report.Database) {
+			if d.Error == "" && err != nil {
+				d.Error = err.Error()
+			}
+			d.Success = d.Error == ""
+		})
+	}
+
+	err = errors.Join(dbErr, err)
+	run.Finish(err)
+
+	return run, err
+}
+
+// runBackup returns the failures of individual databases separately from
+// errors that stopped the pipeline.
+func runBackup(ctx context.Context, cfg *config.Config, dests Destinations, params *RunBackupParams, run *report.Run) (error, error) {
+	// Start backup
+	var dbErr *DatabasesFailedError
+	if err := Backup(ctx, cfg, dests.Primary().Backend, run); err != nil && !errors.As(err, &dbErr) {
+		return nil, err
+	}
+	// Avoid returning a non-nil error interface holding a nil pointer
+	var backupErr error
+	if dbErr != nil {
+		backupErr = dbErr
+	}
+
+	if params.UploadLock != nil {
+		params.UploadLock.Lock()
+		defer params.UploadLock.Unlock()
+	}
+
+	// Local retention runs before the upload. Remote retention works from
+	// the bucket listing, so it runs after the new backups are uploaded.
+	if cfg.RetentionMode != "remote" {
+		// Delete old backup
+		if err := DeleteOldBackup(ctx, cfg, dests, params.Keep, run); err != nil {
+			return backupErr, err
+		}
+	}
+
+	err := replicate(dests, run, func(dest *Destination) error {
+		// Upload
+		if !params.NoUpload {
+			if err := Upload(ctx, cfg, dest, run); err != nil {
+				return err
+			}
+		}
+
+		// Destinations with their own retention are pruned from their
+		// listing in either mode
+		if cfg.RetentionMode == "remote" || dest.Retention != nil {
+			if err := deleteOldRemoteBackup(ctx, cfg, dests, dest, params.Keep, run); err != nil {
+				return err
+			}
+		}
+
+		// Chunks of deleted snapshots are only freed once no snapshot uses
+		// them
+		if dest.primary && !params.NoUpload && hasSnapshotDeletions(cfg, run) {
+			if err := pruneChunks(ctx, cfg, dest.Backend); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return backupErr, err
+}
+
+// replicate calls fn for every destination and records its outcome in run.
+// The failures of required destinations are returned joined, those of
+// optional ones are logged as warnings.
+func replicate(dests Destinations, run *report.Run, fn func(dest *Destination) error) error {
+	var errs []error
+	for _, dest := range dests {
+		err := fn(dest)
+		run.UpdateDestination(dest.Name, func(d *report.Destination) {
+			d.Optional = dest.Optional()
+			d.Success = err == nil
+			if err != nil {
+				d.Error = err.Error()
+			}
+		})
+		if err == nil {
+			continue
+		}
+
+		// Only name the destination if there is more than one
+		if len(dests) > 1 {
+			err = fmt.Errorf("destination %s: %w", dest.Name, err)
+		}
+		if dest.Optional() {
+			log.Printf("Warning: %v\n", err)
+			continue
+		}
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,586 @@
+package tasks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/fidrasofyan/db-backup/internal/chunker"
+	"github.com/fidrasofyan/db-backup/internal/compression"
+	"github.com/fidrasofyan/db-backup/internal/config"
+	"github.com/fidrasofyan/db-backup/internal/encryption"
+	"github.com/fidrasofyan/db-backup/internal/report"
+	"github.com/fidrasofyan/db-backup/internal/service"
+	"golang.org/x/sync/errgroup"
+)
+
+// snapshotFileExt is the extension of snapshot indexes, before compression
+// and encryption
+const snapshotFileExt = ".snapshot"
+
+// chunksDir holds the chunks of all snapshots under remote_dir
+const chunksDir = "chunks"
+
+// chunkGracePeriod protects chunks uploaded by a run whose index isn't
+// uploaded yet from being pruned
+const chunkGracePeriod = 24 * time.Hour
+
+// Snapshot is the index of a snapshot: the files of a backup_dirs entry and
+// the chunks holding their content.
+type Snapshot struct {
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+	Paths     []string  `json:"paths"`
+	// ChunkExt is the compression and encryption extension of the chunks
+	ChunkExt string         `json:"chunk_ext"`
+	Files    []SnapshotFile `json:"files"`
+}
+
+type SnapshotFile struct {
+	// Path is the absolute path without the leading slash
+	Path    string      `json:"path"`
+	Mode    os.FileMode `json:"mode"`
+	ModTime time.Time   `json:"mod_time"`
+	Size    int64       `json:"size,omitempty"`
+	// Link is the target of symlinks
+	Link string `json:"link,omitempty"`
+	// Chunks are the SHA-256 hashes of the file's content chunks, in order
+	Chunks []string `json:"chunks,omitempty"`
+	// ChunkIDs name the chunk objects of encrypted snapshots, in the order of
+	// Chunks. Chunks name them otherwise.
+	ChunkIDs []string `json:"chunk_ids,omitempty"`
+}
+
+// chunkIDs returns the names of the chunk objects of f.
+func (f SnapshotFile) chunkIDs() []string {
+	if len(f.ChunkIDs) > 0 {
+		return f.ChunkIDs
+	}
+	return f.Chunks
+}
+
+func chunkKey(cfg *config.Config, id, ext string) string {
+	return fmt.Sprintf("%s/%s/%s%s", cfg.RemoteDir, chunksDir, id, ext)
+}
+
+// chunkID returns the object name of the chunk with the SHA-256 hash. With a
+// content key, it is a keyed hash, so listing the bucket doesn't tell whether
+// it holds a known file.
+func chunkID(contentKey []byte, hash string) string {
+	if contentKey == nil {
+		return hash
+	}
+	mac := hmac.New(sha256.New, contentKey)
+	mac.Write([]byte(hash))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// isSnapshotName reports whether name is a snapshot index filename.
+func isSnapshotName(name string) bool {
+	_, _, ext, ok := parseBackupName(name)
+	return ok && dumpExt(ext) == snapshotFileExt
+}
+
+// backupDirSnapshot uploads the chunks of the files of dirConfig that aren't
+// stored yet and writes the snapshot index like an archive.
+func backupDirSnapshot(ctx context.Context, comp compression.Compressor, enc encryption.Encryptor, cfg *config.Config, storageService service.Backend, dirConfig config.BackupDirConfig, walker *dirWalker, logger *log.Logger) (*ManifestFile, error) {
+	startedAt := time.Now()
+	logger.Printf("snapshotting directories: %s\n", strings.Join(dirConfig.Paths, ", "))
+
+	chunkExt := comp.Extension()
+	var contentKey []byte
+	if enc != nil {
+		chunkExt += enc.Extension()
+		key, err := enc.ContentKey()
+		if err != nil {
+			return nil, err
+		}
+		contentKey = key
+	}
+
+	// Chunks already stored by any snapshot
+	objects, err := storageService.List(ctx, cfg.RemoteDir+"/"+chunksDir+"/")
+	if err != nil {
+		return nil, err
+	}
+	known := make(map[string]bool, len(objects))
+	for _, obj := range objects {
+		known[obj.Key] = true
+	}
+
+	// Files unchanged since the previous snapshot reuse its chunks without
+	// being read
+	previous := map[string]SnapshotFile{}
+	prev, err := latestSnapshot(ctx, cfg, storageService, enc, dirConfig.Name)
+	if err != nil {
+		logger.Printf("Warning: failed to load previous snapshot, reading all files: %v\n", err)
+	}
+	if prev != nil && prev.ChunkExt == chunkExt {
+		for _, f := range prev.Files {
+			previous[f.Path] = f
+		}
+	}
+
+	snapshot := &Snapshot{
+		Name:      dirConfig.Name,
+		CreatedAt: startedAt,
+		Paths:     dirConfig.Paths,
+		ChunkExt:  chunkExt,
+	}
+
+	var (
+		newChunks int64
+		newBytes  int64
+		reused    int
+	)
+
+	// Chunks are small single part uploads, one per file slot
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(cfg.UploadConcurrency)
+
+	err = walker.walk(func(path string, info os.FileInfo, link string) error {
+		file := SnapshotFile{
+			Path:    entryName(path),
+			Mode:    info.Mode(),
+			ModTime: info.ModTime(),
+			Link:    link,
+		}
+		if !info.Mode().IsRegular() {
+			snapshot.Files = append(snapshot.Files, file)
+			return nil
+		}
+
+		if p, ok := previous[file.Path]; ok && p.Size == info.Size() && p.ModTime.Equal(info.ModTime()) && p.Mode == info.Mode() {
+			stored := true
+			for _, id := range p.chunkIDs() {
+				if !known[chunkKey(cfg, id, chunkExt)] {
+					stored = false
+					break
+				}
+			}
+			if stored {
+				file.Size = p.Size
+				file.Chunks = p.Chunks
+				file.ChunkIDs = p.ChunkIDs
+				snapshot.Files = append(snapshot.Files, file)
+				reused++
+				return nil
+			}
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			// Files may disappear while the directory is walked
+			if os.IsNotExist(err) {
+				logger.Printf("Warning: skipping %s: %v\n", path, err)
+				return nil
+			}
+			return err
+		}
+		defer f.Close()
+
+		c := chunker.New(f)
+		for {
+			chunk, err := c.Next()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				return fmt.Errorf("failed to read %s: %v", path, err)
+			}
+
+			sum := sha256.Sum256(chunk)
+			hash := hex.EncodeToString(sum[:])
+			id := chunkID(contentKey, hash)
+			file.Chunks = append(file.Chunks, hash)
+			if contentKey != nil {
+				file.ChunkIDs = append(file.ChunkIDs, id)
+			}
+			file.Size += int64(len(chunk))
+
+			key := chunkKey(cfg, id, chunkExt)
+			if known[key] {
+				continue
+			}
+			known[key] = true
+
+			// The chunker reuses its buffer
+			data := bytes.Clone(chunk)
+			g.Go(func() error {
+				sealed, err := sealChunk(data, comp, enc)
+				if err != nil {
+					return err
+				}
+				if err := storageService.Put(gctx, key, sealed); err != nil {
+					return fmt.Errorf("failed to upload chunk %s: %v", key, err)
+				}
+				atomic.AddInt64(&newChunks, 1)
+				atomic.AddInt64(&newBytes, int64(len(sealed)))
+				return nil
+			})
+
+			// Stop reading once an upload failed
+			if err := gctx.Err(); err != nil {
+				return err
+			}
+		}
+
+		snapshot.Files = append(snapshot.Files, file)
+		return nil
+	})
+	if waitErr := g.Wait(); err == nil {
+		err = waitErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("snapshot failed: %v", err)
+	}
+
+	logger.Printf("files: %d | unchanged: %d | new chunks: %d (%d bytes)\n", len(snapshot.Files), reused, newChunks, newBytes)
+
+	// Store the index like an archive, so it is named, rotated and uploaded
+	// the same way
+	name := fmt.Sprintf(
+		"%s_%s%s%s",
+		dirConfig.Name,
+		startedAt.Format(BackupTimeFormat),
+		snapshotFileExt,
+		comp.Extension(),
+	)
+	file, err := writeBackup(ctx, cfg, storageService, comp, enc, name, logger, func(w io.Writer) error {
+		return json.NewEncoder(w).Encode(snapshot)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("snapshot failed: failed to write index: %v", err)
+	}
+
+	file.Database = dirConfig.Name
+	file.DatabaseType = "snapshot"
+	file.StartedAt = startedAt
+	return file, nil
+}
+
+// sealChunk compresses and encrypts a chunk like a backup stream.
+func sealChunk(data []byte, comp compression.Compressor, enc encryption.Encryptor) ([]byte, error) {
+	var buf bytes.Buffer
+	var out io.Writer = &buf
+
+	var encWriter io.WriteCloser
+	if enc != nil {
+		var err error
+		encWriter, err = enc.Encrypt(&buf)
+		if err != nil {
+			return nil, err
+		}
+		out = encWriter
+	}
+	compWriter, err := comp.Compress(out)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := compWriter.Write(data); err != nil {
+		return nil, err
+	}
+	if err := compWriter.Close(); err != nil {
+		return nil, err
+	}
+	if encWriter != nil {
+		if err := encWriter.Close(); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// latestSnapshot loads the newest snapshot of name from remote_dir, or nil if
+// there is none.
+func latestSnapshot(ctx context.Context, cfg *config.Config, storageService service.Backend, enc encryption.Encryptor, name string) (*Snapshot, error) {
+	backups, err := ListSnapshots(ctx, cfg, storageService, name)
+	if err != nil || len(backups) == 0 {
+		return nil, err
+	}
+	return loadSnapshot(ctx, cfg, storageService, enc, backups[0])
+}
+
+// ListSnapshots returns the snapshot indexes of name under remote_dir,
+// newest first.
+func ListSnapshots(ctx context.Context, cfg *config.Config, storageService service.Backend, name string) ([]RemoteBackup, error) {
+	backups, err := ListRemoteBackups(ctx, cfg, storageService, name)
+	if err != nil {
+		return nil, err
+	}
+	var snapshots []RemoteBackup
+	for _, b := range backups {
+		if dumpExt(b.Ext) == snapshotFileExt {
+			snapshots = append(snapshots, b)
+		}
+	}
+	return snapshots, nil
+}
+
+func loadSnapshot(ctx context.Context, cfg *config.Config, storageService service.Backend, enc encryption.Encryptor, backup RemoteBackup) (*Snapshot, error) {
+	body, err := storageService.Get(ctx, backup.Key)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	r, err := openBackupReader(body, backup.Ext, enc)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	var snapshot Snapshot
+	if err := json.NewDecoder(r).Decode(&snapshot); err != nil {
+		return nil, fmt.Errorf("failed to read snapshot %s: %v", backup.Key, err)
+	}
+	return &snapshot, nil
+}
+
+// hasSnapshotDeletions reports whether retention deleted snapshots in run.
+func hasSnapshotDeletions(cfg *config.Config, run *report.Run) bool {
+	deleted := map[string]int{}
+	for _, d := range run.Databases() {
+		deleted[d.Name] = d.Deleted
+	}
+	for _, dirConfig := range cfg.BackupDirs {
+		if dirConfig.Mode == "snapshot" && deleted[dirConfig.Name] > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// pruneChunks deletes the chunks no snapshot under remote_dir refers to,
+// including snapshots of other hosts. Recent chunks are kept, as the index
+// referring to them may not be uploaded yet.
+func pruneChunks(ctx context.Context, cfg *config.Config, storageService service.Backend) error {
+	enc, err := encryption.New(cfg.Encryption)
+	if err != nil {
+		return err
+	}
+
+	objects, err := storageService.List(ctx, cfg.RemoteDir+"/")
+	if err != nil {
+		return err
+	}
+
+	// Any unreadable index aborts the prune, as its chunks would be lost
+	referenced := map[string]bool{}
+	chunkPrefix := cfg.RemoteDir + "/" + chunksDir + "/"
+	var chunks []service.Object
+	for _, obj := range objects {
+		if path.Dir(obj.Key)+"/" == chunkPrefix {
+			chunks = append(chunks, obj)
+			continue
+		}
+		if !isSnapshotName(path.Base(obj.Key)) {
+			continue
+		}
+		_, ts, ext, _ := parseBackupName(path.Base(obj.Key))
+		snapshot, err := loadSnapshot(ctx, cfg, storageService, enc, RemoteBackup{Key: obj.Key, Size: obj.Size, Timestamp: ts, Ext: ext})
+		if err != nil {
+			return fmt.Errorf("failed to prune chunks: %v", err)
+		}
+		for _, f := range snapshot.Files {
+			for _, id := range f.chunkIDs() {
+				referenced[chunkKey(cfg, id, snapshot.ChunkExt)] = true
+			}
+		}
+	}
+
+	var keysToDelete []string
+	cutoff := time.Now().Add(-chunkGracePeriod)
+	for _, obj := range chunks {
+		if !referenced[obj.Key] && obj.LastModified.Before(cutoff) {
+			keysToDelete = append(keysToDelete, obj.Key)
+		}
+	}
+
+	if err := storageService.RemoveMany(ctx, keysToDelete); err != nil {
+		return fmt.Errorf("failed to prune chunks: %v", err)
+	}
+	log.Printf("pruned chunks: %d of %d\n", len(keysToDelete), len(chunks))
+	return nil
+}
+
+type RestoreSnapshotParams struct {
+	// Name selects the backup_dirs entry whose snapshots are restored
+	Name string
+	// At is either "latest" or a timestamp in the YYYYMMDD-HHMMSS format
+	At string
+	// Out is the directory the snapshot is restored into
+	Out string
+	// AllowUnsafeLinks restores symlinks with absolute targets or targets
+	// outside of Out, which are rejected otherwise
+	AllowUnsafeLinks bool
+}
+
+// RestoreSnapshot recreates the files of a snapshot under params.Out.
+func RestoreSnapshot(ctx context.Context, cfg *config.Config, storageService service.Backend, params *RestoreSnapshotParams) error {
+	snapshots, err := ListSnapshots(ctx, cfg, storageService, params.Name)
+	if err != nil {
+		return err
+	}
+	backup, err := selectBackup(snapshots, params.At)
+	if err != nil {
+		return err
+	}
+
+	enc, err := encryption.New(cfg.Encryption)
+	if err != nil {
+		return err
+	}
+	snapshot, err := loadSnapshot(ctx, cfg, storageService, enc, backup)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("restoring %s into: %s\n", backup.Key, params.Out)
+
+	// Every file is created through the root, which never resolves a path,
+	// including through restored symlinks, to outside of the output directory
+	if err := os.MkdirAll(params.Out, 0700); err != nil {
+		return fmt.Errorf("restore snapshot failed: %v", err)
+	}
+	root, err := os.OpenRoot(params.Out)
+	if err != nil {
+		return fmt.Errorf("restore snapshot failed: %v", err)
+	}
+	defer root.Close()
+
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(5)
+
+	var dirs []SnapshotFile
+	for _, f := range snapshot.Files {
+		target := filepath.FromSlash(f.Path)
+		if f.Path == "" {
+			target = "."
+		}
+		if !filepath.IsLocal(target) {
+			return fmt.Errorf("restore snapshot failed: invalid path %s", f.Path)
+		}
+
+		switch {
+		case f.Mode.IsDir():
+			// Directories are created before their contents, which are
+			// listed after them
+			if err := root.MkdirAll(target, 0700); err != nil {
+				return fmt.Errorf("restore snapshot failed: %v", err)
+			}
+			dirs = append(dirs, f)
+		case f.Mode&os.ModeSymlink != 0:
+			if !params.AllowUnsafeLinks && !isLocalLink(target, f.Link) {
+				return fmt.Errorf("restore snapshot failed: symlink %s points outside of the output directory: %s", f.Path, f.Link)
+			}
+			if err := root.MkdirAll(filepath.Dir(target), 0700); err != nil {
+				return fmt.Errorf("restore snapshot failed: %v", err)
+			}
+			if err := root.Symlink(f.Link, target); err != nil {
+				return fmt.Errorf("restore snapshot failed: %v", err)
+			}
+		case f.Mode.IsRegular():
+			g.Go(func() error {
+				return restoreSnapshotFile(gctx, cfg, storageService, enc, snapshot.ChunkExt, f, root, target)
+			})
+		default:
+			// The walker never stores other types, but an index may come
+			// from elsewhere
+			log.Printf("Warning: skipping %s: unsupported file type %s\n", f.Path, f.Mode.Type())
+		}
+	}
+	if err := g.Wait(); err != nil {
+		return fmt.Errorf("restore snapshot failed: %v", err)
+	}
+
+	// Set directory permissions last, so read-only directories can be filled
+	for i := len(dirs) - 1; i >= 0; i-- {
+		target := filepath.FromSlash(dirs[i].Path)
+		if dirs[i].Path == "" {
+			target = "."
+		}
+		if err := root.Chmod(target, dirs[i].Mode.Perm()); err != nil {
+			return fmt.Errorf("restore snapshot failed: %v", err)
+		}
+		if err := root.Chtimes(target, dirs[i].ModTime, dirs[i].ModTime); err != nil {
+			return fmt.Errorf("restore snapshot failed: %v", err)
+		}
+	}
+
+	log.Println("restore snapshot complete!")
+	return nil
+}
+
+// isLocalLink reports whether the symlink at path, relative to the output
+// directory, with target link resolves to within the output directory.
+func isLocalLink(path, link string) bool {
+	if filepath.IsAbs(link) {
+		return false
+	}
+	return filepath.IsLocal(filepath.Join(filepath.Dir(path), link))
+}
+
+func restoreSnapshotFile(ctx context.Context, cfg *config.Config, storageService service.Backend, enc encryption.Encryptor, chunkExt string, f SnapshotFile, root *os.Root, target string) error {
+	if err := root.MkdirAll(filepath.Dir(target), 0700); err != nil {
+		return err
+	}
+	out, err := root.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, f.Mode.Perm())
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	ids := f.chunkIDs()
+	if len(ids) != len(f.Chunks) {
+		return fmt.Errorf("invalid chunk list of %s", f.Path)
+	}
+	for i, hash := range f.Chunks {
+		key := chunkKey(cfg, ids[i], chunkExt)
+		if err := restoreChunk(ctx, cfg, storageService, enc, key, hash, chunkExt, out); err != nil {
+			return err
+		}
+	}
+
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return root.Chtimes(target, f.ModTime, f.ModTime)
+}
+
+// restoreChunk writes the content of a chunk to w, checking it against hash.
+func restoreChunk(ctx context.Context, cfg *config.Config, storageService service.Backend, enc encryption.Encryptor, key, hash, chunkExt string, w io.Writer) error {
+	body, err := storageService.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	r, err := openBackupReader(body, chunkExt, enc)
+	if err != nil {
+		return fmt.Errorf("chunk %s: %v", key, err)
+	}
+	defer r.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(w, h), r); err != nil {
+		return fmt.Errorf("chunk %s: %v", key, err)
+	}
+	if hex.EncodeToString(h.Sum(nil)) != hash {
+		return fmt.Errorf("chunk %s: checksum mismatch", key)
+	}
+	return nil
+}
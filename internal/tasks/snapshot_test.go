@@ -0,0 +1,52 @@
+package tasks
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fidrasofyan/db-backup/internal/config"
+	"github.com/fidrasofyan/db-backup/internal/service"
+)
+
+func TestRestoreSnapshotSkipsSpecialFiles(t *testing.T) {
+	ctx := context.Background()
+	cfg := testConfig(t)
+	cfg.BackupDirs = []config.BackupDirConfig{{Name: "uploads", Mode: "snapshot"}}
+	backend := service.NewMemoryBackend()
+
+	modTime := time.Date(2024, 1, 1, 2, 0, 0, 0, time.UTC)
+	data, err := json.Marshal(Snapshot{
+		Name: "uploads",
+		Files: []SnapshotFile{
+			{Path: "", Mode: os.ModeDir | 0o755, ModTime: modTime},
+			{Path: "empty.txt", Mode: 0o644, ModTime: modTime},
+			{Path: "fifo", Mode: os.ModeNamedPipe | 0o644, ModTime: modTime},
+			{Path: "tty", Mode: os.ModeDevice | os.ModeCharDevice | 0o600, ModTime: modTime},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := backend.Put(ctx, "backups/uploads_20240101-020000.snapshot", data); err != nil {
+		t.Fatal(err)
+	}
+
+	out := t.TempDir()
+	params := &RestoreSnapshotParams{Name: "uploads", At: "latest", Out: out}
+	if err := RestoreSnapshot(ctx, cfg, backend, params); err != nil {
+		t.Fatalf("RestoreSnapshot() = %v", err)
+	}
+
+	if info, err := os.Stat(filepath.Join(out, "empty.txt")); err != nil || !info.Mode().IsRegular() {
+		t.Errorf("regular file not restored: %v", err)
+	}
+	for _, name := range []string{"fifo", "tty"} {
+		if _, err := os.Lstat(filepath.Join(out, name)); !os.IsNotExist(err) {
+			t.Errorf("%s restored: %v", name, err)
+		}
+	}
+}
@@ -9,8 +9,10 @@ import (
 	"path/filepath"
 	"strings"
 	"sync/atomic"
+	"time"
 
 	"github.com/fidrasofyan/db-backup/internal/config"
+	"github.com/fidrasofyan/db-backup/internal/report"
 	"github.com/fidrasofyan/db-backup/internal/service"
 	"golang.org/x/sync/errgroup"
 )
@@ -18,9 +20,16 @@ import (
 type FileInfo struct {
 	Name string
 	Path string
+	Size int64
 }
 
-func Upload(ctx context.Context, cfg *config.Config, storageService *service.Storage) error {
+// Upload uploads the files in local_dir that dest doesn't have yet. Snapshot
+// indexes only go to the primary, which stores their chunks.
+func Upload(ctx context.Context, cfg *config.Config, dest *Destination, run *report.Run) error {
+	storageService := dest.Backend
+	cfg = dest.config(cfg)
+	log.Printf("uploading to destination: %s\n", dest.Name)
+
 	// Scan directory
 	files := []FileInfo{}
 
@@ -31,9 +40,22 @@ func Upload(ctx context.Context, cfg *config.Config, storageService *service.Sto
 		if d.IsDir() {
 			return nil
 		}
+		// Skip dumps that are still being written, upload states and cached
+		// checksums
+		if strings.HasSuffix(d.Name(), partialFileExt) || isUploadState(d.Name()) || isChecksumCache(d.Name()) {
+			return nil
+		}
+		if !dest.primary && isSnapshotName(d.Name()) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
 		files = append(files, FileInfo{
 			Name: d.Name(),
 			Path: path,
+			Size: info.Size(),
 		})
 		return nil
 	})
@@ -42,17 +64,31 @@ func Upload(ctx context.Context, cfg *config.Config, storageService *service.Sto
 		return fmt.Errorf("failed to scan directory: %v", err)
 	}
 
+	// Don't upload backups the destination's own retention would delete
+	// right away, e.g. older local backups kept longer than there
+	expired := expiredFiles(cfg, dest, files, time.Now())
+
+	// Only files of this run's databases are counted in the report
+	names := map[string]bool{}
+	for _, name := range backupNames(cfg) {
+		names[name] = true
+	}
+
 	// Upload files concurrently
 	g, gctx := errgroup.WithContext(ctx)
-	g.SetLimit(5)
+	g.SetLimit(cfg.UploadConcurrency)
 
 	var (
 		uploadedCounter int32
 		skippedCounter  int32
+		uploadedBytes   int64
 	)
 
 	for _, fileInfo := range files {
 		fi := fileInfo
+		if expired[fi.Path] {
+			continue
+		}
 
 		g.Go(func() error {
 			select {
@@ -68,24 +104,40 @@ func Upload(ctx context.Context, cfg *config.Config, storageService *service.Sto
 			}
 			s3Key := fmt.Sprintf("%s/%s", strings.TrimLeft(cfg.RemoteDir, "/"), relPath)
 
-			// Is file exists in S3?
-			exists, err := storageService.IsFileExists(ctx, cfg.AWS.Bucket, s3Key)
+			// Is the same file already in S3?
+			obj, err := storageService.Stat(ctx, s3Key)
 			if err != nil {
 				return fmt.Errorf("failed to check if file exists: %v", err)
 			}
-			if *exists {
-				atomic.AddInt32(&skippedCounter, 1)
-				return nil
+			if obj != nil {
+				matches, err := storageService.MatchesFile(ctx, obj, fi.Path, cfg.UploadPartSize(), fi.Path+checksumCacheExt)
+				if err != nil {
+					return fmt.Errorf("failed to compare file %s: %v", fi.Path, err)
+				}
+				if matches {
+					// Drop the state of an upload that completed before the
+					// process was stopped
+					removeUploadState(dest.stateFile(fi.Path))
+
+					atomic.AddInt32(&skippedCounter, 1)
+					recordUpload(run, names, fi, false)
+					return nil
+				}
+				log.Printf("file differs from the uploaded copy (re-uploading): %s\n", fi.Path)
 			}
 
 			// Upload file
 			log.Printf("uploading file: %s\n", fi.Path)
 			err = storageService.Upload(ctx, &service.UploadParams{
-				PartSize:    5 * 1024 * 1024, // 5 MB
-				Concurrency: 5,
-				Bucket:      cfg.AWS.Bucket,
-				Key:         s3Key,
-				Filepath:    fi.Path,
+				PartSize:      cfg.UploadPartSize(),
+				Concurrency:   cfg.UploadPartConcurrency,
+				Key:           s3Key,
+				Filepath:      fi.Path,
+				StateFile:     dest.stateFile(fi.Path),
+				ChecksumCache: fi.Path + checksumCacheExt,
+				OnRetry: func() {
+					recordUploadRetry(run, names, fi)
+				},
 			})
 
 			if err != nil {
@@ -93,6 +145,7 @@ func Upload(ctx context.Context, cfg *config.Config, storageService *service.Sto
 					log.Printf("file is empty (skipped): %s\n", fi.Path)
 
 					atomic.AddInt32(&skippedCounter, 1)
+					recordUpload(run, names, fi, false)
 					return nil
 				}
 				return fmt.Errorf("failed to upload file %v: %v", fi.Path, err)
@@ -101,14 +154,59 @@ func Upload(ctx context.Context, cfg *config.Config, storageService *service.Sto
 			log.Printf("file uploaded: %s", s3Key)
 
 			atomic.AddInt32(&uploadedCounter, 1)
+			atomic.AddInt64(&uploadedBytes, fi.Size)
+			recordUpload(run, names, fi, true)
 			return nil
 		})
 	}
 
-	if err := g.Wait(); err != nil {
+	err = g.Wait()
+	run.UpdateDestination(dest.Name, func(d *report.Destination) {
+		d.Uploaded += int(uploadedCounter)
+		d.Skipped += int(skippedCounter)
+		d.UploadedBytes += uploadedBytes
+	})
+	if err != nil {
 		return fmt.Errorf("upload failed: %w", err)
 	}
 
 	log.Printf("uploaded: %d | skipped: %d\n", uploadedCounter, skippedCounter)
 	return nil
 }
+
+// removeUploadState deletes the upload state file at path.
+func removeUploadState(path string) {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		log.Printf("Warning: failed to delete upload state: %v\n", err)
+	}
+}
+
+// recordUploadRetry counts a retried request while uploading a backup file,
+// see recordUpload.
+func recordUploadRetry(run *report.Run, names map[string]bool, fi FileInfo) {
+	dbName, _, _, ok := parseBackupName(fi.Name)
+	if !ok || !names[dbName] {
+		return
+	}
+	run.Update(dbName, func(d *report.Database) {
+		d.UploadRetries++
+	})
+}
+
+// recordUpload counts an uploaded or skipped backup file for its database.
+// Files that aren't backups of names, such as manifests or the backups of
+// other jobs, are not counted.
+func recordUpload(run *report.Run, names map[string]bool, fi FileInfo, uploaded bool) {
+	dbName, _, _, ok := parseBackupName(fi.Name)
+	if !ok || !names[dbName] {
+		return
+	}
+	run.Update(dbName, func(d *report.Database) {
+		if uploaded {
+			d.Uploaded++
+			d.UploadedBytes += fi.Size
+		} else {
+			d.Skipped++
+		}
+	})
+}
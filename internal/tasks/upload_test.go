@@ -0,0 +1,226 @@
+package tasks
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fidrasofyan/db-backup/internal/config"
+	"github.com/fidrasofyan/db-backup/internal/report"
+	"github.com/fidrasofyan/db-backup/internal/service"
+)
+
+// testConfig returns a config backing up database app into a temporary
+// local_dir.
+func testConfig(t *testing.T) *config.Config {
+	t.Helper()
+	return &config.Config{
+		DBConfigurations:      []config.BackupDBConfig{{Type: "postgres", DBName: "app"}},
+		LocalDir:              t.TempDir(),
+		RemoteDir:             "backups",
+		UploadConcurrency:     1,
+		UploadPartConcurrency: 1,
+		UploadPartSizeMB:      5,
+	}
+}
+
+// writeFile writes a file in local_dir and returns its path.
+func writeFile(t *testing.T, cfg *config.Config, name, data string) string {
+	t.Helper()
+	path := filepath.Join(cfg.LocalDir, name)
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// testDestination returns a destination storing objects in memory under
+// prefix.
+func testDestination(name, prefix string, primary bool) *Destination {
+	return &Destination{
+		DestinationConfig: &config.DestinationConfig{Name: name, Prefix: prefix},
+		Backend:           service.NewMemoryBackend(),
+		primary:           primary,
+	}
+}
+
+// objectKeys returns the keys of the objects in backend, sorted.
+func objectKeys(t *testing.T, backend service.Backend) []string {
+	t.Helper()
+	objects, err := backend.List(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for _, obj := range objects {
+		keys = append(keys, obj.Key)
+	}
+	return keys
+}
+
+func destinationReport(t *testing.T, run *report.Run, name string) report.Destination {
+	t.Helper()
+	for _, d := range run.Destinations() {
+		if d.Name == name {
+			return d
+		}
+	}
+	t.Fatalf("no report for destination %s", name)
+	return report.Destination{}
+}
+
+// failingBackend fails the uploads of the keys in fail.
+type failingBackend struct {
+	*service.MemoryBackend
+	fail map[string]bool
+}
+
+func (b *failingBackend) Upload(ctx context.Context, params *service.UploadParams) error {
+	if b.fail[params.Key] {
+		return errors.New("connection reset")
+	}
+	return b.MemoryBackend.Upload(ctx, params)
+}
+
+func TestUploadSkipsUploadedFiles(t *testing.T) {
+	ctx := context.Background()
+	cfg := testConfig(t)
+	dest := testDestination("default", "backups", true)
+	first := writeFile(t, cfg, "app_20240101-020000.sql.gz", "first")
+	writeFile(t, cfg, "app_20240102-020000.sql.gz", "second")
+	writeFile(t, cfg, "app_20240103-020000.sql.gz.partial", "still dumping")
+	writeFile(t, cfg, "app_20240102-020000.sql.gz.upload", "{}")
+
+	run := report.New()
+	if err := Upload(ctx, cfg, dest, run); err != nil {
+		t.Fatalf("Upload() = %v", err)
+	}
+	want := []string{"backups/app_20240101-020000.sql.gz", "backups/app_20240102-020000.sql.gz"}
+	if keys := objectKeys(t, dest.Backend); !slices.Equal(keys, want) {
+		t.Fatalf("objects = %q, want %q", keys, want)
+	}
+	if d := destinationReport(t, run, "default"); d.Uploaded != 2 || d.Skipped != 0 || d.UploadedBytes != 11 {
+		t.Errorf("report = %+v, want 2 uploaded files of 11 bytes", d)
+	}
+
+	// Nothing changed, so nothing is uploaded again
+	run = report.New()
+	if err := Upload(ctx, cfg, dest, run); err != nil {
+		t.Fatalf("Upload() = %v", err)
+	}
+	if d := destinationReport(t, run, "default"); d.Uploaded != 0 || d.Skipped != 2 {
+		t.Errorf("report = %+v, want 2 skipped files", d)
+	}
+	if _, err := os.Stat(first + checksumCacheExt); err != nil {
+		t.Errorf("checksum not cached: %v", err)
+	}
+
+	// A file whose content changed is uploaded again
+	if err := os.WriteFile(first, []byte("FIRST"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(first, time.Now(), time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	run = report.New()
+	if err := Upload(ctx, cfg, dest, run); err != nil {
+		t.Fatalf("Upload() = %v", err)
+	}
+	if d := destinationReport(t, run, "default"); d.Uploaded != 1 || d.Skipped != 1 {
+		t.Errorf("report = %+v, want 1 uploaded and 1 skipped file", d)
+	}
+	if dbs := run.Databases(); len(dbs) != 1 || dbs[0].Uploaded != 1 || dbs[0].Skipped != 1 {
+		t.Errorf("database report = %+v", dbs)
+	}
+}
+
+func TestUploadResumesAfterFailure(t *testing.T) {
+	ctx := context.Background()
+	cfg := testConfig(t)
+	backend := &failingBackend{
+		MemoryBackend: service.NewMemoryBackend(),
+		fail:          map[string]bool{"backups/app_20240102-020000.sql.gz": true},
+	}
+	dest := &Destination{
+		DestinationConfig: &config.DestinationConfig{Name: "default", Prefix: "backups"},
+		Backend:           backend,
+		primary:           true,
+	}
+	writeFile(t, cfg, "app_20240101-020000.sql.gz", "first")
+	writeFile(t, cfg, "app_20240102-020000.sql.gz", "second")
+
+	err := Upload(ctx, cfg, dest, report.New())
+	if err == nil || !strings.Contains(err.Error(), "connection reset") {
+		t.Fatalf("Upload() = %v, want the upload error", err)
+	}
+	if keys := objectKeys(t, backend); !slices.Equal(keys, []string{"backups/app_20240101-020000.sql.gz"}) {
+		t.Fatalf("objects = %q", keys)
+	}
+
+	// The next run only uploads what is missing
+	backend.fail = nil
+	run := report.New()
+	if err := Upload(ctx, cfg, dest, run); err != nil {
+		t.Fatalf("Upload() = %v", err)
+	}
+	if d := destinationReport(t, run, "default"); d.Uploaded != 1 || d.Skipped != 1 {
+		t.Errorf("report = %+v, want 1 uploaded and 1 skipped file", d)
+	}
+}
+
+func TestReplicateToDestinations(t *testing.T) {
+	ctx := context.Background()
+	cfg := testConfig(t)
+	cfg.BackupDirs = []config.BackupDirConfig{{Name: "uploads", Mode: "snapshot"}}
+	writeFile(t, cfg, "app_20240101-020000.sql.gz", "first")
+	writeFile(t, cfg, "app_20240102-020000.sql.gz", "second")
+	writeFile(t, cfg, "uploads_20240102-020000.snapshot.gz", "index")
+
+	primary := testDestination("primary", "backups", true)
+	offsite := testDestination("offsite", "offsite", false)
+	offsite.Retention = &config.RetentionConfig{KeepLast: 1}
+	flaky := &Destination{
+		DestinationConfig: &config.DestinationConfig{Name: "flaky", Prefix: "backups", OnFailure: "warning"},
+		Backend: &failingBackend{
+			MemoryBackend: service.NewMemoryBackend(),
+			fail:          map[string]bool{"backups/app_20240101-020000.sql.gz": true},
+		},
+	}
+	dests := Destinations{primary, offsite, flaky}
+
+	upload := func(dest *Destination) error {
+		return Upload(ctx, cfg, dest, report.New())
+	}
+	run := report.New()
+	if err := replicate(dests, run, upload); err != nil {
+		t.Fatalf("replicate() = %v, want only a warning", err)
+	}
+
+	want := []string{"backups/app_20240101-020000.sql.gz", "backups/app_20240102-020000.sql.gz", "backups/uploads_20240102-020000.snapshot.gz"}
+	if keys := objectKeys(t, primary.Backend); !slices.Equal(keys, want) {
+		t.Errorf("primary objects = %q, want %q", keys, want)
+	}
+	// Snapshot indexes stay with their chunks on the primary, and backups
+	// the destination's retention would delete aren't uploaded
+	if keys := objectKeys(t, offsite.Backend); !slices.Equal(keys, []string{"offsite/app_20240102-020000.sql.gz"}) {
+		t.Errorf("offsite objects = %q", keys)
+	}
+	if d := destinationReport(t, run, "primary"); !d.Success {
+		t.Errorf("primary report = %+v", d)
+	}
+	if d := destinationReport(t, run, "flaky"); d.Success || !d.Optional || !strings.Contains(d.Error, "connection reset") {
+		t.Errorf("flaky report = %+v, want an optional failure", d)
+	}
+
+	// Required destinations fail the run
+	flaky.OnFailure = ""
+	err := replicate(dests, report.New(), upload)
+	if err == nil || !strings.Contains(err.Error(), "destination flaky") {
+		t.Errorf("replicate() = %v, want the error of destination flaky", err)
+	}
+}
@@ -0,0 +1,122 @@
+package tasks
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+
+	"github.com/fidrasofyan/db-backup/internal/config"
+	"github.com/fidrasofyan/db-backup/internal/service"
+)
+
+type VerifyParams struct {
+	// Manifest is a local manifest path, or "latest" to use the newest
+	// manifest under remote_dir
+	Manifest string
+	// Download re-downloads every object to compare its SHA-256, instead of
+	// only checking its size
+	Download bool
+}
+
+func Verify(ctx context.Context, cfg *config.Config, storageService service.Backend, params *VerifyParams) error {
+	manifest, err := loadManifest(ctx, cfg, storageService, params.Manifest)
+	if err != nil {
+		return err
+	}
+
+	var failedCounter int
+	for _, f := range manifest.Files {
+		// The manifest records the keys in the primary; every destination
+		// stores the files under its own prefix
+		f.S3Key = path.Join(cfg.RemoteDir, path.Base(f.S3Key))
+
+		if err := verifyFile(ctx, cfg, storageService, f, params.Download); err != nil {
+			log.Printf("FAILED: %s: %v\n", f.S3Key, err)
+			failedCounter++
+			continue
+		}
+		log.Printf("OK: %s\n", f.S3Key)
+	}
+
+	log.Printf("verified: %d | failed: %d\n", len(manifest.Files)-failedCounter, failedCounter)
+	if failedCounter > 0 {
+		return fmt.Errorf("verification failed for %d of %d files", failedCounter, len(manifest.Files))
+	}
+	return nil
+}
+
+func verifyFile(ctx context.Context, cfg *config.Config, storageService service.Backend, f ManifestFile, download bool) error {
+	obj, err := storageService.Stat(ctx, f.S3Key)
+	if err != nil {
+		return fmt.Errorf("failed to stat object: %v", err)
+	}
+	if obj == nil {
+		return fmt.Errorf("object not found")
+	}
+	if obj.Size != f.Size {
+		return fmt.Errorf("size mismatch: expected %d, got %d", f.Size, obj.Size)
+	}
+	if !download {
+		return nil
+	}
+
+	body, err := storageService.Get(ctx, f.S3Key)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, body); err != nil {
+		return fmt.Errorf("failed to download object: %v", err)
+	}
+	if sum := hex.EncodeToString(hash.Sum(nil)); sum != f.SHA256 {
+		return fmt.Errorf("checksum mismatch: expected %s, got %s", f.SHA256, sum)
+	}
+	return nil
+}
+
+func loadManifest(ctx context.Context, cfg *config.Config, storageService service.Backend, manifestPath string) (*Manifest, error) {
+	var data []byte
+
+	if manifestPath == "" || manifestPath == "latest" {
+		objects, err := storageService.List(ctx, cfg.RemoteDir+"/")
+		if err != nil {
+			return nil, err
+		}
+		keys := make([]string, len(objects))
+		for i, obj := range objects {
+			keys[i] = obj.Key
+		}
+		key, ok := latestManifestKey(keys)
+		if !ok {
+			return nil, fmt.Errorf("no manifest found under %s", cfg.RemoteDir)
+		}
+		log.Printf("using manifest: %s\n", key)
+
+		body, err := storageService.Get(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		defer body.Close()
+
+		data, err = io.ReadAll(body)
+		if err != nil {
+			return nil, fmt.Errorf("failed to download manifest: %v", err)
+		}
+	} else {
+		var err error
+		data, err = os.ReadFile(manifestPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read manifest: %v", err)
+		}
+	}
+
+	return decodeManifest(bytes.NewReader(data))
+}
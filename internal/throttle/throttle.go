@@ -0,0 +1,187 @@
+package throttle
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// burst is the most bytes let through at once. Reads are split to fit.
+const burst = 64 * 1024
+
+var rateUnits = []struct {
+	suffix string
+	size   int64
+}{
+	// Longest suffixes first, so KiB isn't read as B
+	{"KiB", 1 << 10},
+	{"MiB", 1 << 20},
+	{"GiB", 1 << 30},
+	{"KB", 1000},
+	{"MB", 1000 * 1000},
+	{"GB", 1000 * 1000 * 1000},
+	{"B", 1},
+}
+
+// ParseRate parses a rate such as 20MB/s, 512KiB/s or 1000000 in bytes per
+// second. KB, MB and GB are powers of 1000, KiB, MiB and GiB powers of 1024.
+// Zero means unlimited.
+func ParseRate(s string) (int64, error) {
+	v := strings.TrimSuffix(strings.TrimSpace(s), "/s")
+	size := int64(1)
+	for _, unit := range rateUnits {
+		if strings.HasSuffix(v, unit.suffix) {
+			v = strings.TrimSuffix(v, unit.suffix)
+			size = unit.size
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid rate %q", s)
+	}
+	return int64(n * float64(size)), nil
+}
+
+// FormatRate formats bytes per second for logs.
+func FormatRate(bytesPerSecond int64) string {
+	if bytesPerSecond <= 0 {
+		return "unlimited"
+	}
+	switch {
+	case bytesPerSecond >= 1000*1000:
+		return fmt.Sprintf("%.1fMB/s", float64(bytesPerSecond)/(1000*1000))
+	case bytesPerSecond >= 1000:
+		return fmt.Sprintf("%.1fKB/s", float64(bytesPerSecond)/1000)
+	default:
+		return fmt.Sprintf("%dB/s", bytesPerSecond)
+	}
+}
+
+// Window overrides the default rate between two times of day. A window whose
+// To is before its From spans midnight.
+type Window struct {
+	// From and To are offsets from midnight
+	From time.Duration
+	To   time.Duration
+	Rate int64
+}
+
+func (w Window) contains(offset time.Duration) bool {
+	if w.From <= w.To {
+		return offset >= w.From && offset < w.To
+	}
+	return offset >= w.From || offset < w.To
+}
+
+// Schedule is a rate in bytes per second that may depend on the time of day.
+// Zero rates are unlimited, so the zero Schedule never throttles.
+type Schedule struct {
+	Default int64
+	// Windows are checked in order, the first one containing the time wins
+	Windows []Window
+}
+
+func (s Schedule) IsZero() bool {
+	return s.Default == 0 && len(s.Windows) == 0
+}
+
+// RateAt returns the rate at t, in t's location.
+func (s Schedule) RateAt(t time.Time) int64 {
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	offset := t.Sub(midnight)
+	for _, w := range s.Windows {
+		if w.contains(offset) {
+			return w.Rate
+		}
+	}
+	return s.Default
+}
+
+// Limiter shares one bandwidth budget between all readers it wraps.
+type Limiter struct {
+	schedule Schedule
+	limiter  *rate.Limiter
+
+	mu      sync.Mutex
+	current int64
+}
+
+// NewLimiter returns a limiter following schedule, or nil if the schedule
+// never throttles. A nil *Limiter doesn't throttle.
+func NewLimiter(schedule Schedule) *Limiter {
+	if schedule.IsZero() {
+		return nil
+	}
+	l := &Limiter{
+		schedule: schedule,
+		limiter:  rate.NewLimiter(rate.Inf, burst),
+		current:  -1,
+	}
+	l.update(time.Now())
+	return l
+}
+
+// update applies the rate of the schedule at now.
+func (l *Limiter) update(now time.Time) {
+	r := l.schedule.RateAt(now)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if r == l.current {
+		return
+	}
+	if l.current >= 0 {
+		log.Printf("upload rate limit: %s\n", FormatRate(r))
+	}
+	l.current = r
+	if r <= 0 {
+		l.limiter.SetLimitAt(now, rate.Inf)
+	} else {
+		l.limiter.SetLimitAt(now, rate.Limit(r))
+	}
+}
+
+// wait blocks until n bytes, at most burst, may pass.
+func (l *Limiter) wait(ctx context.Context, n int) error {
+	l.update(time.Now())
+	return l.limiter.WaitN(ctx, n)
+}
+
+// Reader returns r limited by l. Reads are cut to at most burst bytes.
+func (l *Limiter) Reader(ctx context.Context, r io.ReadCloser) io.ReadCloser {
+	if l == nil {
+		return r
+	}
+	return &reader{ctx: ctx, r: r, limiter: l}
+}
+
+type reader struct {
+	ctx     context.Context
+	r       io.ReadCloser
+	limiter *Limiter
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	if len(p) > burst {
+		p = p[:burst]
+	}
+	n, err := r.r.Read(p)
+	if n > 0 {
+		if werr := r.limiter.wait(r.ctx, n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+func (r *reader) Close() error {
+	return r.r.Close()
+}